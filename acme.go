@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acmeClient talks to an ACME server such as Let's Encrypt, see RFC 8555.
+// Requests are signed with the account key as JWS with ES256.
+type acmeClient struct {
+	sync.Mutex
+	directoryURL string
+	client       *http.Client
+	key          *ecdsa.PrivateKey
+	// kid is the account URL, known once the account is registered
+	kid       string
+	directory *acmeDirectory
+	nonces    []string
+}
+
+// acmeDirectory lists the ACME server's endpoints
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+// acmeOrder is a request for a certificate, see RFC 8555 section 7.1.3
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+	url            string
+}
+
+// acmeAuthorization is the proof of control over an identifier that the
+// server asks for, see RFC 8555 section 7.1.4
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is an error returned by the ACME server, see RFC 7807
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+	// retryAfter is when a rate limited request may be tried again
+	retryAfter time.Duration
+}
+
+func (p *acmeProblem) Error() string {
+	return fmt.Sprintf("%s: %s", p.Type, p.Detail)
+}
+
+const (
+	acmeErrorBadNonce    = "urn:ietf:params:acme:error:badNonce"
+	acmeErrorRateLimited = "urn:ietf:params:acme:error:rateLimited"
+)
+
+// acmePollTimeout limits how long authorizations and orders are polled for
+const acmePollTimeout = 2 * time.Minute
+
+func newACMEClient(directoryURL string, key *ecdsa.PrivateKey, client *http.Client) *acmeClient {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &acmeClient{
+		directoryURL: directoryURL,
+		client:       client,
+		key:          key,
+	}
+}
+
+// discover fetches the directory, once
+func (c *acmeClient) discover() (*acmeDirectory, error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.directory != nil {
+		return c.directory, nil
+	}
+	resp, err := c.client.Get(c.directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ACME directory %s: %s", c.directoryURL, resp.Status)
+	}
+	directory := &acmeDirectory{}
+	if err := json.NewDecoder(resp.Body).Decode(directory); err != nil {
+		return nil, err
+	}
+	c.directory = directory
+	return directory, nil
+}
+
+// nonce returns a fresh anti-replay nonce
+func (c *acmeClient) nonce() (string, error) {
+	c.Lock()
+	if len(c.nonces) > 0 {
+		nonce := c.nonces[len(c.nonces)-1]
+		c.nonces = c.nonces[:len(c.nonces)-1]
+		c.Unlock()
+		return nonce, nil
+	}
+	c.Unlock()
+
+	directory, err := c.discover()
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.client.Head(directory.NewNonce)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("ACME server sent no nonce")
+	}
+	return nonce, nil
+}
+
+// post sends a signed request to url, a nil payload makes it a POST-as-GET.
+// The response is decoded into result if it isn't nil.
+func (c *acmeClient) post(url string, payload interface{}, result interface{}) (*http.Response, []byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		nonce, err := c.nonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		signed, err := c.sign(url, body, nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := c.client.Post(url, "application/jose+json", bytes.NewReader(signed))
+		if err != nil {
+			return nil, nil, err
+		}
+		content, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if nonce := resp.Header.Get("Replay-Nonce"); nonce != "" {
+			c.Lock()
+			c.nonces = append(c.nonces, nonce)
+			c.Unlock()
+		}
+		if resp.StatusCode >= 400 {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			if json.Unmarshal(content, problem) != nil || problem.Type == "" {
+				return resp, content, fmt.Errorf("ACME request to %s: %s", url, resp.Status)
+			}
+			// a nonce might expire between getting and using it
+			if problem.Type == acmeErrorBadNonce && attempt < 3 {
+				continue
+			}
+			problem.retryAfter = retryAfter(resp, time.Hour)
+			return resp, content, problem
+		}
+		if result != nil {
+			if err := json.Unmarshal(content, result); err != nil {
+				return resp, content, err
+			}
+		}
+		return resp, content, nil
+	}
+}
+
+// sign wraps payload in a JWS in flattened JSON serialization, see RFC 8555
+// section 6.2. The account is identified by its key until it's registered.
+func (c *acmeClient) sign(url string, payload []byte, nonce string) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": nonce,
+		"url":   url,
+	}
+	c.Lock()
+	kid := c.kid
+	c.Unlock()
+	if kid != "" {
+		protected["kid"] = kid
+	} else {
+		protected["jwk"] = jwk(c.key)
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	// ES256 signatures are the two 32 byte integers, not ASN.1
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk returns the public part of key as JSON Web Key, with only the members
+// that go into its thumbprint, see RFC 7638
+func jwk(key *ecdsa.PrivateKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	return map[string]string{
+		"crv": key.Curve.Params().Name,
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(x),
+		"y":   base64.RawURLEncoding.EncodeToString(y),
+	}
+}
+
+// thumbprint returns the JWK thumbprint of the account key
+func (c *acmeClient) thumbprint() string {
+	// encoding/json sorts map keys, which is the order RFC 7638 requires
+	encoded, _ := json.Marshal(jwk(c.key))
+	hash := sha256.Sum256(encoded)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// keyAuthorization returns what has to be served for a challenge token
+func (c *acmeClient) keyAuthorization(token string) string {
+	return token + "." + c.thumbprint()
+}
+
+// register creates the account, or finds the existing one for the key
+func (c *acmeClient) register(email string) error {
+	c.Lock()
+	registered := c.kid != ""
+	c.Unlock()
+	if registered {
+		return nil
+	}
+	directory, err := c.discover()
+	if err != nil {
+		return err
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := c.post(directory.NewAccount, account, nil)
+	if err != nil {
+		return err
+	}
+	kid := resp.Header.Get("Location")
+	if kid == "" {
+		return errors.New("ACME server sent no account URL")
+	}
+	c.Lock()
+	c.kid = kid
+	c.Unlock()
+	return nil
+}
+
+// newOrder asks for a certificate for domain
+func (c *acmeClient) newOrder(domain string) (*acmeOrder, error) {
+	directory, err := c.discover()
+	if err != nil {
+		return nil, err
+	}
+	order := &acmeOrder{}
+	request := map[string]interface{}{
+		"identifiers": []acmeIdentifier{{Type: "dns", Value: domain}},
+	}
+	resp, _, err := c.post(directory.NewOrder, request, order)
+	if err != nil {
+		return nil, err
+	}
+	order.url = resp.Header.Get("Location")
+	return order, nil
+}
+
+// authorization fetches an authorization of an order
+func (c *acmeClient) authorization(url string) (*acmeAuthorization, error) {
+	authorization := &acmeAuthorization{}
+	_, _, err := c.post(url, nil, authorization)
+	return authorization, err
+}
+
+// accept tells the server that the response to a challenge is in place
+func (c *acmeClient) accept(challenge acmeChallenge) error {
+	_, _, err := c.post(challenge.URL, struct{}{}, nil)
+	return err
+}
+
+// waitAuthorization polls an authorization until the server has decided
+// whether it's valid
+func (c *acmeClient) waitAuthorization(url string) error {
+	deadline := time.Now().Add(acmePollTimeout)
+	for {
+		authorization := &acmeAuthorization{}
+		resp, _, err := c.post(url, nil, authorization)
+		if err != nil {
+			return err
+		}
+		switch authorization.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, challenge := range authorization.Challenges {
+				if challenge.Error != nil {
+					return fmt.Errorf("authorization %s: %s", authorization.Status, challenge.Error)
+				}
+			}
+			return fmt.Errorf("authorization %s", authorization.Status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("authorization still %s", authorization.Status)
+		}
+		time.Sleep(retryAfter(resp, time.Second))
+	}
+}
+
+// finalize submits the certificate signing request and returns the PEM
+// encoded certificate chain once it's issued
+func (c *acmeClient) finalize(order *acmeOrder, csr []byte) ([]byte, error) {
+	request := map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}
+	resp, _, err := c.post(order.Finalize, request, order)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(acmePollTimeout)
+	for order.Status != "valid" {
+		if order.Status != "processing" && order.Status != "pending" && order.Status != "ready" {
+			if order.Error != nil {
+				return nil, fmt.Errorf("order %s: %s", order.Status, order.Error)
+			}
+			return nil, fmt.Errorf("order %s", order.Status)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("order still %s", order.Status)
+		}
+		time.Sleep(retryAfter(resp, time.Second))
+		if resp, _, err = c.post(order.url, nil, order); err != nil {
+			return nil, err
+		}
+	}
+	_, chain, err := c.post(order.Certificate, nil, nil)
+	return chain, err
+}
+
+// retryAfter returns how long the server asked to wait with the Retry-After
+// header, or def
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return def
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// acmeChallengePath is where ACME servers look for HTTP-01 challenge
+// responses, see RFC 8555 section 8.3
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// challengeStore holds the key authorizations for pending HTTP-01
+// challenges, keyed by token. Tokens set through the admin API or the ACME
+// client are kept in memory, others are read from files named after the
+// token in dir.
+type challengeStore struct {
+	sync.Mutex
+	dir    string
+	tokens map[string]string
+}
+
+func newChallengeStore(dir string) *challengeStore {
+	return &challengeStore{
+		dir:    dir,
+		tokens: make(map[string]string),
+	}
+}
+
+// Set adds or replaces the key authorization for token
+func (s *challengeStore) Set(token, keyAuth string) {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens[token] = keyAuth
+}
+
+// Delete removes token once its challenge is done
+func (s *challengeStore) Delete(token string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.tokens, token)
+}
+
+// Get returns the key authorization for token
+func (s *challengeStore) Get(token string) (string, bool) {
+	if s == nil || !isValidToken(token) {
+		return "", false
+	}
+	s.Lock()
+	keyAuth, ok := s.tokens[token]
+	s.Unlock()
+	if ok || s.dir == "" {
+		return keyAuth, ok
+	}
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, token))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(content)), true
+}
+
+// isValidToken returns true if token only contains characters from the
+// base64url alphabet, which also keeps it from escaping the directory
+func isValidToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	for _, c := range token {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// acmeChallengeToken returns the token if the request line is for an
+// HTTP-01 challenge response
+func acmeChallengeToken(line string) (string, bool) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || (parts[0] != http.MethodGet && parts[0] != http.MethodHead) {
+		return "", false
+	}
+	target := requestTarget(line)
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		target = target[:i]
+	}
+	if !strings.HasPrefix(target, acmeChallengePath) {
+		return "", false
+	}
+	return strings.TrimPrefix(target, acmeChallengePath), true
+}
+
+// answerChallenge responds to an HTTP-01 challenge request with the key
+// authorization and closes the connection
+func (p *ConnectionProxy) answerChallenge(downstream net.Conn, line, token, keyAuth, hostname string) bool {
+	body := keyAuth
+	if strings.HasPrefix(line, http.MethodHead+" ") {
+		body = ""
+	}
+	_, err := fmt.Fprintf(downstream, "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		len(keyAuth), body)
+	if err != nil {
+		return p.LogDebug(fmt.Sprintf("Error while answering ACME challenge: %s", err), hostname, downstream)
+	}
+	p.Close(downstream)
+	p.logger.Printf("%s\n", NewLogData(fmt.Sprintf("ACME challenge %s", token), "ACCESS", hostname, downstream))
+	return true
+}
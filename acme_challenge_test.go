@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACMEChallengeToken(t *testing.T) {
+	tests := []struct {
+		line  string
+		token string
+		ok    bool
+	}{
+		{"GET /.well-known/acme-challenge/abc_DEF-123 HTTP/1.1", "abc_DEF-123", true},
+		{"HEAD /.well-known/acme-challenge/abc HTTP/1.1", "abc", true},
+		{"GET http://example.com/.well-known/acme-challenge/abc?x=1 HTTP/1.1", "abc", true},
+		{"POST /.well-known/acme-challenge/abc HTTP/1.1", "", false},
+		{"GET /.well-known/acme-challenge HTTP/1.1", "", false},
+		{"GET / HTTP/1.1", "", false},
+	}
+	for _, test := range tests {
+		token, ok := acmeChallengeToken(test.line)
+		if token != test.token || ok != test.ok {
+			t.Errorf("%q: expected %q %v, got %q %v", test.line, test.token, test.ok, token, ok)
+		}
+	}
+}
+
+func TestChallengeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensible-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "fromfile"), []byte("fromfile.thumbprint\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := newChallengeStore(dir)
+	store.Set("frommemory", "frommemory.thumbprint")
+	tests := []struct {
+		token   string
+		keyAuth string
+		ok      bool
+	}{
+		{"frommemory", "frommemory.thumbprint", true},
+		{"fromfile", "fromfile.thumbprint", true},
+		{"missing", "", false},
+		{"secret.txt", "", false},
+		{"../" + filepath.Base(dir) + "/fromfile", "", false},
+	}
+	for _, test := range tests {
+		keyAuth, ok := store.Get(test.token)
+		if keyAuth != test.keyAuth || ok != test.ok {
+			t.Errorf("%s: expected %q %v, got %q %v", test.token, test.keyAuth, test.ok, keyAuth, ok)
+		}
+	}
+
+	store.Delete("frommemory")
+	if _, ok := store.Get("frommemory"); ok {
+		t.Error("Expected deleted token to be gone")
+	}
+	var none *challengeStore
+	if _, ok := none.Get("frommemory"); ok {
+		t.Error("Expected no tokens without a store")
+	}
+}
+
+func TestHTTPACMEChallenge(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w, "example.com")
+	proxy.challenges = newChallengeStore("")
+	proxy.challenges.Set("LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0", "LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0.9jg46WB3rR_AHD-EBXdN7cBkH1WOu0tA3M9fm21mqTI")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionRedirect}}}
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	// the request as sent by an ACME server validating the challenge
+	response, err := requestHTTPRaw("GET /.well-known/acme-challenge/LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0 HTTP/1.1\r\n"+
+		"Host: example.com\r\nUser-Agent: Pebble\r\nAccept: */*\r\nAccept-Encoding: gzip\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 200 OK\r\n") ||
+		!strings.HasSuffix(string(response), "\r\n\r\nLoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0.9jg46WB3rR_AHD-EBXdN7cBkH1WOu0tA3M9fm21mqTI") {
+		t.Errorf("Expected the key authorization, got %q", response)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected no upstream to be dialed, got %s", <-dialed)
+	}
+	if !strings.Contains(string(w.Content()), "ACME challenge LoqXcYV8q5ONbJQxbmR7SCTNo3tiAXDfowyjxAjEuX0") {
+		t.Errorf("Expected the challenge to be logged, got %q", w.Content())
+	}
+}
+
+func TestHTTPACMEChallengeUpstream(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	proxy.challenges = newChallengeStore("")
+	proxy.challengeUpstream = "challenges.internal:8080"
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionRedirect, ProxyProtocol: proxyProtocolV1}}}
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	request := "GET /.well-known/acme-challenge/unknown HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := <-dialed; address != "challenges.internal:8080" {
+		t.Errorf("Expected the challenge server to be dialed, got %s", address)
+	}
+	// neither redirected nor sent a PROXY header
+	if string(response) != request {
+		t.Errorf("Expected the challenge server to receive %q, got %q", request, response)
+	}
+}
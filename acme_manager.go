@@ -0,0 +1,485 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACME challenge types, see RFC 8555 section 8.3 and RFC 8737
+const (
+	acmeChallengeTLSALPN = "tls-alpn-01"
+	acmeChallengeHTTP    = "http-01"
+)
+
+// acmeALPNProtocol is offered by ACME servers validating a tls-alpn-01
+// challenge
+const acmeALPNProtocol = "acme-tls/1"
+
+// oidACMEIdentifier is the certificate extension that carries the hash of
+// the key authorization for tls-alpn-01
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+const (
+	// acmeAccountKey is the name the account key is stored under
+	acmeAccountKey = "acme-account.key"
+	// acmeRenewBefore is how long before expiry certificates are renewed
+	acmeRenewBefore = 30 * 24 * time.Hour
+	// acmeWaitTimeout is how long a TLS handshake waits for a certificate
+	// to be obtained, after that it fails but the order carries on
+	acmeWaitTimeout = 30 * time.Second
+	// acmeRenewInterval is how often obtained certificates are checked
+	acmeRenewInterval = 12 * time.Hour
+	// failed orders for a hostname are retried after acmeMinBackoff,
+	// doubling up to acmeMaxBackoff
+	acmeMinBackoff = time.Minute
+	acmeMaxBackoff = 24 * time.Hour
+)
+
+// acmeManager obtains and renews certificates for terminated TLS
+// connections. Certificates are requested the first time a whitelisted
+// hostname is connected to, and stored in storage and the certStore.
+type acmeManager struct {
+	sync.Mutex
+	client        *acmeClient
+	email         string
+	challengeType string
+	storage       certStorage
+	certs         *certStore
+	challenges    *challengeStore
+	// allowed decides which hostnames certificates may be requested for
+	allowed func(hostname string) bool
+	logf    func(format string, v ...interface{})
+	// alpnCerts are the certificates answering pending tls-alpn-01
+	// challenges
+	alpnCerts map[string]*tls.Certificate
+	// issuing is closed once the order for a hostname is done
+	issuing map[string]chan struct{}
+	backoff map[string]*acmeBackoff
+	// managed are the hostnames with certificates from ACME
+	managed map[string]bool
+	// order serialises orders, to go easy on the server's rate limits
+	order sync.Mutex
+}
+
+// acmeBackoff keeps hostnames whose orders failed from being retried
+// straight away
+type acmeBackoff struct {
+	until    time.Time
+	failures int
+	err      error
+}
+
+// newACMEManager sets up a manager with the account key from storage,
+// creating one if there isn't any yet
+func newACMEManager(directoryURL, email string, client *http.Client, storage certStorage, certs *certStore, challenges *challengeStore) (*acmeManager, error) {
+	key, err := loadOrCreateKey(storage, acmeAccountKey)
+	if err != nil {
+		return nil, err
+	}
+	return &acmeManager{
+		client:        newACMEClient(directoryURL, key, client),
+		email:         email,
+		challengeType: acmeChallengeTLSALPN,
+		storage:       storage,
+		certs:         certs,
+		challenges:    challenges,
+		allowed:       func(string) bool { return true },
+		logf:          func(string, ...interface{}) {},
+		alpnCerts:     make(map[string]*tls.Certificate),
+		issuing:       make(map[string]chan struct{}),
+		backoff:       make(map[string]*acmeBackoff),
+		managed:       make(map[string]bool),
+	}, nil
+}
+
+// certificate returns the certificate for hostname, obtaining one if needed
+func (m *acmeManager) certificate(hostname string) (*tls.Certificate, error) {
+	hostname = strings.ToLower(hostname)
+	if !isValidCertName(hostname) {
+		return nil, fmt.Errorf("invalid hostname %q", hostname)
+	}
+	if !m.allowed(hostname) {
+		return nil, fmt.Errorf("%s is not whitelisted", hostname)
+	}
+	if cert := m.load(hostname); cert != nil {
+		m.certs.add(hostname, cert)
+		m.renewIfNeeded(hostname, cert)
+		return cert, nil
+	}
+
+	done, err := m.startOrder(hostname)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-done:
+	case <-time.After(acmeWaitTimeout):
+		return nil, fmt.Errorf("still obtaining a certificate for %s", hostname)
+	}
+	if cert := m.certs.lookup(hostname); cert != nil {
+		return cert, nil
+	}
+	m.Lock()
+	defer m.Unlock()
+	if backoff, ok := m.backoff[hostname]; ok {
+		return nil, backoff.err
+	}
+	return nil, fmt.Errorf("no certificate for %s", hostname)
+}
+
+// renewIfNeeded starts renewing cert in the background if it expires soon
+func (m *acmeManager) renewIfNeeded(hostname string, cert *tls.Certificate) {
+	if cert.Leaf == nil || time.Until(cert.Leaf.NotAfter) > acmeRenewBefore || !m.allowed(hostname) {
+		return
+	}
+	m.startOrder(hostname)
+}
+
+// periodicRenewal renews the certificates obtained so far when they're
+// about to expire. Others are renewed when they're next used.
+func (m *acmeManager) periodicRenewal(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			m.Lock()
+			var hostnames []string
+			for hostname := range m.managed {
+				hostnames = append(hostnames, hostname)
+			}
+			m.Unlock()
+			for _, hostname := range hostnames {
+				if cert := m.certs.lookup(hostname); cert != nil {
+					m.renewIfNeeded(hostname, cert)
+				}
+			}
+		}
+	}()
+}
+
+// startOrder obtains a certificate for hostname in the background, unless
+// that's already happening or it failed recently. The returned channel is
+// closed when it's done.
+func (m *acmeManager) startOrder(hostname string) (chan struct{}, error) {
+	m.Lock()
+	defer m.Unlock()
+	if done, ok := m.issuing[hostname]; ok {
+		return done, nil
+	}
+	if backoff, ok := m.backoff[hostname]; ok && time.Now().Before(backoff.until) {
+		return nil, fmt.Errorf("not ordering a certificate for %s before %s: %s", hostname, backoff.until.Format(time.RFC3339), backoff.err)
+	}
+	done := make(chan struct{})
+	m.issuing[hostname] = done
+	go func() {
+		err := m.obtain(hostname)
+		m.Lock()
+		delete(m.issuing, hostname)
+		if err != nil {
+			m.backOff(hostname, err)
+		} else {
+			delete(m.backoff, hostname)
+			m.managed[hostname] = true
+		}
+		m.Unlock()
+		close(done)
+		if err != nil {
+			m.logf("Could not obtain a certificate for %s: %s\n", hostname, err)
+		} else {
+			m.logf("Obtained a certificate for %s\n", hostname)
+		}
+	}()
+	return done, nil
+}
+
+// backOff stops orders for hostname for a while after one failed. Rate
+// limited orders wait for as long as the server asks.
+func (m *acmeManager) backOff(hostname string, err error) {
+	backoff, ok := m.backoff[hostname]
+	if !ok {
+		backoff = &acmeBackoff{}
+		m.backoff[hostname] = backoff
+	}
+	backoff.failures++
+	backoff.err = err
+	wait := acmeMinBackoff << uint(backoff.failures-1)
+	if wait > acmeMaxBackoff || wait <= 0 {
+		wait = acmeMaxBackoff
+	}
+	if problem, ok := err.(*acmeProblem); ok && problem.Type == acmeErrorRateLimited && problem.retryAfter > wait {
+		wait = problem.retryAfter
+	}
+	backoff.until = time.Now().Add(wait)
+}
+
+// obtain goes through an ACME order for hostname and stores the certificate
+func (m *acmeManager) obtain(hostname string) error {
+	m.order.Lock()
+	defer m.order.Unlock()
+
+	if err := m.client.register(m.email); err != nil {
+		return err
+	}
+	order, err := m.client.newOrder(hostname)
+	if err != nil {
+		return err
+	}
+	for _, url := range order.Authorizations {
+		if err := m.authorize(hostname, url); err != nil {
+			return err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: hostname},
+		DNSNames: []string{hostname},
+	}, key)
+	if err != nil {
+		return err
+	}
+	chain, err := m.client.finalize(order, csr)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	cert, err := parseCertificate(chain, keyPEM)
+	if err != nil {
+		return err
+	}
+	// the key first, so the certificate is never stored without it
+	if err := m.storage.Put(hostname+".key", keyPEM); err != nil {
+		return err
+	}
+	if err := m.storage.Put(hostname+".crt", chain); err != nil {
+		return err
+	}
+	m.certs.add(hostname, cert)
+	return nil
+}
+
+// authorize answers the challenge of an authorization and waits for the
+// server to validate it
+func (m *acmeManager) authorize(hostname, url string) error {
+	authorization, err := m.client.authorization(url)
+	if err != nil {
+		return err
+	}
+	if authorization.Status == "valid" {
+		return nil
+	}
+	challenge, ok := m.pickChallenge(authorization)
+	if !ok {
+		return fmt.Errorf("no supported challenge offered for %s", hostname)
+	}
+
+	keyAuth := m.client.keyAuthorization(challenge.Token)
+	switch challenge.Type {
+	case acmeChallengeHTTP:
+		m.challenges.Set(challenge.Token, keyAuth)
+		defer m.challenges.Delete(challenge.Token)
+	case acmeChallengeTLSALPN:
+		cert, err := alpnChallengeCertificate(hostname, keyAuth)
+		if err != nil {
+			return err
+		}
+		m.Lock()
+		m.alpnCerts[hostname] = cert
+		m.Unlock()
+		defer func() {
+			m.Lock()
+			delete(m.alpnCerts, hostname)
+			m.Unlock()
+		}()
+	}
+
+	if err := m.client.accept(challenge); err != nil {
+		return err
+	}
+	return m.client.waitAuthorization(url)
+}
+
+// pickChallenge returns the preferred challenge type if it's offered, or
+// else the other supported one
+func (m *acmeManager) pickChallenge(authorization *acmeAuthorization) (acmeChallenge, bool) {
+	types := []string{acmeChallengeTLSALPN, acmeChallengeHTTP}
+	if m.challengeType == acmeChallengeHTTP {
+		types = []string{acmeChallengeHTTP, acmeChallengeTLSALPN}
+	}
+	for _, challengeType := range types {
+		for _, challenge := range authorization.Challenges {
+			if challenge.Type == challengeType {
+				return challenge, true
+			}
+		}
+	}
+	return acmeChallenge{}, false
+}
+
+// alpnCertificate returns the certificate answering a pending tls-alpn-01
+// challenge for hostname
+func (m *acmeManager) alpnCertificate(hostname string) *tls.Certificate {
+	m.Lock()
+	defer m.Unlock()
+	return m.alpnCerts[strings.ToLower(hostname)]
+}
+
+// load returns the stored certificate for hostname, unless it has expired
+func (m *acmeManager) load(hostname string) *tls.Certificate {
+	cert := m.certs.lookup(hostname)
+	if cert == nil {
+		chain, err := m.storage.Get(hostname + ".crt")
+		if err != nil {
+			return nil
+		}
+		keyPEM, err := m.storage.Get(hostname + ".key")
+		if err != nil {
+			return nil
+		}
+		if cert, err = parseCertificate(chain, keyPEM); err != nil {
+			return nil
+		}
+	}
+	if isExpired(cert) {
+		return nil
+	}
+	return cert
+}
+
+// isExpired returns true if cert can no longer be used
+func isExpired(cert *tls.Certificate) bool {
+	return cert.Leaf != nil && time.Now().After(cert.Leaf.NotAfter)
+}
+
+// acmeHTTPClient returns the client for talking to the ACME server, trusting
+// the certificates in caFile as well as the system roots if it's set
+func acmeHTTPClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if caFile == "" {
+		return client, nil
+	}
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if !roots.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	client.Transport = &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	}
+	return client, nil
+}
+
+// alpnChallengeCertificate creates the self-signed certificate that proves
+// control over hostname for tls-alpn-01, see RFC 8737 section 3
+func alpnChallengeCertificate(hostname, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidACMEIdentifier, Critical: true, Value: value},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// loadOrCreateKey returns the ECDSA key stored under name, generating and
+// storing a new one if there is none
+func loadOrCreateKey(storage certStorage, name string) (*ecdsa.PrivateKey, error) {
+	content, err := storage.Get(name)
+	if err == errNotStored {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := encodeKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, storage.Put(name, encoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", name)
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// encodeKey returns key in PEM format
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+// parseCertificate combines a PEM encoded chain and key, with the leaf
+// parsed
+func parseCertificate(chain, key []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// isValidCertName returns true if hostname is safe to use in storage names
+func isValidCertName(hostname string) bool {
+	if hostname == "" || hostname[0] == '.' || hostname[0] == '-' || strings.Contains(hostname, "..") {
+		return false
+	}
+	for _, c := range hostname {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
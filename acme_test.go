@@ -0,0 +1,775 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestACMEObtainCertificate(t *testing.T) {
+	for _, challengeType := range []string{acmeChallengeTLSALPN, acmeChallengeHTTP} {
+		fake := newFakeACME(t)
+		defer fake.Close()
+		test := newACMETestProxy(t, fake)
+		defer os.RemoveAll(test.dir)
+		test.manager.challengeType = challengeType
+
+		// both challenges are offered, the preferred one has to be used
+		var mutex sync.Mutex
+		var used []string
+		fake.validate = func(challenge fakeChallenge, keyAuth string) error {
+			mutex.Lock()
+			used = append(used, challenge.Type)
+			mutex.Unlock()
+			if challenge.Type == acmeChallengeHTTP {
+				return validateHTTP01(test.httpAddress, challenge, keyAuth)
+			}
+			return validateTLSALPN01(test.httpsAddress, challenge, keyAuth)
+		}
+
+		for i := 0; i < 2; i++ {
+			response, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots})
+			if err != nil {
+				t.Fatalf("%s: %s", challengeType, err)
+			}
+			if !strings.HasPrefix(response, "GET / HTTP/1.1\r\nHost: example.com\r\n") {
+				t.Errorf("%s: expected the request to be echoed, got %q", challengeType, response)
+			}
+		}
+		mutex.Lock()
+		if len(used) != 1 || used[0] != challengeType {
+			t.Errorf("expected the %s challenge to be used once, got %v", challengeType, used)
+		}
+		mutex.Unlock()
+		if fake.orderCount() != 1 {
+			t.Errorf("%s: expected one order, got %d", challengeType, fake.orderCount())
+		}
+		for _, name := range []string{"example.com.crt", "example.com.key", acmeAccountKey} {
+			if _, err := os.Stat(test.dir + "/" + name); err != nil {
+				t.Errorf("%s: expected %s to be stored: %s", challengeType, name, err)
+			}
+		}
+		if test.manager.alpnCertificate("example.com") != nil {
+			t.Errorf("%s: expected the challenge certificate to be removed", challengeType)
+		}
+
+		// a restarted proxy uses the stored certificate and account
+		restarted := newACMETestProxyIn(t, fake, test.dir)
+		if _, err := requestTLS(restarted.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots}); err != nil {
+			t.Fatalf("%s: %s", challengeType, err)
+		}
+		if fake.orderCount() != 1 || fake.accountCount() != 1 {
+			t.Errorf("%s: expected the stored certificate and account to be used, got %d orders and %d accounts", challengeType, fake.orderCount(), fake.accountCount())
+		}
+	}
+}
+
+func TestACMEObtainCertificateSlowly(t *testing.T) {
+	fake := newFakeACME(t)
+	defer fake.Close()
+	test := newACMETestProxy(t, fake, func(proxy *ConnectionProxy) {
+		proxy.handshakeTimeout = 100 * time.Millisecond
+	})
+	defer os.RemoveAll(test.dir)
+	test.manager.challengeType = acmeChallengeHTTP
+	fake.validate = func(challenge fakeChallenge, keyAuth string) error {
+		// longer than the handshake may take
+		time.Sleep(300 * time.Millisecond)
+		return validateHTTP01(test.httpAddress, challenge, keyAuth)
+	}
+
+	response, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response, "GET / HTTP/1.1\r\nHost: example.com\r\n") {
+		t.Errorf("Expected the request to be echoed, got %q", response)
+	}
+}
+
+func TestACMENotWhitelisted(t *testing.T) {
+	fake := newFakeACME(t)
+	defer fake.Close()
+	test := newACMETestProxy(t, fake)
+	defer os.RemoveAll(test.dir)
+	test.proxy.config = &Config{Rules: []*Rule{
+		{Hosts: []string{"example.com"}, Action: actionTerminate},
+		{Hosts: []string{"*"}, Action: actionProxy},
+	}}
+
+	for _, hostname := range []string{"other.com", "www.example.com", "../example.com"} {
+		if _, err := test.manager.certificate(hostname); err == nil {
+			t.Errorf("expected no certificate for %s", hostname)
+		}
+	}
+	if _, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "other.com", RootCAs: fake.roots}); err == nil {
+		t.Error("expected the handshake for other.com to fail")
+	}
+	if fake.orderCount() != 0 {
+		t.Errorf("expected no orders, got %d", fake.orderCount())
+	}
+}
+
+func TestACMERateLimited(t *testing.T) {
+	fake := newFakeACME(t)
+	defer fake.Close()
+	fake.rateLimited = true
+	test := newACMETestProxy(t, fake)
+	defer os.RemoveAll(test.dir)
+
+	for i := 0; i < 2; i++ {
+		if _, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots}); err == nil {
+			t.Fatal("expected the handshake to fail")
+		}
+	}
+	// the second handshake has to wait for the Retry-After of the first
+	if fake.orderCount() != 1 {
+		t.Errorf("expected one order, got %d", fake.orderCount())
+	}
+	test.manager.Lock()
+	backoff := test.manager.backoff["example.com"]
+	test.manager.Unlock()
+	if backoff == nil || time.Until(backoff.until) < 59*time.Minute {
+		t.Errorf("expected to back off for the hour from Retry-After, got %+v", backoff)
+	}
+	if !strings.Contains(string(test.logs.Content()), acmeErrorRateLimited) {
+		t.Errorf("expected the rate limit in the logs, got %s", test.logs.Content())
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+	fake := newFakeACME(t)
+	defer fake.Close()
+	fake.validFor = acmeRenewBefore / 2
+	test := newACMETestProxy(t, fake)
+	defer os.RemoveAll(test.dir)
+	fake.validate = func(challenge fakeChallenge, keyAuth string) error {
+		return validateTLSALPN01(test.httpsAddress, challenge, keyAuth)
+	}
+
+	if _, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots}); err != nil {
+		t.Fatal(err)
+	}
+	first := test.certs.lookup("example.com")
+
+	// the certificate expires soon, so using it starts the renewal
+	if _, err := requestTLS(test.httpsAddress, &tls.Config{ServerName: "example.com", RootCAs: fake.roots}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for test.certs.lookup("example.com") == first {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the certificate to be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fake.orderCount() != 2 {
+		t.Errorf("expected two orders, got %d", fake.orderCount())
+	}
+}
+
+// TestACMEPebble obtains a certificate from Pebble, the ACME test server
+// (https://github.com/letsencrypt/pebble). It needs to be told which ports
+// to validate challenges on and to resolve every name to 127.0.0.1, e.g.
+// with pebble-challtestsrv:
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 &
+//	PEBBLE_VA_NOSLEEP=1 pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053 &
+//	PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir PEBBLE_CA_FILE=test/certs/pebble.minica.pem go test -run Pebble
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY is not set")
+	}
+	client, err := acmeHTTPClient(os.Getenv("PEBBLE_CA_FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := map[string]string{
+		acmeChallengeHTTP:    envOr("PEBBLE_HTTP_PORT", "5002"),
+		acmeChallengeTLSALPN: envOr("PEBBLE_TLS_PORT", "5001"),
+	}
+
+	for _, challengeType := range []string{acmeChallengeTLSALPN, acmeChallengeHTTP} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		hostname := strings.Replace(challengeType, "-", "", -1) + ".sensible-proxy.test"
+		certs := newCertStore(dir)
+		manager, err := newACMEManager(directory, "", client, dirStorage(dir), certs, newChallengeStore(""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		manager.challengeType = challengeType
+		proxy := getMockProxy(ioutil.Discard, hostname)
+		proxy.config = &Config{Rules: []*Rule{{Hosts: []string{hostname}, Action: actionTerminate}}}
+		proxy.certs = certs
+		proxy.acme = manager
+		proxy.challenges = manager.challenges
+		manager.allowed = proxy.canObtainCertificate
+		manager.logf = t.Logf
+
+		handler := handleHTTPSConnection
+		if challengeType == acmeChallengeHTTP {
+			handler = handleHTTPConnection
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:"+ports[challengeType])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		serveProxy(listener, handler, proxy)
+
+		cert, err := manager.certificate(hostname)
+		if err != nil {
+			t.Fatalf("%s: %s", challengeType, err)
+		}
+		if err := cert.Leaf.VerifyHostname(hostname); err != nil {
+			t.Errorf("%s: %s", challengeType, err)
+		}
+	}
+}
+
+func TestACMEChallengeCertificate(t *testing.T) {
+	cert, err := alpnChallengeCertificate("example.com", "token.thumbprint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkALPNChallengeCertificate(leaf, "example.com", "token.thumbprint"); err != nil {
+		t.Error(err)
+	}
+	if err := checkALPNChallengeCertificate(leaf, "example.com", "other.thumbprint"); err == nil {
+		t.Error("expected the certificate not to match another key authorization")
+	}
+}
+
+type acmeTestProxy struct {
+	dir          string
+	proxy        *ConnectionProxy
+	manager      *acmeManager
+	certs        *certStore
+	logs         *BufferWriter
+	httpAddress  string
+	httpsAddress string
+}
+
+// newACMETestProxy starts HTTP and HTTPS listeners terminating example.com
+// with certificates from fake. configure can change the proxy before the
+// listeners are started.
+func newACMETestProxy(t *testing.T, fake *fakeACME, configure ...func(*ConnectionProxy)) *acmeTestProxy {
+	return newACMETestProxyIn(t, fake, tempDir(t), configure...)
+}
+
+// newACMETestProxyIn is newACMETestProxy with the certificates in dir
+func newACMETestProxyIn(t *testing.T, fake *fakeACME, dir string, configure ...func(*ConnectionProxy)) *acmeTestProxy {
+	certs := newCertStore(dir)
+	if _, err := certs.reload(); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := newACMEManager(fake.URL+"/directory", "admin@example.com", fake.Client(), dirStorage(dir), certs, newChallengeStore(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := &BufferWriter{}
+	proxy := getMockProxy(logs, "example.com")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionTerminate, TerminateUpstream: terminateUpstreamPlain}}}
+	proxy.certs = certs
+	proxy.acme = manager
+	proxy.challenges = manager.challenges
+	proxy.dial = dialEchoServer(t)
+	manager.allowed = proxy.canObtainCertificate
+	manager.logf = proxy.Logf
+	for _, configure := range configure {
+		configure(proxy)
+	}
+
+	test := &acmeTestProxy{dir: dir, proxy: proxy, manager: manager, certs: certs, logs: logs}
+	for _, handler := range []tcpHandler{handleHTTPConnection, handleHTTPSConnection} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		serveProxy(listener, handler, proxy)
+		if test.httpAddress == "" {
+			test.httpAddress = listener.Addr().String()
+		} else {
+			test.httpsAddress = listener.Addr().String()
+		}
+	}
+	return test
+}
+
+// serveProxy handles every connection to listener with handler
+func serveProxy(listener net.Listener, handler tcpHandler, proxy *ConnectionProxy) {
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handler(conn, proxy)
+		}
+	}()
+}
+
+// validateHTTP01 checks the HTTP-01 challenge like an ACME server would
+func validateHTTP01(address string, challenge fakeChallenge, keyAuth string) error {
+	request, err := http.NewRequest("GET", "http://"+address+acmeChallengePath+challenge.Token, nil)
+	if err != nil {
+		return err
+	}
+	request.Host = challenge.domain
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != keyAuth {
+		return fmt.Errorf("got %s %q", response.Status, body)
+	}
+	return nil
+}
+
+// validateTLSALPN01 checks the TLS-ALPN-01 challenge like an ACME server
+// would
+func validateTLSALPN01(address string, challenge fakeChallenge, keyAuth string) error {
+	conn, err := tls.Dial("tcp", address, &tls.Config{
+		ServerName:         challenge.domain,
+		NextProtos:         []string{acmeALPNProtocol},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProtocol {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	return checkALPNChallengeCertificate(state.PeerCertificates[0], challenge.domain, keyAuth)
+}
+
+// checkALPNChallengeCertificate checks cert is for hostname and carries the
+// hash of keyAuth, see RFC 8737 section 3
+func checkALPNChallengeCertificate(cert *x509.Certificate, hostname, keyAuth string) error {
+	if len(cert.DNSNames) != 1 || cert.DNSNames[0] != hostname {
+		return fmt.Errorf("certificate for %v", cert.DNSNames)
+	}
+	hash := sha256.Sum256([]byte(keyAuth))
+	expected, _ := asn1.Marshal(hash[:])
+	for _, extension := range cert.Extensions {
+		if extension.Id.Equal(oidACMEIdentifier) {
+			if !extension.Critical || !bytes.Equal(extension.Value, expected) {
+				return fmt.Errorf("wrong acmeIdentifier extension")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no acmeIdentifier extension")
+}
+
+// fakeACME is a minimal ACME server that checks the requests it gets and
+// issues certificates from a test CA once validate accepts a challenge
+type fakeACME struct {
+	sync.Mutex
+	*httptest.Server
+	t      *testing.T
+	roots  *x509.CertPool
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	nonces map[string]bool
+	// accounts are the account keys by account URL
+	accounts map[string]*ecdsa.PublicKey
+	// thumbprints are the JWK thumbprints by account URL
+	thumbprints map[string]string
+	orders      []*fakeOrder
+	rateLimited bool
+	validFor    time.Duration
+	validate    func(challenge fakeChallenge, keyAuth string) error
+}
+
+type fakeOrder struct {
+	account    string
+	domain     string
+	token      string
+	status     string
+	authzState string
+	chain      []byte
+}
+
+type fakeChallenge struct {
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Token  string `json:"token"`
+	Status string `json:"status"`
+	domain string
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	certPEM, keyPEM, ca := newTestCertificate(t, time.Hour, "Fake ACME CA")
+	block, _ := pem.Decode(keyPEM)
+	caKey, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	fake := &fakeACME{
+		t:           t,
+		roots:       roots,
+		ca:          ca,
+		caKey:       caKey,
+		nonces:      make(map[string]bool),
+		accounts:    make(map[string]*ecdsa.PublicKey),
+		thumbprints: make(map[string]string),
+		validFor:    90 * 24 * time.Hour,
+		validate: func(fakeChallenge, string) error {
+			return fmt.Errorf("not validating")
+		},
+	}
+	fake.Server = httptest.NewTLSServer(http.HandlerFunc(fake.serve))
+	return fake
+}
+
+func (f *fakeACME) orderCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.orders)
+}
+
+func (f *fakeACME) accountCount() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.accounts)
+}
+
+func (f *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	nonce := fmt.Sprintf("nonce%d", len(f.nonces))
+	f.nonces[nonce] = true
+	f.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+		})
+		return
+	case "/nonce":
+		return
+	}
+
+	payload, account, err := f.verify(r)
+	if err != nil {
+		f.problem(w, http.StatusBadRequest, "urn:ietf:params:acme:error:malformed", err.Error())
+		return
+	}
+	if r.URL.Path == "/account" {
+		w.Header().Set("Location", account)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+		return
+	}
+	if !strings.HasPrefix(account, f.URL+"/account/") {
+		f.problem(w, http.StatusUnauthorized, "urn:ietf:params:acme:error:unauthorized", "no kid")
+		return
+	}
+	if r.URL.Path == "/order" {
+		f.newOrder(w, payload, account)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	id, err := strconv.Atoi(parts[len(parts)-1])
+	f.Lock()
+	if err != nil || id >= len(f.orders) || f.orders[id].account != account {
+		f.Unlock()
+		f.problem(w, http.StatusNotFound, "urn:ietf:params:acme:error:malformed", "no such order")
+		return
+	}
+	order := f.orders[id]
+	f.Unlock()
+	switch parts[0] {
+	case "order":
+		f.writeOrder(w, id, http.StatusOK)
+	case "authz":
+		f.writeAuthorization(w, id)
+	case "challenge":
+		f.challenge(w, id, parts[1], account)
+	case "finalize":
+		f.finalize(w, id, payload)
+	case "cert":
+		f.Lock()
+		chain := order.chain
+		f.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verify checks the JWS of a request and returns its payload and account
+// URL, which is created for new keys
+func (f *fakeACME) verify(r *http.Request) ([]byte, string, error) {
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, "", err
+	}
+	var header struct {
+		Alg   string            `json:"alg"`
+		Nonce string            `json:"nonce"`
+		URL   string            `json:"url"`
+		Kid   string            `json:"kid"`
+		JWK   map[string]string `json:"jwk"`
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(decoded, &header); err != nil {
+		return nil, "", err
+	}
+	if header.Alg != "ES256" || header.URL != f.URL+r.URL.Path {
+		return nil, "", fmt.Errorf("bad header %s", decoded)
+	}
+	if (header.Kid == "") == (header.JWK == nil) {
+		return nil, "", fmt.Errorf("need exactly one of kid and jwk")
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if !f.nonces[header.Nonce] {
+		return nil, "", fmt.Errorf("bad nonce %q", header.Nonce)
+	}
+	f.nonces[header.Nonce] = false
+
+	account := header.Kid
+	key := f.accounts[account]
+	if header.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK["x"])
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK["y"])
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		encoded, _ := json.Marshal(header.JWK)
+		hash := sha256.Sum256(encoded)
+		thumbprint := base64.RawURLEncoding.EncodeToString(hash[:])
+		account = f.URL + "/account/" + thumbprint
+		if r.URL.Path != "/account" {
+			return nil, "", fmt.Errorf("jwk used for %s", r.URL.Path)
+		}
+		f.accounts[account] = key
+		f.thumbprints[account] = thumbprint
+	}
+	if key == nil {
+		return nil, "", fmt.Errorf("unknown account %q", account)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, "", fmt.Errorf("bad signature")
+	}
+	hash := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, "", fmt.Errorf("signature doesn't verify")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, account, err
+}
+
+func (f *fakeACME) problem(w http.ResponseWriter, status int, problemType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": problemType, "detail": detail})
+}
+
+func (f *fakeACME) newOrder(w http.ResponseWriter, payload []byte, account string) {
+	var request struct {
+		Identifiers []acmeIdentifier `json:"identifiers"`
+	}
+	if err := json.Unmarshal(payload, &request); err != nil || len(request.Identifiers) != 1 {
+		f.problem(w, http.StatusBadRequest, "urn:ietf:params:acme:error:malformed", "one identifier expected")
+		return
+	}
+	token := make([]byte, 16)
+	rand.Read(token)
+	f.Lock()
+	f.orders = append(f.orders, &fakeOrder{
+		account:    account,
+		domain:     request.Identifiers[0].Value,
+		token:      base64.RawURLEncoding.EncodeToString(token),
+		status:     "pending",
+		authzState: "pending",
+	})
+	id := len(f.orders) - 1
+	rateLimited := f.rateLimited
+	f.Unlock()
+	if rateLimited {
+		w.Header().Set("Retry-After", "3600")
+		f.problem(w, http.StatusTooManyRequests, acmeErrorRateLimited, "too many certificates")
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/order/%d", f.URL, id))
+	f.writeOrder(w, id, http.StatusCreated)
+}
+
+func (f *fakeACME) writeOrder(w http.ResponseWriter, id, status int) {
+	f.Lock()
+	order := f.orders[id]
+	response := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    []acmeIdentifier{{Type: "dns", Value: order.domain}},
+		"authorizations": []string{fmt.Sprintf("%s/authz/%d", f.URL, id)},
+		"finalize":       fmt.Sprintf("%s/finalize/%d", f.URL, id),
+	}
+	if order.status == "valid" {
+		response["certificate"] = fmt.Sprintf("%s/cert/%d", f.URL, id)
+	}
+	f.Unlock()
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (f *fakeACME) challenges(id int) []fakeChallenge {
+	order := f.orders[id]
+	var challenges []fakeChallenge
+	for _, challengeType := range []string{acmeChallengeHTTP, acmeChallengeTLSALPN} {
+		challenges = append(challenges, fakeChallenge{
+			Type:   challengeType,
+			URL:    fmt.Sprintf("%s/challenge/%s/%d", f.URL, challengeType, id),
+			Token:  order.token,
+			Status: order.authzState,
+			domain: order.domain,
+		})
+	}
+	return challenges
+}
+
+func (f *fakeACME) writeAuthorization(w http.ResponseWriter, id int) {
+	f.Lock()
+	defer f.Unlock()
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     f.orders[id].authzState,
+		"identifier": acmeIdentifier{Type: "dns", Value: f.orders[id].domain},
+		"challenges": f.challenges(id),
+	})
+}
+
+// challenge validates a challenge straight away, the client polls the
+// authorization afterwards
+func (f *fakeACME) challenge(w http.ResponseWriter, id int, challengeType, account string) {
+	f.Lock()
+	var challenge fakeChallenge
+	for _, c := range f.challenges(id) {
+		if c.Type == challengeType {
+			challenge = c
+		}
+	}
+	keyAuth := challenge.Token + "." + f.thumbprints[account]
+	f.Unlock()
+
+	err := f.validate(challenge, keyAuth)
+	f.Lock()
+	order := f.orders[id]
+	if err != nil {
+		f.t.Logf("%s failed: %s", challengeType, err)
+		order.authzState, order.status = "invalid", "invalid"
+	} else {
+		order.authzState, order.status = "valid", "ready"
+	}
+	challenge.Status = order.authzState
+	f.Unlock()
+	json.NewEncoder(w).Encode(challenge)
+}
+
+// finalize issues the certificate for the CSR of a ready order
+func (f *fakeACME) finalize(w http.ResponseWriter, id int, payload []byte) {
+	var request struct {
+		CSR string `json:"csr"`
+	}
+	json.Unmarshal(payload, &request)
+	der, err := base64.RawURLEncoding.DecodeString(request.CSR)
+	if err != nil {
+		f.problem(w, http.StatusBadRequest, "urn:ietf:params:acme:error:badCSR", err.Error())
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	f.Lock()
+	order := f.orders[id]
+	if err == nil && (len(csr.DNSNames) != 1 || csr.DNSNames[0] != order.domain) {
+		err = fmt.Errorf("CSR for %v", csr.DNSNames)
+	}
+	if err == nil && order.status != "ready" {
+		err = fmt.Errorf("order is %s", order.status)
+	}
+	f.Unlock()
+	if err != nil {
+		f.problem(w, http.StatusForbidden, "urn:ietf:params:acme:error:badCSR", err.Error())
+		return
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(f.validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, f.ca, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.Lock()
+	order.status = "valid"
+	order.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})...)
+	f.Unlock()
+	f.writeOrder(w, id, http.StatusOK)
+}
+
+// envOr returns the environment variable name, or def if it's not set
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drainPollInterval is how often draining checks whether all connections
+// are closed
+const drainPollInterval = time.Second
+
+// adminServer is the admin API served on ADMIN_ADDR, for looking into and
+// controlling the running proxy. Every request needs the token as
+// "Authorization: Bearer <token>".
+type adminServer struct {
+	token   string
+	started time.Time
+	// listeners are the proxies by name, "http" and "https"
+	listeners map[string]*ConnectionProxy
+	config    *Config
+	breakers  *circuitBreakers
+	sessions  *sessionTable
+	// challenges holds the ACME HTTP-01 challenge tokens answered on the
+	// HTTP listener
+	challenges *challengeStore
+	logger     *log.Logger
+	// refreshWhitelist fetches the whitelist again and returns why that
+	// failed, it's nil if there's no WHITELIST_URL to fetch it from
+	refreshWhitelist func() error
+	// drainTimeout is how long draining waits for connections to close
+	drainTimeout time.Duration
+	// drained is closed once draining is done
+	drained  chan struct{}
+	draining sync.Once
+}
+
+// listenAdmin listens on addr, which is either "unix:" and the path of a
+// unix socket, or a loopback address and port, since the admin API
+// shouldn't be reachable from other hosts
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		// a socket left behind by an earlier run
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		// the socket is created in a directory only the proxy can enter and
+		// moved into place once only the proxy can connect to it
+		dir, err := ioutil.TempDir(filepath.Dir(path), ".admin")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		private := filepath.Join(dir, "admin.sock")
+		listener, err := net.Listen("unix", private)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Chmod(private, 0600); err == nil {
+			err = os.Rename(private, path)
+		}
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("%s isn't a loopback address", host)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serve serves the admin API on listener
+func (a *adminServer) serve(listener net.Listener) {
+	go func() {
+		log.Fatalln("Admin listener failed", http.Serve(listener, a.handler()))
+	}()
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", a.handleStatus)
+	mux.HandleFunc("/connections", a.handleConnections)
+	mux.HandleFunc("/connections/", a.handleConnection)
+	mux.HandleFunc("/whitelist/refresh", a.handleWhitelistRefresh)
+	mux.HandleFunc("/drain", a.handleDrain)
+	mux.HandleFunc("/acme/challenges/", a.handleChallenge)
+	return a.authenticate(mux)
+}
+
+// authenticate only lets requests with the token through
+func (a *adminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(header, "Bearer ")
+		if token == header || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowMethod answers requests with another method than method, and
+// returns false for them
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listenerStatus is a listener as shown by /status
+type listenerStatus struct {
+	Port        string `json:"port"`
+	Connections int    `json:"connections"`
+	Draining    bool   `json:"draining"`
+}
+
+// whitelistStatus is the whitelist as shown by /status. An empty whitelist
+// allows all hostnames.
+type whitelistStatus struct {
+	Size    int        `json:"size"`
+	Updated *time.Time `json:"updated"`
+	Age     string     `json:"age,omitempty"`
+}
+
+// adminStatus is the response of /status
+type adminStatus struct {
+	Version         string                              `json:"version"`
+	Uptime          string                              `json:"uptime"`
+	Listeners       map[string]listenerStatus           `json:"listeners"`
+	Whitelist       whitelistStatus                     `json:"whitelist"`
+	Pools           map[string]map[string]backendStatus `json:"pools"`
+	CircuitBreakers map[string]breakerStatus            `json:"circuit_breakers"`
+}
+
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	status := adminStatus{
+		Version:         version,
+		Uptime:          time.Since(a.started).Round(time.Second).String(),
+		Listeners:       map[string]listenerStatus{},
+		Pools:           a.config.poolStatus(),
+		CircuitBreakers: a.breakers.status(),
+	}
+	connections := map[string]int{}
+	for _, session := range a.sessions.status() {
+		connections[session.Listener]++
+	}
+	for name, proxy := range a.listeners {
+		status.Listeners[name] = listenerStatus{
+			Port:        proxy.port,
+			Connections: connections[proxy.port],
+			Draining:    proxy.isDraining(),
+		}
+	}
+	status.Whitelist = a.whitelistStatus()
+	writeJSON(w, http.StatusOK, status)
+}
+
+// whitelistStatus returns the whitelist the listeners share
+func (a *adminServer) whitelistStatus() whitelistStatus {
+	status := whitelistStatus{}
+	for _, proxy := range a.listeners {
+		size, updated := proxy.whitelistStatus()
+		status.Size = size
+		if !updated.IsZero() {
+			status.Updated = &updated
+			status.Age = time.Since(updated).Round(time.Second).String()
+		}
+		break
+	}
+	return status
+}
+
+func (a *adminServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.sessions.status())
+}
+
+// handleConnection closes the connection with the ID at the end of the path
+func (a *adminServer) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	conn := a.sessions.get(strings.TrimPrefix(r.URL.Path, "/connections/"))
+	if conn == nil {
+		http.Error(w, "No such connection", http.StatusNotFound)
+		return
+	}
+	conn.session.mutex.Lock()
+	hostname := conn.session.hostname
+	conn.session.mutex.Unlock()
+	a.logger.Printf("%s\n", NewLogData("Closed through the admin API", "ADMIN", hostname, conn))
+	conn.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *adminServer) handleWhitelistRefresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if a.refreshWhitelist == nil {
+		http.Error(w, "No WHITELIST_URL set", http.StatusConflict)
+		return
+	}
+	if err := a.refreshWhitelist(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.whitelistStatus())
+}
+
+// maxKeyAuthorizationSize limits the request body of PUT
+// /acme/challenges/<token>, key authorizations are well below it
+const maxKeyAuthorizationSize = 1024
+
+// handleChallenge sets the key authorization in the request body for the
+// token at the end of the path with PUT, and removes it with DELETE once the
+// challenge is done
+func (a *adminServer) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/acme/challenges/")
+	if !isValidToken(token) {
+		http.Error(w, "Invalid token", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxKeyAuthorizationSize+1))
+		keyAuth := strings.TrimSpace(string(body))
+		if err != nil || keyAuth == "" || len(body) > maxKeyAuthorizationSize {
+			http.Error(w, "Expected the key authorization as the body", http.StatusBadRequest)
+			return
+		}
+		a.challenges.Set(token, keyAuth)
+	case http.MethodDelete:
+		a.challenges.Delete(token)
+	default:
+		w.Header().Set("Allow", http.MethodPut+", "+http.MethodDelete)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleDrain stops accepting connections, and stops the proxy once the open
+// ones are closed or drainTimeout has passed
+func (a *adminServer) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	a.draining.Do(func() {
+		for _, proxy := range a.listeners {
+			proxy.drain()
+		}
+		a.logger.Printf("Draining, waiting for %d connections\n", a.sessions.count())
+		go func() {
+			deadline := time.Now().Add(a.drainTimeout)
+			for a.sessions.count() > 0 && time.Now().Before(deadline) {
+				time.Sleep(drainPollInterval)
+			}
+			close(a.drained)
+		}()
+	})
+	writeJSON(w, http.StatusAccepted, map[string]int{"connections": a.sessions.count()})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAdmin(proxies ...*ConnectionProxy) *adminServer {
+	admin := &adminServer{
+		token:        "secret",
+		started:      time.Now(),
+		listeners:    map[string]*ConnectionProxy{},
+		sessions:     newSessionTable(),
+		challenges:   newChallengeStore(""),
+		logger:       proxies[0].logger,
+		drainTimeout: time.Minute,
+		drained:      make(chan struct{}),
+	}
+	for i, proxy := range proxies {
+		proxy.sessions = admin.sessions
+		admin.listeners[[]string{"http", "https"}[i]] = proxy
+	}
+	return admin
+}
+
+// adminRequest sends a request to the admin API and decodes the JSON
+// response into v, if it's not nil
+func adminRequest(t *testing.T, admin *adminServer, method, path string, v interface{}) int {
+	request := httptest.NewRequest(method, path, nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	admin.handler().ServeHTTP(recorder, request)
+	if v != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %s in %q", method, path, err, recorder.Body.String())
+		}
+	}
+	return recorder.Code
+}
+
+func TestAdminAuthentication(t *testing.T) {
+	admin := newTestAdmin(getMockProxy(ioutil.Discard))
+	for _, header := range []string{"", "secret", "Bearer wrong", "Basic secret"} {
+		request := httptest.NewRequest(http.MethodGet, "/status", nil)
+		request.Header.Set("Authorization", header)
+		recorder := httptest.NewRecorder()
+		admin.handler().ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%q: expected status 401, got %d", header, recorder.Code)
+		}
+	}
+	if status := adminRequest(t, admin, http.MethodGet, "/status", nil); status != http.StatusOK {
+		t.Errorf("Expected status 200 with the token, got %d", status)
+	}
+	if status := adminRequest(t, admin, http.MethodPost, "/status", nil); status != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405 for the wrong method, got %d", status)
+	}
+}
+
+func TestAdminListenAddress(t *testing.T) {
+	for _, addr := range []string{"0.0.0.0:0", "192.0.2.1:0", "example.com:0"} {
+		if _, err := listenAdmin(addr); err == nil {
+			t.Errorf("%s: expected addresses other than loopback to be refused", addr)
+		}
+	}
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := dir + "/admin.sock"
+	listener, err := listenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the socket to be only accessible by the proxy, got %v, %v", info, err)
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Expected only the socket to be left, got %d entries", len(entries))
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestAdminStatus(t *testing.T) {
+	proxy, tlsProxy := getMockProxy(ioutil.Discard), getMockProxy(ioutil.Discard)
+	proxy.port, tlsProxy.port = "80", "443"
+	admin := newTestAdmin(proxy, tlsProxy)
+	admin.breakers = newCircuitBreakers(1, time.Minute)
+	admin.breakers.done("www.example.com:80", attemptFailed)
+	admin.config = &Config{Pools: map[string]*Pool{"web": newTestPool(t, "", &Backend{Address: "10.0.0.5"})}}
+	whitelist := []string{SHA1("example.com"), SHA1("example.org")}
+	proxy.SetWhiteList(whitelist)
+	tlsProxy.SetWhiteList(whitelist)
+
+	var status adminStatus
+	adminRequest(t, admin, http.MethodGet, "/status", &status)
+	if status.Version != "dev" || status.Uptime != "0s" {
+		t.Errorf("Unexpected version or uptime %+v", status)
+	}
+	if status.Listeners["http"].Port != "80" || status.Listeners["https"].Port != "443" {
+		t.Errorf("Unexpected listeners %+v", status.Listeners)
+	}
+	if status.Whitelist.Size != 2 || status.Whitelist.Updated == nil || status.Whitelist.Age != "0s" {
+		t.Errorf("Unexpected whitelist %+v", status.Whitelist)
+	}
+	if !status.Pools["web"]["10.0.0.5"].Healthy || status.CircuitBreakers["www.example.com:80"].State != breakerOpen {
+		t.Errorf("Expected the pools and circuit breakers, got %+v", status)
+	}
+
+	if code := adminRequest(t, admin, http.MethodPost, "/whitelist/refresh", nil); code != http.StatusConflict {
+		t.Errorf("Expected status 409 without a WHITELIST_URL, got %d", code)
+	}
+	refreshed := false
+	admin.refreshWhitelist = func() error {
+		refreshed = true
+		return nil
+	}
+	if code := adminRequest(t, admin, http.MethodPost, "/whitelist/refresh", &status.Whitelist); code != http.StatusOK || !refreshed {
+		t.Errorf("Expected the whitelist to be refreshed, got %d", code)
+	}
+}
+
+func TestAdminWhitelistRefreshFailed(t *testing.T) {
+	proxy, tlsProxy := getMockProxy(ioutil.Discard), getMockProxy(ioutil.Discard)
+	admin := newTestAdmin(proxy, tlsProxy)
+	emptyTestServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer emptyTestServer.Close()
+	admin.refreshWhitelist = func() error {
+		return setWhitelistFromURL(proxy, tlsProxy, emptyTestServer.URL)
+	}
+	proxy.SetWhiteList([]string{SHA1("example.com")})
+
+	request := httptest.NewRequest(http.MethodPost, "/whitelist/refresh", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	admin.handler().ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadGateway || !strings.Contains(recorder.Body.String(), "could not find whitelist, keeping old list with 1 domains") {
+		t.Errorf("Expected status 502 with the reason, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestAdminConnections(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.port = "80"
+	// passthrough connections are counted in chunks while the kernel
+	// copies between them, these go through the proxy request by request
+	proxy.keepAliveMode = keepAliveReroute
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	proxy.dial = dialTCPServer(t, func(conn net.Conn) {
+		readRequestHead(bufio.NewReader(conn), defaultMaxHeaderSize)
+		conn.Write([]byte(response))
+		io.Copy(ioutil.Discard, conn)
+	})
+	admin := newTestAdmin(proxy)
+
+	listener, err := getProxyServer(handleHTTPConnection, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	conn.Write([]byte(request))
+	if _, err := io.ReadFull(conn, make([]byte, len(response))); err != nil {
+		t.Fatal(err)
+	}
+
+	var sessions []sessionStatus
+	adminRequest(t, admin, http.MethodGet, "/connections", &sessions)
+	if len(sessions) != 1 {
+		t.Fatalf("Expected one connection, got %+v", sessions)
+	}
+	session := sessions[0]
+	if session.Listener != "80" || session.Client != conn.LocalAddr().String() || session.Host != "example.com" || !strings.HasPrefix(session.Upstream, "127.0.0.1:") {
+		t.Errorf("Unexpected connection %+v", session)
+	}
+	if session.Received != int64(len(request)) || session.Sent != int64(len(response)) {
+		t.Errorf("Expected the bytes of the request and response, got %+v", session)
+	}
+
+	if code := adminRequest(t, admin, http.MethodDelete, "/connections/"+session.ID, nil); code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+	if count := admin.sessions.count(); count != 0 {
+		t.Errorf("Expected no connections, got %d", count)
+	}
+	if !strings.Contains(string(w.Content()), "ADMIN: Closed through the admin API id="+session.ID) {
+		t.Errorf("Expected the closing to be logged, got %s", w.Content())
+	}
+	if code := adminRequest(t, admin, http.MethodDelete, "/connections/"+session.ID, nil); code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for a closed connection, got %d", code)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.port = "0"
+	proxy.dial = dialEchoServer(t)
+	admin := newTestAdmin(proxy)
+	errChan := make(chan int, 1)
+	go doProxy(errChan, handleHTTPConnection, proxy)
+	var listener net.Listener
+	for listener == nil {
+		time.Sleep(10 * time.Millisecond)
+		proxy.Lock()
+		listener = proxy.listener
+		proxy.Unlock()
+	}
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(request))
+	if _, err := io.ReadFull(conn, make([]byte, len(request))); err != nil {
+		t.Fatal(err)
+	}
+
+	var drain map[string]int
+	if code := adminRequest(t, admin, http.MethodPost, "/drain", &drain); code != http.StatusAccepted || drain["connections"] != 1 {
+		t.Errorf("Expected draining to wait for one connection, got %d %v", code, drain)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("Expected new connections to be refused")
+	}
+	select {
+	case <-admin.drained:
+		t.Fatal("Expected draining to wait for the open connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	conn.Close()
+	select {
+	case <-admin.drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected draining to be done once the connection closed")
+	}
+	select {
+	case <-errChan:
+		t.Error("Expected the listener to stop without crashing")
+	default:
+	}
+}
+
+func TestAdminChallenges(t *testing.T) {
+	admin := newTestAdmin(getMockProxy(ioutil.Discard))
+	put := func(path, body string) int {
+		request := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		admin.handler().ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	if code := put("/acme/challenges/token-1", "token-1.thumbprint\n"); code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	if keyAuth, ok := admin.challenges.Get("token-1"); !ok || keyAuth != "token-1.thumbprint" {
+		t.Errorf("Expected the key authorization to be set, got %q", keyAuth)
+	}
+	for path, body := range map[string]string{
+		"/acme/challenges/token-1": "",
+		"/acme/challenges/":        "thumbprint",
+		"/acme/challenges/a.b":     "thumbprint",
+	} {
+		if code := put(path, body); code != http.StatusBadRequest {
+			t.Errorf("%s %q: expected status 400, got %d", path, body, code)
+		}
+	}
+	if code := adminRequest(t, admin, http.MethodGet, "/acme/challenges/token-1", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", code)
+	}
+
+	if code := adminRequest(t, admin, http.MethodDelete, "/acme/challenges/token-1", nil); code != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", code)
+	}
+	if _, ok := admin.challenges.Get("token-1"); ok {
+		t.Error("Expected the token to be removed")
+	}
+}
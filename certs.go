@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often CERT_DIR is checked for changes
+const certReloadInterval = 30 * time.Second
+
+// certStore holds the certificates used to terminate TLS, loaded from the
+// CERT_DIR directory. Every certificate is a "<name>.crt" file with the
+// chain in PEM format next to a "<name>.key" file with its private key.
+type certStore struct {
+	sync.RWMutex
+	dir string
+	// certs are keyed by the lower case DNS names they're valid for,
+	// including wildcards such as "*.example.com"
+	certs map[string]*tls.Certificate
+	// managed are the certificates obtained with ACME, which are kept
+	// across reloads
+	managed map[string]*tls.Certificate
+	// signature tells whether any files changed since the last load
+	signature string
+}
+
+func newCertStore(dir string) *certStore {
+	return &certStore{
+		dir:     dir,
+		certs:   make(map[string]*tls.Certificate),
+		managed: make(map[string]*tls.Certificate),
+	}
+}
+
+// reload loads the certificates again if any files in the directory have
+// changed. On errors the certificates loaded before are kept.
+func (s *certStore) reload() (bool, error) {
+	signature, err := s.dirSignature()
+	if err != nil {
+		return false, err
+	}
+	s.RLock()
+	unchanged := signature == s.signature
+	s.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certs, err := loadCertificates(s.dir)
+	if err != nil {
+		return false, err
+	}
+	s.Lock()
+	s.certs, s.signature = certs, signature
+	s.Unlock()
+	return true, nil
+}
+
+// dirSignature describes the names, sizes and modification times of the
+// files in the directory
+func (s *certStore) dirSignature() (string, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return "", err
+	}
+	var signature strings.Builder
+	for _, file := range files {
+		fmt.Fprintf(&signature, "%s %d %d\n", file.Name(), file.Size(), file.ModTime().UnixNano())
+	}
+	return signature.String(), nil
+}
+
+// loadCertificates reads every certificate and key pair in dir
+func loadCertificates(dir string) (map[string]*tls.Certificate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return nil, err
+	}
+	certs := make(map[string]*tls.Certificate)
+	for _, certFile := range files {
+		keyFile := strings.TrimSuffix(certFile, ".crt") + ".key"
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", certFile, err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, fmt.Errorf("%s: %s", certFile, err)
+		}
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 && cert.Leaf.Subject.CommonName != "" {
+			names = []string{cert.Leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			// with several certificates for a name, the one valid for
+			// longest wins, e.g. the renewed one
+			if existing, ok := certs[name]; ok && existing.Leaf.NotAfter.After(cert.Leaf.NotAfter) {
+				continue
+			}
+			certs[name] = &cert
+		}
+	}
+	return certs, nil
+}
+
+// lookup returns the certificate for hostname, falling back to a wildcard
+// certificate for its parent domain
+func (s *certStore) lookup(hostname string) *tls.Certificate {
+	if s == nil {
+		return nil
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	s.RLock()
+	defer s.RUnlock()
+	if cert, ok := s.managed[hostname]; ok {
+		return cert
+	}
+	if cert, ok := s.certs[hostname]; ok {
+		return cert
+	}
+	// a wildcard only covers a single label
+	if dot := strings.IndexByte(hostname, '.'); dot > 0 {
+		if cert, ok := s.certs["*"+hostname[dot:]]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// add makes an obtained certificate available for hostname
+func (s *certStore) add(hostname string, cert *tls.Certificate) {
+	s.Lock()
+	defer s.Unlock()
+	s.managed[strings.ToLower(hostname)] = cert
+}
+
+// GetCertificate picks the certificate for a TLS handshake by its SNI
+// hostname, see tls.Config
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := s.lookup(hello.ServerName)
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+	}
+	return cert, nil
+}
+
+// periodicCertReload picks up new and renewed certificates in the
+// directory every interval
+func periodicCertReload(proxy *ConnectionProxy, certs *certStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			reloaded, err := certs.reload()
+			if err != nil {
+				proxy.Logf("Could not reload certificates, keeping the old ones: %s\n", err)
+			} else if reloaded {
+				proxy.Logf("Reloaded certificates from '%s'\n", certs.dir)
+			}
+		}
+	}()
+}
+
+// certStorage keeps certificates, their keys and the ACME account key
+// across restarts
+type certStorage interface {
+	// Get returns the content stored under name, or errNotStored
+	Get(name string) ([]byte, error)
+	Put(name string, content []byte) error
+}
+
+var errNotStored = errors.New("not stored")
+
+// dirStorage stores files in a directory, e.g. CERT_DIR so the certificates
+// are loaded by the certStore as well
+type dirStorage string
+
+func (d dirStorage) Get(name string) ([]byte, error) {
+	content, err := ioutil.ReadFile(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return nil, errNotStored
+	}
+	return content, err
+}
+
+// Put writes the file atomically, so a half written certificate is never
+// loaded
+func (d dirStorage) Put(name string, content []byte) error {
+	tmp, err := ioutil.TempFile(string(d), "."+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(string(d), name))
+}
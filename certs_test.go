@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertStoreLookup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestCertificate(t, dir, "apex", time.Hour, "example.com")
+	writeTestCertificate(t, dir, "wildcard", time.Hour, "*.example.org", "example.org")
+
+	store := newCertStore(dir)
+	if _, err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hostname string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"EXAMPLE.com.", "example.com"},
+		{"www.example.com", ""},
+		{"example.org", "*.example.org"},
+		{"www.example.org", "*.example.org"},
+		{"a.b.example.org", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		cert := store.lookup(test.hostname)
+		actual := ""
+		if cert != nil {
+			actual = cert.Leaf.DNSNames[0]
+		}
+		if actual != test.expected {
+			t.Errorf("%s: expected certificate for %q, got %q", test.hostname, test.expected, actual)
+		}
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeTestCertificate(t, dir, "old", time.Hour, "example.com")
+
+	store := newCertStore(dir)
+	if reloaded, err := store.reload(); err != nil || !reloaded {
+		t.Fatalf("Expected the first load to succeed, got %v %v", reloaded, err)
+	}
+	if reloaded, err := store.reload(); err != nil || reloaded {
+		t.Fatalf("Expected nothing to reload, got %v %v", reloaded, err)
+	}
+
+	// the renewed certificate wins over the old one
+	renewed := writeTestCertificate(t, dir, "renewed", 2*time.Hour, "example.com")
+	if reloaded, err := store.reload(); err != nil || !reloaded {
+		t.Fatalf("Expected the new certificate to be loaded, got %v %v", reloaded, err)
+	}
+	if cert := store.lookup("example.com"); !cert.Leaf.NotAfter.Equal(renewed.NotAfter) {
+		t.Errorf("Expected the renewed certificate, got one valid until %s", cert.Leaf.NotAfter)
+	}
+
+	// a broken pair keeps the certificates loaded before
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.crt"), []byte("nonsense"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reload(); err == nil {
+		t.Error("Expected an error for a broken certificate")
+	}
+	if store.lookup("example.com") == nil {
+		t.Error("Expected the certificates to be kept")
+	}
+}
+
+// writeTestCertificate creates a self-signed certificate for names as
+// "<name>.crt" and "<name>.key" in dir
+func writeTestCertificate(t *testing.T, dir, name string, validFor time.Duration, names ...string) *x509.Certificate {
+	certPEM, keyPEM, cert := newTestCertificate(t, validFor, names...)
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// newTestCertificate returns a self-signed certificate for names and its key
+// in PEM format
+func newTestCertificate(t *testing.T, validFor time.Duration, names ...string) ([]byte, []byte, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0]},
+		DNSNames:              names,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		cert
+}
+
+// newTestTLSConfig returns a server config with a self-signed certificate
+// for names, and a pool trusting it for clients
+func newTestTLSConfig(t *testing.T, names ...string) (*tls.Config, *x509.CertPool) {
+	certPEM, keyPEM, cert := newTestCertificate(t, time.Hour, names...)
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{pair}}, roots
+}
+
+// tempDir creates a directory for a test, which has to remove it
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sensible-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// States of a circuit breaker
+const (
+	// breakerClosed lets connections through
+	breakerClosed = "closed"
+	// breakerOpen fails connections right away
+	breakerOpen = "open"
+	// breakerHalfOpen lets one connection through to find out whether
+	// the upstream is back
+	breakerHalfOpen = "half-open"
+)
+
+const (
+	// earlyResetWindow is how soon after connecting an upstream closing
+	// the connection without sending anything counts as a failure
+	earlyResetWindow = time.Second
+	// maxBreakers limits how many upstreams are tracked, since clients pick
+	// them. Only upstreams that have failed recently are tracked, see
+	// evict.
+	maxBreakers = 10000
+)
+
+// breakerRejections counts connections failed by open circuit breakers
+var breakerRejections = expvar.NewInt("circuit_breaker_rejections")
+
+// circuitOpenError is returned for upstreams whose circuit breaker is open
+type circuitOpenError struct {
+	address  string
+	failures int
+	retryIn  time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("%s failed %d times in a row, trying again in %s", e.address, e.failures, e.retryIn.Round(time.Second))
+}
+
+// isCircuitOpen returns true if err is from an open circuit breaker
+func isCircuitOpen(err error) bool {
+	_, ok := err.(*circuitOpenError)
+	return ok
+}
+
+// circuitBreakers stops connecting to upstreams that keep failing, so
+// connections for them fail right away instead of each waiting for the dial
+// timeout. A breaker opens after threshold failures in a row, and after
+// cooldown lets one connection through to probe the upstream: if it
+// succeeds the breaker closes, otherwise it stays open for another
+// cooldown. It's shared by both listeners.
+type circuitBreakers struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mutex    sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+type circuitBreaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+	failedAt time.Time
+	// probing is set while the half-open probe is in progress
+	probing bool
+}
+
+func newCircuitBreakers(threshold int, cooldown time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		breakers:  make(map[string]*circuitBreaker),
+	}
+}
+
+// allow returns a *circuitOpenError if connecting to address should fail
+// right away. Otherwise the outcome of the attempt has to be reported with
+// done.
+func (b *circuitBreakers) allow(address string) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.breakers[address]
+	if !ok || breaker.state == breakerClosed {
+		return nil
+	}
+	if breaker.state == breakerOpen {
+		if elapsed := b.now().Sub(breaker.openedAt); elapsed < b.cooldown {
+			breakerRejections.Add(1)
+			return &circuitOpenError{address: address, failures: breaker.failures, retryIn: b.cooldown - elapsed}
+		}
+		breaker.state = breakerHalfOpen
+	}
+	if breaker.probing {
+		breakerRejections.Add(1)
+		return &circuitOpenError{address: address, failures: breaker.failures}
+	}
+	breaker.probing = true
+	return nil
+}
+
+// Outcomes of a connection attempt
+const (
+	// attemptUnknown is for attempts that didn't show whether the upstream
+	// works, e.g. when the client went away first
+	attemptUnknown = iota
+	attemptSucceeded
+	attemptFailed
+)
+
+// done records the outcome of an attempt allowed by allow
+func (b *circuitBreakers) done(address string, outcome int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	breaker, ok := b.breakers[address]
+	switch outcome {
+	case attemptSucceeded:
+		// closed breakers without failures don't need to be tracked
+		delete(b.breakers, address)
+	case attemptFailed:
+		if !ok {
+			if len(b.breakers) >= maxBreakers {
+				b.evict()
+			}
+			breaker = &circuitBreaker{state: breakerClosed}
+			b.breakers[address] = breaker
+		}
+		breaker.failures++
+		breaker.failedAt = b.now()
+		breaker.probing = false
+		if breaker.state == breakerHalfOpen || breaker.failures >= b.threshold {
+			breaker.state = breakerOpen
+			breaker.openedAt = b.now()
+		}
+	default:
+		if ok {
+			breaker.probing = false
+		}
+	}
+}
+
+// evict makes room in the full map, since clients could otherwise fill it
+// with failing hostnames of their own. Breakers that haven't failed for a
+// cooldown are dropped first, then closed ones, or else arbitrary ones.
+func (b *circuitBreakers) evict() {
+	now := b.now()
+	for address, breaker := range b.breakers {
+		if !breaker.probing && now.Sub(breaker.failedAt) >= b.cooldown {
+			delete(b.breakers, address)
+		}
+	}
+	for address, breaker := range b.breakers {
+		if len(b.breakers) < maxBreakers {
+			return
+		}
+		if breaker.state == breakerClosed {
+			delete(b.breakers, address)
+		}
+	}
+	for address := range b.breakers {
+		if len(b.breakers) < maxBreakers {
+			return
+		}
+		delete(b.breakers, address)
+	}
+}
+
+// breakerStatus is how a breaker is doing, for the metrics
+type breakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+// status returns the breakers of upstreams that have failed recently, all
+// others are closed
+func (b *circuitBreakers) status() map[string]breakerStatus {
+	status := map[string]breakerStatus{}
+	if b == nil {
+		return status
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for address, breaker := range b.breakers {
+		state := breaker.state
+		if state == breakerOpen && b.now().Sub(breaker.openedAt) >= b.cooldown {
+			state = breakerHalfOpen
+		}
+		status[address] = breakerStatus{State: state, Failures: breaker.failures}
+	}
+	return status
+}
+
+// dial connects to address with dial unless its breaker is open. Failing to
+// connect counts against the breaker, unless ctx was canceled because
+// another attempt connected first. The connection is returned as a
+// *breakerConn.
+func (b *circuitBreakers) dial(ctx context.Context, address string, dial func() (net.Conn, error)) (net.Conn, error) {
+	if b == nil {
+		return dial()
+	}
+	if err := b.allow(address); err != nil {
+		return nil, err
+	}
+	conn, err := dial()
+	if err != nil {
+		if ctx.Err() == context.Canceled {
+			b.done(address, attemptUnknown)
+		} else {
+			b.done(address, attemptFailed)
+		}
+		return nil, err
+	}
+	// whether it works is known once it answers
+	return &breakerConn{Conn: conn, breakers: b, address: address, connected: time.Now()}, nil
+}
+
+// breakerConn is a connection to an upstream whose breaker is waiting to
+// hear whether it works: it does if it sends anything, and doesn't if it
+// closes the connection within earlyResetWindow without doing so. Copying
+// between connections bypasses it, and reports to it with answered instead.
+type breakerConn struct {
+	net.Conn
+	breakers  *circuitBreakers
+	address   string
+	connected time.Time
+	reported  sync.Once
+}
+
+func (c *breakerConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 || (err != nil && !isTimeout(err)) {
+		c.answered(n > 0)
+	}
+	return n, err
+}
+
+// answered records that the upstream either sent something or closed the
+// connection without doing so
+func (c *breakerConn) answered(sent bool) {
+	c.reported.Do(func() {
+		switch {
+		case sent:
+			c.breakers.done(c.address, attemptSucceeded)
+		case time.Since(c.connected) < earlyResetWindow:
+			c.breakers.done(c.address, attemptFailed)
+		default:
+			c.breakers.done(c.address, attemptUnknown)
+		}
+	})
+}
+
+// failed records that the upstream was connected to, but couldn't be sent
+// the PROXY header or the client's data
+func (c *breakerConn) failed() {
+	c.reported.Do(func() {
+		c.breakers.done(c.address, attemptFailed)
+	})
+}
+
+func (c *breakerConn) Close() error {
+	c.reported.Do(func() {
+		c.breakers.done(c.address, attemptUnknown)
+	})
+	return c.Conn.Close()
+}
+
+// breakerOf returns the *breakerConn conn is or wraps, or nil if it isn't
+// watched by a circuit breaker
+func breakerOf(conn net.Conn) *breakerConn {
+	for {
+		switch c := conn.(type) {
+		case *breakerConn:
+			return c
+		case *backendConn:
+			conn = c.Conn
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	breakers := newCircuitBreakers(2, 30*time.Second)
+	breakers.now = func() time.Time { return now }
+	address := "www.example.com:80"
+	rejections := breakerRejections.Value()
+
+	for i := 0; i < 2; i++ {
+		if err := breakers.allow(address); err != nil {
+			t.Fatalf("Expected attempt %d to be allowed, got %s", i+1, err)
+		}
+		breakers.done(address, attemptFailed)
+	}
+	err := breakers.allow(address)
+	if !isCircuitOpen(err) || err.Error() != "www.example.com:80 failed 2 times in a row, trying again in 30s" {
+		t.Fatalf("Expected the breaker to be open, got %v", err)
+	}
+	if breakers.allow("www.example.org:80") != nil {
+		t.Error("Expected other upstreams not to be affected")
+	}
+	if status := breakers.status(); status[address] != (breakerStatus{State: breakerOpen, Failures: 2}) {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// one probe at a time after the cooldown, a failed one opens it again
+	now = now.Add(30 * time.Second)
+	if err := breakers.allow(address); err != nil {
+		t.Fatalf("Expected a probe after the cooldown, got %s", err)
+	}
+	if !isCircuitOpen(breakers.allow(address)) {
+		t.Error("Expected only one probe to be allowed")
+	}
+	breakers.done(address, attemptFailed)
+	if !isCircuitOpen(breakers.allow(address)) {
+		t.Error("Expected a failed probe to open the breaker again")
+	}
+
+	now = now.Add(30 * time.Second)
+	if err := breakers.allow(address); err != nil {
+		t.Fatalf("Expected a probe after the cooldown, got %s", err)
+	}
+	breakers.done(address, attemptSucceeded)
+	if err := breakers.allow(address); err != nil {
+		t.Errorf("Expected a successful probe to close the breaker, got %s", err)
+	}
+	if status := breakers.status(); len(status) != 0 {
+		t.Errorf("Expected closed breakers not to be tracked, got %+v", status)
+	}
+	if rejected := breakerRejections.Value() - rejections; rejected != 3 {
+		t.Errorf("Expected 3 rejections to be counted, got %d", rejected)
+	}
+}
+
+func TestCircuitBreakerEviction(t *testing.T) {
+	now := time.Now()
+	breakers := newCircuitBreakers(2, 30*time.Second)
+	breakers.now = func() time.Time { return now }
+
+	// clients filling the map with hostnames that fail once
+	for i := 0; i < maxBreakers; i++ {
+		breakers.done(fmt.Sprintf("www.junk%d.example:80", i), attemptFailed)
+	}
+	opened := "www.example.org:80"
+	for i := 0; i < 2; i++ {
+		breakers.done(opened, attemptFailed)
+	}
+	address := "www.example.com:80"
+	for i := 0; i < 2; i++ {
+		breakers.done(address, attemptFailed)
+	}
+	if !isCircuitOpen(breakers.allow(address)) || !isCircuitOpen(breakers.allow(opened)) {
+		t.Fatal("Expected closed breakers to make room for failing upstreams")
+	}
+	if len(breakers.breakers) > maxBreakers {
+		t.Errorf("Expected at most %d breakers, got %d", maxBreakers, len(breakers.breakers))
+	}
+
+	// once they haven't failed for a cooldown, open ones can go too
+	now = now.Add(30 * time.Second)
+	for i := 0; i < maxBreakers; i++ {
+		breakers.done(fmt.Sprintf("www.junk%d.example:443", i), attemptFailed)
+	}
+	if _, ok := breakers.breakers[opened]; ok {
+		t.Error("Expected the expired breaker to be evicted")
+	}
+}
+
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.breakers = newCircuitBreakers(2, time.Minute)
+	dials := 0
+	proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	}
+
+	for _, status := range []string{"502", "502", "503"} {
+		response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 "+status+" ") {
+			t.Errorf("Expected a %s response, got %q", status, response)
+		}
+	}
+	if dials != 2 {
+		t.Errorf("Expected the upstream not to be dialed while the breaker is open, got %d dials", dials)
+	}
+	if !strings.Contains(string(w.Content()), "Circuit breaker open: www.example.com:80 failed 2 times in a row") {
+		t.Errorf("Expected the reason in the logs, got %s", w.Content())
+	}
+}
+
+func TestCircuitBreakerEarlyReset(t *testing.T) {
+	proxy := getMockProxy(&BufferWriter{})
+	proxy.breakers = newCircuitBreakers(1, time.Minute)
+	proxy.dial = dialTCPServer(t, func(conn net.Conn) {
+		conn.Close()
+	})
+
+	requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if status := proxy.breakers.status(); status["www.example.com:80"].State != breakerOpen {
+		t.Errorf("Expected an upstream closing right away to open the breaker, got %+v", status)
+	}
+
+	proxy.breakers = newCircuitBreakers(1, time.Minute)
+	proxy.dial = dialEchoServer(t)
+	if _, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if status := proxy.breakers.status(); len(status) != 0 {
+		t.Errorf("Expected an upstream that answers not to count as failed, got %+v", status)
+	}
+}
+
+func TestCircuitBreakerPerBackend(t *testing.T) {
+	proxy := getMockProxy(&BufferWriter{})
+	proxy.breakers = newCircuitBreakers(1, time.Minute)
+	pool := newTestPool(t, "", &Backend{Address: "10.0.0.5"}, &Backend{Address: "10.0.0.6"})
+	proxy.config = &Config{
+		Pools: map[string]*Pool{"web": pool},
+		Rules: []*Rule{{Hosts: []string{"example.com"}, Pool: "web"}},
+	}
+	var dialed func() []string
+	proxy.dial, dialed = dialByAddress(map[string]dialFunc{
+		"10.0.0.5:80": dialRefused,
+		"10.0.0.6:80": dialEchoServer(t),
+	})
+
+	// the failing backend is passed over for the other one
+	for _, status := range []string{"GET", "GET", "GET"} {
+		response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), status) {
+			t.Errorf("Expected %q, got %q", status, response)
+		}
+	}
+	// the third connection doesn't dial the backend whose breaker is open
+	if actual := strings.Join(dialed(), " "); actual != "10.0.0.5:80 10.0.0.6:80 10.0.0.6:80 10.0.0.6:80" {
+		t.Errorf("Unexpected dials %s", actual)
+	}
+	if status := proxy.breakers.status(); len(status) != 1 || status["10.0.0.5:80"].State != breakerOpen {
+		t.Errorf("Expected only the breaker of the failing backend to be open, got %+v", status)
+	}
+}
+
+func TestCircuitBreakerPerAddress(t *testing.T) {
+	proxy := getMockProxy(&BufferWriter{})
+	proxy.breakers = newCircuitBreakers(1, time.Minute)
+	proxy.lookup = lookupAddresses("192.0.2.1", "192.0.2.2")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, Fallbacks: []string{"origin.example.net"}}}}
+	var dialed func() []string
+	proxy.dial, dialed = dialByAddress(map[string]dialFunc{
+		"192.0.2.1:80":          dialRefused,
+		"192.0.2.2:80":          dialRefused,
+		"origin.example.net:80": dialRefused,
+	})
+
+	for _, status := range []string{"502", "503"} {
+		response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 "+status+" ") {
+			t.Errorf("Expected a %s response, got %q", status, response)
+		}
+	}
+	if actual := strings.Join(dialed(), " "); actual != "192.0.2.1:80 192.0.2.2:80 origin.example.net:80" {
+		t.Errorf("Expected nothing to be dialed once all breakers are open, got %s", actual)
+	}
+	status := proxy.breakers.status()
+	for _, address := range []string{"192.0.2.1:80", "192.0.2.2:80", "origin.example.net:80"} {
+		if status[address].State != breakerOpen {
+			t.Errorf("Expected the breaker of %s to be open, got %+v", address, status)
+		}
+	}
+}
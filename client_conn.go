@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"sync/atomic"
+)
+
+// clientConn is a connection from a client. It has an ID that is logged and
+// shown to the client in error responses, so both can be matched up. When
+// the connection came through a load balancer sending a PROXY protocol
+// header, its addresses are the client's ones from that header.
+type clientConn struct {
+	net.Conn
+	id          string
+	source      net.Addr
+	destination net.Addr
+	// loopMarkers are the instances the connection went through, from
+	// its PROXY protocol header
+	loopMarkers []string
+	// replay is returned by Read before anything else, to hand bytes that
+	// were sniffed from the connection on to e.g. a TLS server
+	replay []byte
+	// session tracks the connection for the admin API, may be nil
+	session *session
+}
+
+func newClientConn(conn net.Conn) *clientConn {
+	return &clientConn{Conn: conn, id: newConnectionID()}
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	if len(c.replay) > 0 {
+		n := copy(b, c.replay)
+		c.replay = c.replay[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	if c.session != nil {
+		atomic.AddInt64(&c.session.received, int64(n))
+	}
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if c.session != nil {
+		atomic.AddInt64(&c.session.sent, int64(n))
+	}
+	return n, err
+}
+
+func (c *clientConn) Close() error {
+	if c.session != nil {
+		c.session.table.remove(c.id)
+	}
+	return c.Conn.Close()
+}
+
+func (c *clientConn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *clientConn) LocalAddr() net.Addr {
+	if c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ID returns the connection's ID
+func (c *clientConn) ID() string { return c.id }
+
+// NetConn returns the underlying connection
+func (c *clientConn) NetConn() net.Conn { return c.Conn }
+
+// netConn returns the connection underneath a *clientConn, *backendConn or
+// *breakerConn, so copying can splice between the sockets, or conn itself
+// for any other connection
+func netConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *clientConn:
+			if len(c.replay) > 0 {
+				return conn
+			}
+			conn = c.Conn
+		case *backendConn:
+			conn = c.Conn
+		case *breakerConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
+
+// connectionID returns the ID of a client connection, or "" for other
+// connections
+func connectionID(conn net.Conn) string {
+	switch c := conn.(type) {
+	case interface{ ID() string }:
+		return c.ID()
+	case *tls.Conn:
+		// the client connection a terminated TLS connection runs over
+		return connectionID(c.NetConn())
+	}
+	return ""
+}
+
+// newConnectionID returns a random ID to tell connections apart
+func newConnectionID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
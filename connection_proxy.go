@@ -1,18 +1,92 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+type dialFunc func(network, address string, timeout time.Duration) (net.Conn, error)
+
 type ConnectionProxy struct {
 	sync.Mutex
 	port      string
 	whitelist []string
 	logger    *log.Logger
+	// whitelistUpdated is when the whitelist was last set
+	whitelistUpdated time.Time
+	// listener accepts the connections, once doProxy started it
+	listener net.Listener
+	// draining is set once the listener was closed by drain
+	draining bool
+	// sessions tracks the open client connections for the admin API, may
+	// be nil
+	sessions *sessionTable
+
+	// handshakeTimeout limits how long a client may take to send enough of
+	// its request for the hostname to be found
+	handshakeTimeout time.Duration
+	// dialTimeout limits how long connecting to the upstream may take
+	dialTimeout time.Duration
+	// dialRetries is how often connecting to the upstream is tried again
+	// after failing, see connectUpstream
+	dialRetries int
+	// breakers fail connections to upstreams that keep failing right
+	// away, may be nil
+	breakers *circuitBreakers
+	// idleTimeout closes a proxied connection when no data has moved in
+	// either direction for this long
+	idleTimeout time.Duration
+	// maxHeaderSize is the largest HTTP request line and headers accepted,
+	// defaults to defaultMaxHeaderSize
+	maxHeaderSize int
+	// keepAliveMode decides what happens to later requests on an HTTP
+	// connection, see keepAliveReroute and keepAliveReject
+	keepAliveMode string
+	// forwardedHeaders adds the client's address to the X-Forwarded-* and
+	// Forwarded headers of HTTP requests
+	forwardedHeaders bool
+	// stripForwarded removes those headers from HTTP requests, unless the
+	// client is one of trustedProxies
+	stripForwarded bool
+	trustedProxies []*net.IPNet
+	// proxyProtocolSources are the load balancers whose connections start
+	// with a PROXY protocol header
+	proxyProtocolSources []*net.IPNet
+	// config holds the rules from RULES_PATH, may be nil
+	config *Config
+	// certs are the certificates for terminating TLS, may be nil
+	certs *certStore
+	// acme obtains certificates for terminated connections that have none
+	// in certs, may be nil
+	acme *acmeManager
+	// upstreamTLSConfig is used to connect to upstreams of terminated TLS
+	// connections, defaults to verifying them against the system roots
+	upstreamTLSConfig *tls.Config
+	// errorPages are the templates for HTTP error responses, may be nil
+	errorPages errorPages
+	// challenges answers ACME HTTP-01 challenges, may be nil
+	challenges *challengeStore
+	// challengeUpstream is the address of a server answering ACME HTTP-01
+	// challenges that aren't in challenges
+	challengeUpstream string
+	// blockedNetworks are the addresses upstreams may not resolve to
+	blockedNetworks []*net.IPNet
+	// localAddrs are the proxy's own addresses, which upstreams may not
+	// resolve to
+	localAddrs *localAddresses
+	// loopMarker identifies this instance in requests, to find loops
+	// through other proxies, see loop.go
+	loopMarker string
+	// lookup resolves upstream hostnames, e.g. with the cache of a
+	// dnsResolver, defaults to net.DefaultResolver
+	lookup lookupFunc
+	// dial is used to connect to upstreams, defaults to net.DialTimeout
+	dial dialFunc
 }
 
 // LogError will write a message to the application log and add the as much
@@ -39,9 +113,58 @@ func (p *ConnectionProxy) LogDebug(msg, hostname string, conn net.Conn) bool {
 	return false
 }
 
+// LogHandshakeError logs a read error that happened while sniffing the
+// hostname from the client. Deadline expiries are reported as a handshake
+// timeout rather than with the more specific msg.
+func (p *ConnectionProxy) LogHandshakeError(msg string, err error, conn net.Conn) bool {
+	if isTimeout(err) {
+		return p.LogError("Handshake timeout", "", conn)
+	}
+	return p.LogError(msg, "", conn)
+}
+
+// LogUpstreamError logs why connecting to the upstream failed, see
+// upstreamFailure, for connections that can't be answered with an HTTP
+// error page
+func (p *ConnectionProxy) LogUpstreamError(err error, hostname string, conn net.Conn) bool {
+	msg, _, _ := upstreamFailure(err)
+	return p.LogError(msg, hostname, conn)
+}
+
+// LogHTTPUpstreamError answers an HTTP client with the error page for why
+// connecting to the upstream failed, and logs it
+func (p *ConnectionProxy) LogHTTPUpstreamError(err error, hostname string, conn net.Conn) bool {
+	msg, status, isError := upstreamFailure(err)
+	p.writeHTTPError(conn, status, hostname)
+	if isError {
+		return p.LogError(msg, hostname, conn)
+	}
+	return p.LogDebug(msg, hostname, conn)
+}
+
 // LogAccess will log a successful ACCESS log line to the application log
 func (p *ConnectionProxy) LogAccess(hostname string, conn net.Conn) bool {
-	p.logger.Printf("%s\n", NewLogData("connected", "ACCESS", hostname, conn))
+	return p.LogAccessVia("", hostname, conn)
+}
+
+// LogAccessVia will log an ACCESS line that records the fallback of the rule
+// for hostname the connection was proxied to or answered by, if any
+func (p *ConnectionProxy) LogAccessVia(fallback, hostname string, conn net.Conn) bool {
+	msg := "connected"
+	if fallback == fallbackMaintenance {
+		msg = "served"
+	}
+	if fallback != "" {
+		msg += " fallback=" + fallback
+	}
+	p.logger.Printf("%s\n", NewLogData(msg, "ACCESS", hostname, conn))
+	return true
+}
+
+// LogRedirect will log a REDIRECT line for a request that was answered with
+// a redirect instead of being proxied
+func (p *ConnectionProxy) LogRedirect(status int, location, hostname string, conn net.Conn) bool {
+	p.logger.Printf("%s\n", NewLogData(fmt.Sprintf("%d %s", status, location), "REDIRECT", hostname, conn))
 	return true
 }
 
@@ -63,9 +186,35 @@ func (p *ConnectionProxy) Close(c io.Closer) {
 func (p *ConnectionProxy) SetWhiteList(list []string) {
 	p.Lock()
 	p.whitelist = list
+	p.whitelistUpdated = time.Now()
 	p.Unlock()
 }
 
+// whitelistStatus returns the size of the whitelist and when it was last
+// set, the zero time if it never was
+func (p *ConnectionProxy) whitelistStatus() (int, time.Time) {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.whitelist), p.whitelistUpdated
+}
+
+// drain stops accepting connections, the open ones are left to finish
+func (p *ConnectionProxy) drain() {
+	p.Lock()
+	p.draining = true
+	listener := p.listener
+	p.Unlock()
+	if listener != nil {
+		p.Close(listener)
+	}
+}
+
+func (p *ConnectionProxy) isDraining() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.draining
+}
+
 func (p *ConnectionProxy) GetWhiteList() []string {
 	var list []string
 	p.Lock()
@@ -88,3 +237,60 @@ func (p *ConnectionProxy) IsWhiteListed(hostname string) bool {
 	}
 	return false
 }
+
+// startHandshake puts a deadline on reading the initial request from the
+// client, so that clients that connect and send nothing don't tie up the
+// connection forever.
+func (p *ConnectionProxy) startHandshake(conn net.Conn) {
+	if p.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(p.handshakeTimeout))
+	}
+}
+
+// endHandshake removes the deadline set by startHandshake, from here on the
+// connection is governed by the idle timeout.
+func (p *ConnectionProxy) endHandshake(conn net.Conn) {
+	if p.handshakeTimeout > 0 {
+		conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// headerLimit returns the largest HTTP request head accepted from a client
+func (p *ConnectionProxy) headerLimit() int {
+	if p.maxHeaderSize > 0 {
+		return p.maxHeaderSize
+	}
+	return defaultMaxHeaderSize
+}
+
+// parsesEveryRequest returns true if every request on an HTTP connection has
+// to be read, rather than only the first one. Forwarded headers can't be
+// trusted or added otherwise.
+func (p *ConnectionProxy) parsesEveryRequest() bool {
+	return p.keepAliveMode != keepAlivePassthrough || p.forwardedHeaders || p.stripForwarded
+}
+
+// dialUpstream connects to the upstream address, giving up after
+// dialTimeout. With blockedNetworks, localAddrs or lookup the hostname is
+// resolved first, and the checked addresses are connected to so they can't
+// change in between, see dialAddresses.
+func (p *ConnectionProxy) dialUpstream(address string) (net.Conn, error) {
+	if p.blockedNetworks == nil && p.localAddrs == nil && p.lookup == nil {
+		return p.dialBreaker(address)
+	}
+	addresses, err := p.resolveUpstream(address)
+	if err != nil {
+		return nil, err
+	}
+	return p.dialAddresses(sortAddresses(addresses))
+}
+
+// dialDirect connects to address without checking it against
+// blockedNetworks, for upstreams that are configured rather than requested
+func (p *ConnectionProxy) dialDirect(address string) (net.Conn, error) {
+	dial := p.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	return dial("tcp", address, p.dialTimeout)
+}
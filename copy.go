@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleTimer tracks when data last moved in either direction of a proxied
+// connection, so that one direction waiting on the other isn't considered
+// idle as long as the other direction is busy.
+type idleTimer struct {
+	timeout time.Duration
+	last    int64
+}
+
+func newIdleTimer(timeout time.Duration) *idleTimer {
+	return &idleTimer{
+		timeout: timeout,
+		last:    time.Now().UnixNano(),
+	}
+}
+
+// touch records that data has just been transferred
+func (t *idleTimer) touch() {
+	atomic.StoreInt64(&t.last, time.Now().UnixNano())
+}
+
+// expired returns true if no data has been transferred in either direction
+// for longer than the timeout
+func (t *idleTimer) expired() bool {
+	if t.timeout <= 0 {
+		return false
+	}
+	last := time.Unix(0, atomic.LoadInt64(&t.last))
+	return time.Since(last) >= t.timeout
+}
+
+// deadlines returns when the next read and write should give up, or zero
+// times if there is no idle timeout. Reads give up halfway through the
+// timeout to check whether the other direction is busy, which also tells a
+// read timing out apart from a write, since both are reported the same way.
+func (t *idleTimer) deadlines() (time.Time, time.Time) {
+	if t.timeout <= 0 {
+		return time.Time{}, time.Time{}
+	}
+	now := time.Now()
+	return now.Add(t.timeout / 2), now.Add(t.timeout)
+}
+
+// pipe copies data between a client and an upstream. Each direction is
+// shut down independently with CloseWrite when its source is exhausted, so
+// a client can half-close its side of the connection and still receive the
+// response. Both connections are fully closed once both directions are
+// finished, the connection has been idle for too long or copying fails.
+type pipe struct {
+	downstream net.Conn
+	upstream   net.Conn
+	idle       *idleTimer
+	proxy      *ConnectionProxy
+	// running is the number of directions still copying
+	running int32
+	closed  sync.Once
+}
+
+// proxyConnections starts copying between downstream and upstream.
+// downReader is what to read client data from, which differs from
+// downstream when the handler has wrapped it in a buffered reader.
+//
+// The copying happens on two new goroutines rather than one of them running
+// on the handler's goroutine, which lets the handler's goroutine and its
+// stack, which has grown while sniffing the hostname, be freed while the
+// connection is open.
+func proxyConnections(downstream net.Conn, downReader io.Reader, upstream net.Conn, proxy *ConnectionProxy) {
+	p := &pipe{
+		downstream: downstream,
+		upstream:   upstream,
+		idle:       newIdleTimer(proxy.idleTimeout),
+		proxy:      proxy,
+		running:    2,
+	}
+	go p.copyAndClose(upstream, downReader, downstream)
+	go p.copyAndClose(downstream, upstream, upstream)
+}
+
+// copyAndClose copies from src into dst until src is exhausted, then shuts
+// down writing to dst. srcConn is the connection that src reads from.
+func (p *pipe) copyAndClose(dst net.Conn, src io.Reader, srcConn net.Conn) {
+	// send on what the handler has already buffered, after that src can be
+	// bypassed, which allows splicing between the connections
+	if b, ok := src.(bufferedReader); ok {
+		if n := b.Buffered(); n > 0 {
+			_, writeDeadline := p.idle.deadlines()
+			dst.SetWriteDeadline(writeDeadline)
+			if _, err := io.CopyN(dst, src, int64(n)); err != nil {
+				logCopyError(err, dst, p.proxy)
+				p.close()
+				return
+			}
+			p.idle.touch()
+		}
+		src = srcConn
+	}
+	// the circuit breaker of an upstream has to hear whether it answered
+	// from here, since the copying bypasses the connection
+	breaker := breakerOf(srcConn)
+	// copy between the underlying connections, so wrapping a connection
+	// to change its addresses doesn't stop the kernel from splicing
+	if src == io.Reader(srcConn) {
+		src = netConn(srcConn)
+	}
+	dstConn := netConn(dst)
+	// what's copied around a client connection still counts for its session
+	counter := sessionCounter(srcConn, src, dst, dstConn)
+
+	var buf []byte
+	if !canSplice(dstConn, src) {
+		buf = make([]byte, 32*1024)
+	}
+	for {
+		readDeadline, writeDeadline := p.idle.deadlines()
+		srcConn.SetReadDeadline(readDeadline)
+		// a client or backend that stops reading is as idle as one that
+		// stops writing
+		dstConn.SetWriteDeadline(writeDeadline)
+		// copying in chunks gives the chance to push the deadlines
+		// forward without having to wrap src, which would stop the
+		// kernel from splicing.
+		n, err := copyChunk(dstConn, src, buf)
+		if n > 0 {
+			p.idle.touch()
+			if counter != nil {
+				atomic.AddInt64(counter, n)
+			}
+		}
+		if breaker != nil && (n > 0 || (err != nil && !isTimeout(err))) {
+			breaker.answered(n > 0)
+			breaker = nil
+		}
+		if err == nil {
+			continue
+		}
+		if isTimeout(err) && !writeDeadline.IsZero() && !time.Now().Before(writeDeadline) {
+			// dst hasn't taken anything for the whole timeout, whatever
+			// was read for it is lost, so there's no carrying on
+			logCopyError(err, dstConn, p.proxy)
+			p.close()
+			return
+		}
+		if isTimeout(err) && (n > 0 || !p.idle.expired()) {
+			// either still receiving or the other direction is busy
+			continue
+		}
+		if err != io.EOF {
+			logCopyError(err, srcConn, p.proxy)
+			p.close()
+			return
+		}
+		break
+	}
+
+	if cw, ok := dstConn.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			// only a reset makes shutting down fail, which for an upstream
+			// that hasn't answered yet is what its breaker waits for
+			if upstream := breakerOf(dst); upstream != nil {
+				upstream.answered(false)
+			}
+			p.close()
+			return
+		}
+	} else {
+		// without half-close support, the only way to signal the end of
+		// the data is to close the connection
+		p.close()
+		return
+	}
+	if atomic.AddInt32(&p.running, -1) == 0 {
+		p.close()
+	}
+}
+
+// spliceChunkSize is how much is copied before the idle deadline is renewed
+const spliceChunkSize = 1 << 20
+
+// copyChunk copies up to spliceChunkSize bytes from src to dst. When buf is
+// nil, dst and src are both TCP connections and the copy happens with
+// splice(2) on Linux without the data entering userspace. It returns io.EOF
+// if src is exhausted.
+func copyChunk(dst net.Conn, src io.Reader, buf []byte) (int64, error) {
+	chunk := &io.LimitedReader{R: src, N: spliceChunkSize}
+	var n int64
+	var err error
+	if buf == nil {
+		n, err = dst.(io.ReaderFrom).ReadFrom(chunk)
+	} else {
+		// hide ReadFrom to make sure buf is used
+		n, err = io.CopyBuffer(struct{ io.Writer }{dst}, chunk, buf)
+	}
+	if err == nil && n < spliceChunkSize {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// canSplice returns true if the kernel can move data directly from src to
+// dst
+func canSplice(dst net.Conn, src io.Reader) bool {
+	_, dstOK := dst.(*net.TCPConn)
+	_, srcOK := src.(*net.TCPConn)
+	return dstOK && srcOK
+}
+
+// bufferedReader is implemented by readers that might have read more from the
+// connection than was consumed, e.g. *bufio.Reader
+type bufferedReader interface {
+	Buffered() int
+}
+
+// close fully closes both connections, the first call wins
+func (p *pipe) close() {
+	p.closed.Do(func() {
+		// errors are ignored since logging the reason for stopping might
+		// already have closed one of them
+		p.downstream.Close()
+		p.upstream.Close()
+	})
+}
+
+// closeWriter is implemented by connections that can shut down their
+// writing side while still reading, e.g. *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// logCopyError logs why copying stopped. conn is the connection that timed
+// out, whether reading from or writing to it.
+func logCopyError(err error, conn net.Conn, proxy *ConnectionProxy) {
+	if isTimeout(err) {
+		proxy.LogError("Idle timeout", "", conn)
+		return
+	}
+	// this is a bit of hack until the core net lib gives us better
+	// typed error. The below error is expected since either the
+	// client or backend can close the connection when ever they
+	// feel like it.
+	if !strings.Contains(err.Error(), "use of closed network connection") {
+		proxy.LogDebug(fmt.Sprintf("Error during copy between connections: %s", err), "", nil)
+	}
+}
+
+// isTimeout returns true if err was caused by a deadline expiring
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPHalfClose(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	// only answers once the client has finished sending
+	proxy.dial = dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "read %d bytes", len(request))
+	})
+
+	listener, err := getProxyServer(handleHTTPConnection, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := "GET / HTTP/1.0\nHost: example.com\n\n"
+	fmt.Fprint(conn, request)
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("read %d bytes", len(request))
+	if string(actual) != expected {
+		t.Errorf("Expected response '%s' got '%s'", expected, string(actual))
+	}
+}
+
+func TestProxyConnectionsHalfCloseEcho(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	client, downstream := getTCPPair(t)
+	defer client.Close()
+	upstream, err := dialEchoServer(t)("tcp", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConnections(downstream, downstream, upstream, proxy)
+
+	expected := strings.Repeat("echo", 64*1024)
+	go func() {
+		client.Write([]byte(expected))
+		client.(*net.TCPConn).CloseWrite()
+	}()
+
+	actual, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("Expected %d echoed bytes, got %d", len(expected), len(actual))
+	}
+
+	// both directions are done, so the proxy should fully close
+	upstream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := upstream.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("Expected upstream to be closed, got %v", err)
+	}
+}
+
+func TestProxyConnectionsDrainsBufferedReader(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	client, downstream := getTCPPair(t)
+	defer client.Close()
+	upstream, err := dialEchoServer(t)("tcp", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// make the reader buffer more than the handler consumed
+	fmt.Fprint(client, "sniffed buffered")
+	reader := bufio.NewReader(downstream)
+	if _, err := reader.Peek(len("sniffed buffered")); err != nil {
+		t.Fatal(err)
+	}
+	reader.Discard(len("sniffed "))
+
+	proxyConnections(downstream, reader, upstream, proxy)
+	fmt.Fprint(client, " spliced")
+	client.(*net.TCPConn).CloseWrite()
+
+	actual, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "buffered spliced"
+	if string(actual) != expected {
+		t.Errorf("Expected '%s' got '%s'", expected, string(actual))
+	}
+}
+
+func TestProxyConnectionsHalfCloseIdleTimeout(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.idleTimeout = 100 * time.Millisecond
+	client, downstream := getTCPPair(t)
+	defer client.Close()
+	// reads the request, but never answers or closes
+	upstream, err := dialTCPServer(t, func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+		time.Sleep(time.Minute)
+	})("tcp", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConnections(downstream, downstream, upstream, proxy)
+	fmt.Fprint(client, "hello")
+	client.(*net.TCPConn).CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := ioutil.ReadAll(client); err != nil {
+		t.Fatalf("Expected the proxy to close the connection, got %s", err)
+	}
+	logLines := w.Content()
+	expected := "ERROR: Idle timeout"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestProxyConnectionsHalfCloseStalledReader(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.idleTimeout = 200 * time.Millisecond
+	client, downstream := getTCPPair(t)
+	defer client.Close()
+	// answers with more than fits into the socket buffers
+	upstream, err := dialTCPServer(t, func(conn net.Conn) {
+		ioutil.ReadAll(conn)
+		conn.Write(make([]byte, 64<<20))
+	})("tcp", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxyConnections(downstream, downstream, upstream, proxy)
+	fmt.Fprint(client, "hello")
+	client.(*net.TCPConn).CloseWrite()
+
+	// the client never reads, so the proxy's writes have to time out
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(string(w.Content()), "Idle timeout") {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the proxy to close the connection, got %s", string(w.Content()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, client); err != nil && isTimeout(err) {
+		t.Fatalf("Expected the connection to be closed, got %s", err)
+	}
+}
+
+func BenchmarkCopySplice(b *testing.B) {
+	benchmarkCopy(b, func(conn net.Conn) io.Reader {
+		return conn
+	})
+}
+
+func BenchmarkCopyBufferedSplice(b *testing.B) {
+	benchmarkCopy(b, func(conn net.Conn) io.Reader {
+		return bufio.NewReader(conn)
+	})
+}
+
+// BenchmarkCopyUserspace hides the connection type, which forces the copy
+// through a userspace buffer, as it was done before splicing was supported
+func BenchmarkCopyUserspace(b *testing.B) {
+	benchmarkCopy(b, func(conn net.Conn) io.Reader {
+		return struct{ io.Reader }{conn}
+	})
+}
+
+// benchmarkCopy measures the throughput of proxying from a client to an
+// upstream, with wrap deciding what the proxy reads the client data from
+func benchmarkCopy(b *testing.B, wrap func(net.Conn) io.Reader) {
+	proxy := getMockProxy(ioutil.Discard)
+	client, downstream := getTCPPair(b)
+	defer client.Close()
+	upstream, server := getTCPPair(b)
+	defer server.Close()
+
+	proxyConnections(downstream, wrap(downstream), upstream, proxy)
+
+	chunk := make([]byte, 64*1024)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := io.CopyN(ioutil.Discard, server, int64(b.N*len(chunk))); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// getTCPPair returns both ends of a local TCP connection
+func getTCPPair(t testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// connectionAttemptDelay is how long a connection attempt gets before
+	// the next address is tried alongside it, see RFC 8305 section 5
+	connectionAttemptDelay = 250 * time.Millisecond
+	// dialRetryDelay is the wait before the first retry of connecting to an
+	// upstream, doubling with every retry after it
+	dialRetryDelay = 100 * time.Millisecond
+)
+
+// upstreamSetupError is returned by connectUpstream when the upstream was
+// connected to, but writing to it failed
+type upstreamSetupError struct {
+	step string
+	err  error
+}
+
+func (e *upstreamSetupError) Error() string {
+	return fmt.Sprintf("Error while %s to backend: %s", e.step, e.err)
+}
+
+// upstreamFailure returns what to log when connecting to the upstream failed
+// with err, the status to answer HTTP clients with, and whether it's an
+// error rather than something only logged for debugging
+func upstreamFailure(err error) (string, int, bool) {
+	if setupErr, ok := err.(*upstreamSetupError); ok {
+		return setupErr.Error(), http.StatusBadGateway, false
+	}
+	if isCircuitOpen(err) {
+		return fmt.Sprintf("Circuit breaker open: %s", err), http.StatusServiceUnavailable, true
+	}
+	if isBlocked(err) {
+		return fmt.Sprintf("Upstream blocked: %s", err), http.StatusForbidden, true
+	}
+	if isLoop(err) {
+		return fmt.Sprintf("Proxy loop detected: %s", err), http.StatusLoopDetected, true
+	}
+	if isTimeout(err) {
+		return "Upstream dial timeout", http.StatusGatewayTimeout, false
+	}
+	return fmt.Sprintf("Couldn't connect to backend: %s", err), http.StatusBadGateway, false
+}
+
+// connectUpstream connects to the upstream address and sends it the PROXY
+// protocol header, if the rule for hostname asks for one, and replay, what
+// has already been read from the client. With dialRetries, failed attempts
+// are retried as long as the client's data can't have been acted on:
+// failures to connect always, failures to send replay only if it's
+// idempotent. If the rule for hostname refers to a pool, one of its
+// backends is connected to instead of address, on the same port.
+//
+// Failures are counted by the circuit breakers of the addresses actually
+// connected to, the pool backend or each resolved IP address, which fail
+// attempts with a *circuitOpenError while they're open.
+func (p *ConnectionProxy) connectUpstream(downstream net.Conn, address, hostname string, replay []byte, idempotent bool) (net.Conn, error) {
+	dial := p.dialUpstream
+	if pool := p.config.poolFor(hostname); pool != nil {
+		dial = func(address string) (net.Conn, error) {
+			return pool.dial(p, address, downstream)
+		}
+	}
+	return p.connect(dial, downstream, address, hostname, replay, idempotent)
+}
+
+// connect is connectUpstream with the function connecting to address
+func (p *ConnectionProxy) connect(dial func(address string) (net.Conn, error), downstream net.Conn, address, hostname string, replay []byte, idempotent bool) (net.Conn, error) {
+	delay := dialRetryDelay
+	for attempt := 0; ; attempt++ {
+		upstream, err := dial(address)
+		retry := canRetryDial(err)
+		if err == nil {
+			if err = p.sendProxyHeader(upstream, downstream, hostname); err != nil {
+				err, retry = &upstreamSetupError{"sending PROXY header", err}, true
+			} else if len(replay) > 0 {
+				if _, err = upstream.Write(replay); err != nil {
+					err, retry = &upstreamSetupError{"proxying initial data", err}, idempotent
+				}
+			}
+			if err == nil {
+				return upstream, nil
+			}
+			// it was connected to, but didn't take what was sent
+			if breaker := breakerOf(upstream); breaker != nil {
+				breaker.failed()
+			}
+			p.Close(upstream)
+		}
+		if attempt >= p.dialRetries || !retry {
+			return nil, err
+		}
+		if debugLog {
+			p.logger.Printf("%s\n", NewLogData(fmt.Sprintf("Retrying %s: %s", address, err), "DEBUG", hostname, downstream))
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// canRetryDial returns false for errors of dialUpstream that won't go away
+// by trying again
+func canRetryDial(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return false
+	}
+	return !isBlocked(err) && !isLoop(err) && !isCircuitOpen(err)
+}
+
+// dialBreaker connects to address with dialDirect, unless its circuit
+// breaker is open
+func (p *ConnectionProxy) dialBreaker(address string) (net.Conn, error) {
+	return p.breakers.dial(context.Background(), address, func() (net.Conn, error) {
+		return p.dialDirect(address)
+	})
+}
+
+// idempotentRequest returns true if the HTTP request in head may be sent
+// again, see RFC 7231 section 4.2.2
+func idempotentRequest(head []byte) bool {
+	switch strings.SplitN(headLines(head)[0], " ", 2)[0] {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// sortAddresses orders the resolved addresses of an upstream for
+// connecting to them, alternating between IPv6 and IPv4 and starting with
+// IPv6, as RFC 8305 section 4 suggests
+func sortAddresses(addresses []string) []string {
+	var v6, v4 []string
+	for _, address := range addresses {
+		host, _, _ := net.SplitHostPort(address)
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			v6 = append(v6, address)
+		} else {
+			v4 = append(v4, address)
+		}
+	}
+	sorted := make([]string, 0, len(addresses))
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			sorted = append(sorted, v6[i])
+		}
+		if i < len(v4) {
+			sorted = append(sorted, v4[i])
+		}
+	}
+	return sorted
+}
+
+// dialAddresses connects to one of addresses with Happy Eyeballs (RFC 8305):
+// they're tried in order, with the next one started when the previous one
+// fails or hasn't connected within connectionAttemptDelay. The first
+// connection wins and the others are closed. All of it has to finish within
+// dialTimeout. addresses may not be empty.
+func (p *ConnectionProxy) dialAddresses(addresses []string) (net.Conn, error) {
+	ctx, cancel := context.Background(), context.CancelFunc(nil)
+	if p.dialTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, p.dialTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addresses))
+	next, pending := 0, 0
+	start := func() {
+		address := addresses[next]
+		next++
+		pending++
+		go func() {
+			conn, err := p.breakers.dial(ctx, address, func() (net.Conn, error) {
+				return p.dialContext(ctx, address)
+			})
+			results <- result{conn, err}
+		}()
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		var delay <-chan time.Time
+		var timer *time.Timer
+		if next < len(addresses) {
+			timer = time.NewTimer(connectionAttemptDelay)
+			delay = timer.C
+		}
+		var r result
+		done := false
+		select {
+		case r = <-results:
+			done = true
+		case <-delay:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if !done {
+			start()
+			continue
+		}
+
+		pending--
+		if r.err == nil {
+			// the attempts still going are given up on, whatever they
+			// connected to is closed
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					if r := <-results; r.conn != nil {
+						r.conn.Close()
+					}
+				}
+			}(pending)
+			return r.conn, nil
+		}
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		if next < len(addresses) {
+			start()
+		}
+	}
+	return nil, firstErr
+}
+
+// dialContext connects to address until ctx is done, with dial if it's set
+func (p *ConnectionProxy) dialContext(ctx context.Context, address string) (net.Conn, error) {
+	if p.dial == nil {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	timeout := p.dialTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	return p.dial("tcp", address, timeout)
+}
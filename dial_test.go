@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSortAddresses(t *testing.T) {
+	sorted := sortAddresses([]string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.3:80", "[2001:db8::1]:80", "[2001:db8::2]:80"})
+	expected := "[2001:db8::1]:80 192.0.2.1:80 [2001:db8::2]:80 192.0.2.2:80 192.0.2.3:80"
+	if strings.Join(sorted, " ") != expected {
+		t.Errorf("Expected %s, got %s", expected, strings.Join(sorted, " "))
+	}
+}
+
+// dialHanging is a dialFunc for an address that never answers
+func dialHanging(network, address string, timeout time.Duration) (net.Conn, error) {
+	time.Sleep(timeout)
+	return nil, timeoutError{}
+}
+
+// dialRefused is a dialFunc for an address nothing listens on
+func dialRefused(network, address string, timeout time.Duration) (net.Conn, error) {
+	return nil, errors.New("connection refused")
+}
+
+// dialByAddress returns a dialFunc that uses the one for the requested
+// address, and records the addresses in the order they're dialed
+func dialByAddress(dials map[string]dialFunc) (dialFunc, func() []string) {
+	var mutex sync.Mutex
+	var dialed []string
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+			mutex.Lock()
+			dialed = append(dialed, address)
+			mutex.Unlock()
+			return dials[address](network, address, timeout)
+		}, func() []string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return append([]string(nil), dialed...)
+		}
+}
+
+func lookupAddresses(addresses ...string) lookupFunc {
+	return func(host string) ([]net.IP, error) {
+		var ips []net.IP
+		for _, address := range addresses {
+			ips = append(ips, net.ParseIP(address))
+		}
+		return ips, nil
+	}
+}
+
+func TestUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		err     error
+		message string
+		status  int
+		isError bool
+	}{
+		{&upstreamSetupError{"proxying initial data", io.ErrClosedPipe}, "Error while proxying initial data to backend: io: read/write on closed pipe", http.StatusBadGateway, false},
+		{&circuitOpenError{address: "10.0.0.1:80", failures: 3}, "Circuit breaker open: 10.0.0.1:80 failed 3 times in a row, trying again in 0s", http.StatusServiceUnavailable, true},
+		{&blockedUpstreamError{"www.example.com", net.ParseIP("10.0.0.1")}, "Upstream blocked: www.example.com resolves to 10.0.0.1", http.StatusForbidden, true},
+		{&upstreamLoopError{"www.example.com", "127.0.0.1:80"}, "Proxy loop detected: www.example.com resolves to the proxy itself (127.0.0.1:80)", http.StatusLoopDetected, true},
+		{timeoutError{}, "Upstream dial timeout", http.StatusGatewayTimeout, false},
+		{errors.New("connection refused"), "Couldn't connect to backend: connection refused", http.StatusBadGateway, false},
+	}
+	for _, test := range tests {
+		message, status, isError := upstreamFailure(test.err)
+		if message != test.message || status != test.status || isError != test.isError {
+			t.Errorf("Expected %q, %d, %t, got %q, %d, %t", test.message, test.status, test.isError, message, status, isError)
+		}
+	}
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	tests := []struct {
+		name    string
+		v6      dialFunc
+		dialed  string
+		maxTime time.Duration
+	}{
+		// the IPv4 address is tried after connectionAttemptDelay
+		{"hanging", dialHanging, "[2001:db8::1]:443 93.184.216.34:443", time.Second},
+		// and right away when the IPv6 one fails
+		{"refused", dialRefused, "[2001:db8::1]:443 93.184.216.34:443", connectionAttemptDelay / 2},
+	}
+	for _, test := range tests {
+		proxy := getMockProxy(ioutil.Discard)
+		proxy.dialTimeout = 5 * time.Second
+		proxy.lookup = lookupAddresses("93.184.216.34", "2001:db8::1")
+		var dialed func() []string
+		proxy.dial, dialed = dialByAddress(map[string]dialFunc{
+			"[2001:db8::1]:443": test.v6,
+			"93.184.216.34:443": dialEchoServer(t),
+		})
+
+		start := time.Now()
+		conn, err := proxy.dialUpstream("www.example.com:443")
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		conn.Close()
+		if elapsed := time.Since(start); elapsed > test.maxTime {
+			t.Errorf("%s: expected to connect within %s, took %s", test.name, test.maxTime, elapsed)
+		}
+		if strings.Join(dialed(), " ") != test.dialed {
+			t.Errorf("%s: expected %s to be dialed, got %s", test.name, test.dialed, dialed())
+		}
+	}
+}
+
+func TestHappyEyeballsTimeout(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.dialTimeout = 500 * time.Millisecond
+	proxy.lookup = lookupAddresses("192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4")
+	proxy.dial = dialHanging
+
+	start := time.Now()
+	_, err := proxy.dialUpstream("www.example.com:80")
+	if !isTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected all addresses to share the dial timeout, took %s", elapsed)
+	}
+}
+
+func TestDialUpstreamNoAddresses(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.lookup = lookupAddresses()
+	var dialed func() []string
+	proxy.dial, dialed = dialByAddress(nil)
+
+	_, err := proxy.dialUpstream("www.example.com:80")
+	expected := "no addresses for www.example.com"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected '%s', got %v", expected, err)
+	}
+	if len(dialed()) > 0 {
+		t.Errorf("Expected nothing to be dialed, got %s", dialed())
+	}
+}
+
+func TestHTTPSDialRetries(t *testing.T) {
+	attempts := 0
+	received := make(chan []byte, 1)
+	upstream := dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		header := make([]byte, tlsRecordHeaderLen)
+		io.ReadFull(conn, header)
+		received <- header
+	})
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.dialRetries = 2
+	proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if attempts++; attempts < 3 {
+			return nil, errors.New("connection refused")
+		}
+		return upstream(network, address, timeout)
+	}
+
+	go requestHTTPS("example.com", "example.com", proxy)
+	select {
+	case header := <-received:
+		if header[0] != 0x16 {
+			t.Errorf("Expected the ClientHello to be replayed, got %x", header)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the third attempt to connect")
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+// failingWriteConn is an upstream connection that fails writes, as if it
+// was reset right after connecting
+type failingWriteConn struct {
+	net.Conn
+}
+
+func (c *failingWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func TestHTTPDialRetriesIdempotent(t *testing.T) {
+	tests := []struct {
+		method   string
+		attempts int
+	}{
+		{"GET", 2},
+		{"POST", 1},
+	}
+	for _, test := range tests {
+		attempts := 0
+		echo := dialEchoServer(t)
+		proxy := getMockProxy(ioutil.Discard)
+		proxy.dialRetries = 1
+		proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+			conn, err := echo(network, address, timeout)
+			if attempts++; attempts == 1 && err == nil {
+				return &failingWriteConn{conn}, nil
+			}
+			return conn, err
+		}
+
+		request := test.method + " / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n"
+		response, err := requestHTTPRaw(request, proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, got %d", test.method, test.attempts, attempts)
+		}
+		if test.attempts > 1 && string(response) != request {
+			t.Errorf("%s: expected the request to be replayed, got %q", test.method, response)
+		}
+		if test.attempts == 1 && !strings.HasPrefix(string(response), "HTTP/1.1 502 ") {
+			t.Errorf("%s: expected a 502 response, got %q", test.method, response)
+		}
+	}
+}
+
+func TestDialRetriesBlocked(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.dialRetries = 3
+	proxy.blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	proxy.lookup = lookupAddresses("10.0.0.1")
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	if _, err := proxy.connectUpstream(nil, "www.example.com:80", "example.com", nil, true); !isBlocked(err) {
+		t.Errorf("Expected the upstream to be blocked, got %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected nothing to be dialed, got %s", <-dialed)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS message fields, see RFC 1035 section 4
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsClassIN   = 1
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+
+	dnsFlagResponse  = 0x8000
+	dnsFlagTruncated = 0x0200
+	dnsFlagRecursion = 0x0100
+
+	dnsHeaderLen = 12
+	// dnsUDPSize is the EDNS0 buffer size, small enough not to be
+	// fragmented, see https://www.dnsflagday.net/2020/
+	dnsUDPSize = 1232
+	// dnsMaxCNAMEs limits how long a chain of aliases is followed
+	dnsMaxCNAMEs = 8
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// dnsAnswer is what a server said about the records of one type for a name.
+// ttl is how long it may be cached, for a negative answer that's from the
+// SOA record in the authority section (RFC 2308), or 0 if there's none.
+type dnsAnswer struct {
+	ips      []net.IP
+	ttl      uint32
+	notFound bool
+}
+
+// exchangeDNS asks server for the records of qtype for name, over UDP and
+// again over TCP if the answer didn't fit
+func exchangeDNS(server, name string, qtype uint16, timeout time.Duration) (*dnsAnswer, error) {
+	// a guessable ID would let anyone who can send UDP packets to the proxy
+	// spoof answers, so it comes from crypto/rand
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	query, err := buildDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	answer, truncated, err := exchangeDNSUDP(server, query, id, name, qtype, timeout)
+	if err != nil || !truncated {
+		return answer, err
+	}
+	return exchangeDNSTCP(server, query, id, name, qtype, timeout)
+}
+
+func exchangeDNSUDP(server string, query []byte, id uint16, name string, qtype uint16, timeout time.Duration) (*dnsAnswer, bool, error) {
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, false, err
+	}
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		// anything that doesn't answer the query could be spoofed
+		if n < 2 || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		return parseDNSResponse(buf[:n], id, name, qtype)
+	}
+}
+
+func exchangeDNSTCP(server string, query []byte, id uint16, name string, qtype uint16, timeout time.Duration) (*dnsAnswer, error) {
+	conn, err := net.DialTimeout("tcp", server, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// messages over TCP are prefixed with their length
+	framed := make([]byte, 2, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, framed); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(framed))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	answer, _, err := parseDNSResponse(response, id, name, qtype)
+	return answer, err
+}
+
+// buildDNSQuery returns a recursive query for the records of qtype for name
+func buildDNSQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, dnsHeaderLen, 64)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagRecursion)
+	binary.BigEndian.PutUint16(msg[4:], 1)  // question
+	binary.BigEndian.PutUint16(msg[10:], 1) // EDNS0 OPT record
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > maxLabelLen {
+			return nil, fmt.Errorf("invalid DNS name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = appendUint16(msg, qtype, dnsClassIN)
+	// the OPT record has the root name, the UDP size as class, and no TTL
+	// or data
+	msg = append(msg, 0)
+	msg = appendUint16(msg, dnsTypeOPT, dnsUDPSize, 0, 0, 0)
+	return msg, nil
+}
+
+func appendUint16(b []byte, values ...uint16) []byte {
+	for _, v := range values {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return b
+}
+
+// dnsRecord is a resource record from a response
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	ttl   uint32
+	data  []byte
+	// offset of data in the message, for names in it to be decompressed
+	offset int
+}
+
+// parseDNSResponse returns the addresses of name from the response to the
+// query with id, or whether the response was truncated. Server failures
+// are returned as errors.
+func parseDNSResponse(msg []byte, id uint16, name string, qtype uint16) (*dnsAnswer, bool, error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg) != id {
+		return nil, false, errDNSMalformed
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&dnsFlagResponse == 0 {
+		return nil, false, errDNSMalformed
+	}
+	// the answer has to repeat the question it answers
+	if binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, false, errDNSMalformed
+	}
+	question, offset, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil {
+		return nil, false, err
+	}
+	if offset+4 > len(msg) || question != strings.ToLower(strings.TrimSuffix(name, ".")) ||
+		binary.BigEndian.Uint16(msg[offset:]) != qtype || binary.BigEndian.Uint16(msg[offset+2:]) != dnsClassIN {
+		return nil, false, errDNSMalformed
+	}
+	offset += 4
+	if flags&dnsFlagTruncated != 0 {
+		return nil, true, nil
+	}
+	rcode := flags & 0x0f
+	if rcode != dnsRcodeSuccess && rcode != dnsRcodeNXDomain {
+		return nil, false, fmt.Errorf("DNS server failure, rcode %d", rcode)
+	}
+
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	authorities := int(binary.BigEndian.Uint16(msg[8:]))
+	records := make([]dnsRecord, 0, answers+authorities)
+	for i := 0; i < answers+authorities; i++ {
+		var record dnsRecord
+		if record, offset, err = readDNSRecord(msg, offset); err != nil {
+			return nil, false, err
+		}
+		records = append(records, record)
+	}
+
+	// the negative TTL is the lower of the SOA's own TTL and its minimum
+	answer := &dnsAnswer{}
+	for _, record := range records[answers:] {
+		if record.rtype != dnsTypeSOA {
+			continue
+		}
+		// the primary server and mailbox names are followed by the
+		// serial, refresh, retry, expire and minimum fields
+		_, end, err := readDNSName(msg, record.offset)
+		if err == nil {
+			_, end, err = readDNSName(msg, end)
+		}
+		if err != nil || end+20 > record.offset+len(record.data) {
+			return nil, false, errDNSMalformed
+		}
+		answer.ttl = minUint32(record.ttl, binary.BigEndian.Uint32(msg[end+16:]))
+	}
+	if rcode == dnsRcodeNXDomain {
+		answer.notFound = true
+		return answer, false, nil
+	}
+
+	// follow the aliases from name, only records for the end of the chain
+	// are addresses of name
+	target := strings.ToLower(strings.TrimSuffix(name, "."))
+	ttl := uint32(0)
+	first := true
+	for i := 0; i <= dnsMaxCNAMEs; i++ {
+		next := ""
+		for _, record := range records[:answers] {
+			if record.name != target || record.rtype != dnsTypeCNAME {
+				continue
+			}
+			if next, _, err = readDNSName(msg, record.offset); err != nil {
+				return nil, false, err
+			}
+			ttl, first = minTTL(ttl, record.ttl, first), false
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	for _, record := range records[:answers] {
+		if record.name != target || record.rtype != qtype {
+			continue
+		}
+		if (qtype == dnsTypeA && len(record.data) != net.IPv4len) || (qtype == dnsTypeAAAA && len(record.data) != net.IPv6len) {
+			return nil, false, errDNSMalformed
+		}
+		answer.ips = append(answer.ips, net.IP(append([]byte(nil), record.data...)))
+		ttl, first = minTTL(ttl, record.ttl, first), false
+	}
+	if len(answer.ips) == 0 {
+		// the name exists, but has no records of this type
+		answer.notFound = true
+		return answer, false, nil
+	}
+	answer.ttl = ttl
+	return answer, false, nil
+}
+
+// readDNSRecord reads the resource record at offset and returns the offset
+// of the one after it
+func readDNSRecord(msg []byte, offset int) (dnsRecord, int, error) {
+	name, offset, err := readDNSName(msg, offset)
+	if err != nil {
+		return dnsRecord{}, 0, err
+	}
+	if offset+10 > len(msg) {
+		return dnsRecord{}, 0, errDNSMalformed
+	}
+	record := dnsRecord{
+		name:  name,
+		rtype: binary.BigEndian.Uint16(msg[offset:]),
+		ttl:   binary.BigEndian.Uint32(msg[offset+4:]),
+	}
+	length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+	record.offset = offset + 10
+	if record.offset+length > len(msg) {
+		return dnsRecord{}, 0, errDNSMalformed
+	}
+	record.data = msg[record.offset : record.offset+length]
+	return record, record.offset + length, nil
+}
+
+// readDNSName reads the possibly compressed name at offset, lowercased and
+// without the trailing dot, and returns the offset after it
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	// every pointer has to point further back, so this can't loop
+	limit := offset
+	for {
+		if offset >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			pointer := int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			if pointer >= limit {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset, limit = pointer, pointer
+		case length > maxLabelLen:
+			return "", 0, errDNSMalformed
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+func minUint32(a, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// minTTL returns the lower of two TTLs, or ttl if it's the first one
+func minTTL(current, ttl uint32, first bool) uint32 {
+	if first {
+		return ttl
+	}
+	return minUint32(current, ttl)
+}
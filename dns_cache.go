@@ -0,0 +1,250 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsQueryTimeout is how long each server has to answer
+	dnsQueryTimeout = 2 * time.Second
+	// dnsMaxTTL caps how long answers are cached, whatever their TTL says
+	dnsMaxTTL = 24 * time.Hour
+	// dnsCacheSize is the most hostnames kept, as clients pick them
+	dnsCacheSize = 10000
+)
+
+// Counters of the DNS cache, served by the metrics listener. A hit is a fresh
+// answer from the cache, stale is an expired one served while it's being
+// looked up again, and a miss had to wait for the DNS servers.
+var (
+	dnsCacheHits   = expvar.NewInt("dns_cache_hits")
+	dnsCacheMisses = expvar.NewInt("dns_cache_misses")
+	dnsCacheStale  = expvar.NewInt("dns_cache_stale")
+)
+
+// dnsResolver looks up upstream hostnames with the DNS servers from
+// DNS_SERVERS or the system resolver, and caches the answers for as long as
+// their TTL allows. It's shared by both listeners.
+type dnsResolver struct {
+	servers []string
+	// query looks up the addresses of a host and how long they may be
+	// cached
+	query func(host string) ([]net.IP, time.Duration, error)
+	// maxStale is how long after expiring an answer may still be served
+	// while it's looked up again, which keeps upstreams reachable while the
+	// DNS servers are down
+	maxStale time.Duration
+	now      func() time.Time
+
+	mutex sync.Mutex
+	cache map[string]*dnsCacheEntry
+	// inflight are the hostnames being looked up, so that concurrent
+	// lookups of the same one wait for its answer instead of asking again
+	inflight map[string]*dnsCall
+}
+
+// dnsCall is a lookup in progress, done is closed once ips and err are set
+type dnsCall struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// dnsCacheEntry is the answer for a hostname. Negative answers are cached as
+// well, with err set.
+type dnsCacheEntry struct {
+	ips        []net.IP
+	err        error
+	expires    time.Time
+	refreshing bool
+}
+
+// newDNSResolver returns a resolver asking servers, e.g. "10.0.0.2:53", in
+// turn
+func newDNSResolver(servers []string, maxStale time.Duration) *dnsResolver {
+	r := &dnsResolver{
+		servers:  servers,
+		maxStale: maxStale,
+		now:      time.Now,
+		cache:    make(map[string]*dnsCacheEntry),
+		inflight: make(map[string]*dnsCall),
+	}
+	r.query = r.queryServers
+	return r
+}
+
+// newSystemDNSResolver returns a resolver asking the system resolver, giving
+// up after timeout. Its answers don't say how long they may be cached, so
+// they're cached for ttl, found or not.
+func newSystemDNSResolver(ttl, timeout, maxStale time.Duration) *dnsResolver {
+	r := newDNSResolver(nil, maxStale)
+	r.query = func(host string) ([]net.IP, time.Duration, error) {
+		ips, err := lookupSystem(host, timeout)
+		return ips, ttl, err
+	}
+	return r
+}
+
+// parseDNSServers parses a comma separated list of DNS server addresses,
+// the port defaults to 53
+func parseDNSServers(list string) ([]string, error) {
+	var servers []string
+	for _, server := range strings.Split(list, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if net.ParseIP(strings.Trim(server, "[]")) != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			return nil, &net.AddrError{Err: "not an IP address", Addr: server}
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// lookup returns the addresses of host, from the cache if possible
+func (r *dnsResolver) lookup(host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	now := r.now()
+	r.mutex.Lock()
+	entry, ok := r.cache[host]
+	if ok && now.Before(entry.expires) {
+		r.mutex.Unlock()
+		dnsCacheHits.Add(1)
+		return entry.ips, entry.err
+	}
+	if ok && entry.err == nil && now.Before(entry.expires.Add(r.maxStale)) {
+		if !entry.refreshing {
+			entry.refreshing = true
+			go r.resolve(host)
+		}
+		r.mutex.Unlock()
+		dnsCacheStale.Add(1)
+		return entry.ips, nil
+	}
+	r.mutex.Unlock()
+	dnsCacheMisses.Add(1)
+	return r.resolve(host)
+}
+
+// resolve asks the DNS servers for the addresses of host and caches the
+// answer, or waits for the answer if host is already being looked up
+func (r *dnsResolver) resolve(host string) ([]net.IP, error) {
+	r.mutex.Lock()
+	if call, ok := r.inflight[host]; ok {
+		r.mutex.Unlock()
+		<-call.done
+		return call.ips, call.err
+	}
+	call := &dnsCall{done: make(chan struct{})}
+	r.inflight[host] = call
+	r.mutex.Unlock()
+
+	ips, ttl, err := r.query(host)
+	r.mutex.Lock()
+	call.ips, call.err = r.store(host, ips, ttl, err)
+	delete(r.inflight, host)
+	r.mutex.Unlock()
+	close(call.done)
+	return call.ips, call.err
+}
+
+// store caches the answer for host, the mutex has to be held. If none of
+// the servers answered, whatever is cached is kept.
+func (r *dnsResolver) store(host string, ips []net.IP, ttl time.Duration, err error) ([]net.IP, error) {
+	if dnsErr, ok := err.(*net.DNSError); err != nil && !(ok && dnsErr.IsNotFound) {
+		if entry, ok := r.cache[host]; ok {
+			entry.refreshing = false
+		}
+		return nil, err
+	}
+	if ttl > dnsMaxTTL {
+		ttl = dnsMaxTTL
+	}
+	if ttl <= 0 {
+		delete(r.cache, host)
+		return ips, err
+	}
+	if _, ok := r.cache[host]; !ok && len(r.cache) >= dnsCacheSize {
+		r.evict()
+	}
+	r.cache[host] = &dnsCacheEntry{ips: ips, err: err, expires: r.now().Add(ttl)}
+	return ips, err
+}
+
+// evict makes room in the full cache, dropping everything that can't be
+// served anymore, or else an arbitrary entry
+func (r *dnsResolver) evict() {
+	now := r.now()
+	for host, entry := range r.cache {
+		if !now.Before(entry.expires.Add(r.maxStale)) || (entry.err != nil && !now.Before(entry.expires)) {
+			delete(r.cache, host)
+		}
+	}
+	for host := range r.cache {
+		if len(r.cache) < dnsCacheSize {
+			break
+		}
+		delete(r.cache, host)
+	}
+}
+
+// queryServers asks the servers in turn for the IPv4 and IPv6 addresses of host,
+// and returns them with the lowest TTL. A host without any addresses gets a
+// *net.DNSError with IsNotFound set. If only one of the queries fails, the
+// addresses of the other one are enough, but not its negative answer.
+func (r *dnsResolver) queryServers(host string) ([]net.IP, time.Duration, error) {
+	var err error
+	for _, server := range r.servers {
+		var answers [2]*dnsAnswer
+		var errs [2]error
+		var wg sync.WaitGroup
+		for i, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			wg.Add(1)
+			go func(i int, qtype uint16) {
+				defer wg.Done()
+				answers[i], errs[i] = exchangeDNS(server, host, qtype, dnsQueryTimeout)
+			}(i, qtype)
+		}
+		wg.Wait()
+
+		var ips []net.IP
+		var ttl uint32
+		first := true
+		for i, answer := range answers {
+			if errs[i] == nil && !answer.notFound {
+				ips = append(ips, answer.ips...)
+				ttl, first = minTTL(ttl, answer.ttl, first), false
+			}
+		}
+		if len(ips) > 0 {
+			return ips, time.Duration(ttl) * time.Second, nil
+		}
+		if errs[0] != nil || errs[1] != nil {
+			err = errs[0]
+			if err == nil {
+				err = errs[1]
+			}
+			dnsErr := &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTemporary: true}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				dnsErr.IsTimeout = true
+			}
+			err = dnsErr
+			continue
+		}
+		ttl = minUint32(answers[0].ttl, answers[1].ttl)
+		return nil, time.Duration(ttl) * time.Second, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return nil, 0, err
+}
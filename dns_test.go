@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDNSRecord is an answer of the test DNS server, a CNAME if cname is set
+type testDNSRecord struct {
+	ips   []string
+	cname string
+	ttl   uint32
+}
+
+// testDNSServer answers queries over UDP and TCP from its records, with
+// NXDOMAIN and an SOA for unknown names. Truncated names only get a full
+// answer over TCP, and queries for failing types a server failure.
+type testDNSServer struct {
+	addr string
+
+	mutex     sync.Mutex
+	records   map[string]testDNSRecord
+	truncated map[string]bool
+	failing   map[uint16]bool
+	down      bool
+	queries   int
+}
+
+func newTestDNSServer(t *testing.T, records map[string]testDNSRecord) *testDNSServer {
+	server := &testDNSServer{records: records, truncated: map[string]bool{}, failing: map[uint16]bool{}}
+	// TCP gets the same port as UDP, which can be taken for one of them
+	var packetConn net.PacketConn
+	var listener net.Listener
+	for i := 0; ; i++ {
+		var err error
+		if listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if packetConn, err = net.ListenPacket("udp", listener.Addr().String()); err == nil {
+			break
+		}
+		listener.Close()
+		if i == 10 {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		packetConn.Close()
+		listener.Close()
+	})
+	server.addr = listener.Addr().String()
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := server.answer(buf[:n], false); response != nil {
+				packetConn.WriteTo(response, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				if response := server.answer(query, true); response != nil {
+					binary.BigEndian.PutUint16(length, uint16(len(response)))
+					conn.Write(append(length, response...))
+				}
+			}()
+		}
+	}()
+	return server
+}
+
+func (s *testDNSServer) set(name string, record testDNSRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.records[name] = record
+}
+
+func (s *testDNSServer) setDown(down bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.down = down
+}
+
+func (s *testDNSServer) queryCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queries
+}
+
+// answer returns the response to a query, with names in the answers
+// compressed
+func (s *testDNSServer) answer(query []byte, tcp bool) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries++
+	name, end, err := readDNSName(query, dnsHeaderLen)
+	if err != nil {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end:])
+	response := append([]byte(nil), query[:end+4]...)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	flags := uint16(dnsFlagResponse | dnsFlagRecursion | 0x0080)
+	if s.down || s.failing[qtype] {
+		binary.BigEndian.PutUint16(response[2:], flags|2)
+		return response
+	}
+	if s.truncated[name] && !tcp {
+		binary.BigEndian.PutUint16(response[2:], flags|dnsFlagTruncated)
+		return response
+	}
+
+	answers := 0
+	owner := []byte{0xc0, dnsHeaderLen}
+	for i := 0; i < dnsMaxCNAMEs; i++ {
+		record, ok := s.records[name]
+		if !ok {
+			break
+		}
+		if record.cname != "" {
+			// the encoded name from a query, without the type, class and
+			// OPT record after it
+			target, _ := buildDNSQuery(0, record.cname, 0)
+			target = target[dnsHeaderLen : len(target)-15]
+			response = append(response, owner...)
+			response = appendUint16(response, dnsTypeCNAME, dnsClassIN, uint16(record.ttl>>16), uint16(record.ttl), uint16(len(target)))
+			owner = []byte{0xc0 | byte(len(response)>>8), byte(len(response))}
+			response = append(response, target...)
+			answers++
+			name = record.cname
+			continue
+		}
+		for _, address := range record.ips {
+			ip := net.ParseIP(address)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			if (qtype == dnsTypeA) != (len(ip) == net.IPv4len) {
+				continue
+			}
+			response = append(response, owner...)
+			response = appendUint16(response, qtype, dnsClassIN, uint16(record.ttl>>16), uint16(record.ttl), uint16(len(ip)))
+			response = append(response, ip...)
+			answers++
+		}
+		binary.BigEndian.PutUint16(response[2:], flags)
+		binary.BigEndian.PutUint16(response[6:], uint16(answers))
+		return response
+	}
+
+	// NXDOMAIN with the SOA of the root zone, whose negative TTL is 60
+	response = append(response, 0)
+	response = appendUint16(response, dnsTypeSOA, dnsClassIN, 0, 300, 22+4)
+	response = append(response, 1, 'a', 0, 1, 'b', 0)
+	response = appendUint16(response, 0, 1, 0, 1, 0, 1, 0, 1, 0, 60)
+	binary.BigEndian.PutUint16(response[2:], flags|dnsRcodeNXDomain)
+	binary.BigEndian.PutUint16(response[6:], uint16(answers))
+	binary.BigEndian.PutUint16(response[8:], 1)
+	return response
+}
+
+// newTestResolver returns a resolver for server with a clock that can be
+// moved forward
+func newTestResolver(server *testDNSServer, maxStale time.Duration) (*dnsResolver, func(time.Duration)) {
+	resolver := newDNSResolver([]string{server.addr}, maxStale)
+	var mutex sync.Mutex
+	now := time.Now()
+	resolver.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	return resolver, func(d time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = now.Add(d)
+	}
+}
+
+func ipStrings(ips []net.IP) string {
+	var s []string
+	for _, ip := range ips {
+		s = append(s, ip.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func TestDNSResolverLookup(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {cname: "lb.example.net", ttl: 300},
+		"lb.example.net":  {ips: []string{"93.184.216.34", "2606:2800:220:1::1"}, ttl: 60},
+		"big.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+	})
+	server.mutex.Lock()
+	server.truncated["big.example.com"] = true
+	server.mutex.Unlock()
+	resolver, _ := newTestResolver(server, 0)
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"www.example.com", "93.184.216.34,2606:2800:220:1::1"},
+		{"WWW.Example.com.", "93.184.216.34,2606:2800:220:1::1"},
+		{"big.example.com", "192.0.2.1"},
+	}
+	for _, test := range tests {
+		ips, err := resolver.lookup(test.host)
+		if err != nil {
+			t.Errorf("%s: %s", test.host, err)
+		} else if ipStrings(ips) != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.host, test.expected, ipStrings(ips))
+		}
+	}
+	if _, err := resolver.lookup("missing.example.com"); err == nil || !err.(*net.DNSError).IsNotFound {
+		t.Errorf("Expected a not found error, got %v", err)
+	}
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+	})
+	resolver, advance := newTestResolver(server, 0)
+	hits, misses := dnsCacheHits.Value(), dnsCacheMisses.Value()
+
+	resolver.lookup("www.example.com")
+	server.set("www.example.com", testDNSRecord{ips: []string{"192.0.2.2"}, ttl: 60})
+	advance(59 * time.Second)
+	if ips, _ := resolver.lookup("www.example.com"); ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("Expected the cached address until the TTL passes, got %s", ipStrings(ips))
+	}
+	advance(time.Second)
+	if ips, _ := resolver.lookup("www.example.com"); ipStrings(ips) != "192.0.2.2" {
+		t.Errorf("Expected a new lookup after the TTL, got %s", ipStrings(ips))
+	}
+	if queries := server.queryCount(); queries != 4 {
+		t.Errorf("Expected 2 lookups of A and AAAA records, got %d queries", queries)
+	}
+	if hits := dnsCacheHits.Value() - hits; hits != 1 {
+		t.Errorf("Expected 1 cache hit, got %d", hits)
+	}
+	if misses := dnsCacheMisses.Value() - misses; misses != 2 {
+		t.Errorf("Expected 2 cache misses, got %d", misses)
+	}
+}
+
+func TestDNSResolverNegativeCache(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{})
+	resolver, advance := newTestResolver(server, time.Hour)
+
+	resolver.lookup("www.example.com")
+	server.set("www.example.com", testDNSRecord{ips: []string{"192.0.2.1"}, ttl: 60})
+	advance(59 * time.Second)
+	if _, err := resolver.lookup("www.example.com"); err == nil {
+		t.Error("Expected the cached negative answer until the SOA minimum passes")
+	}
+	advance(time.Second)
+	if ips, err := resolver.lookup("www.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("Expected a new lookup after the negative TTL, got %v %s", err, ipStrings(ips))
+	}
+}
+
+func TestDNSResolverZeroTTL(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 0},
+	})
+	resolver, _ := newTestResolver(server, time.Hour)
+
+	resolver.lookup("www.example.com")
+	resolver.lookup("www.example.com")
+	if queries := server.queryCount(); queries != 4 {
+		t.Errorf("Expected answers with a TTL of 0 not to be cached, got %d queries", queries)
+	}
+}
+
+func TestDNSResolverStaleWhileRevalidate(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+	})
+	resolver, advance := newTestResolver(server, time.Hour)
+	stale := dnsCacheStale.Value()
+
+	resolver.lookup("www.example.com")
+	server.setDown(true)
+	advance(30 * time.Minute)
+	for i := 0; i < 3; i++ {
+		if ips, err := resolver.lookup("www.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+			t.Fatalf("Expected the stale answer while the server is down, got %v %s", err, ipStrings(ips))
+		}
+		// wait for the failed refresh
+		for deadline := time.Now().Add(5 * time.Second); server.queryCount() < 2+2*(i+1) && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if stale := dnsCacheStale.Value() - stale; stale != 3 {
+		t.Errorf("Expected 3 stale answers, got %d", stale)
+	}
+
+	server.setDown(false)
+	server.set("www.example.com", testDNSRecord{ips: []string{"192.0.2.2"}, ttl: 60})
+	resolver.lookup("www.example.com")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if ips, _ := resolver.lookup("www.example.com"); ipStrings(ips) == "192.0.2.2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the answer to be refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.setDown(true)
+	advance(2 * time.Hour)
+	if _, err := resolver.lookup("www.example.com"); err == nil {
+		t.Error("Expected an error once the answer is too old to be served")
+	}
+}
+
+func TestSystemDNSResolver(t *testing.T) {
+	resolver := newSystemDNSResolver(time.Minute, time.Second, 0)
+	hits, misses := dnsCacheHits.Value(), dnsCacheMisses.Value()
+	for i := 0; i < 2; i++ {
+		if ips, err := resolver.lookup("localhost"); err != nil || len(ips) == 0 {
+			t.Fatalf("Expected the addresses of localhost, got %v %v", err, ips)
+		}
+	}
+	if dnsCacheMisses.Value()-misses != 1 || dnsCacheHits.Value()-hits != 1 {
+		t.Errorf("Expected the second lookup to be answered from the cache")
+	}
+
+	uncached := newSystemDNSResolver(0, time.Second, 0)
+	uncached.lookup("localhost")
+	if _, ok := uncached.cache["localhost"]; ok {
+		t.Error("Expected nothing to be cached without a TTL")
+	}
+}
+
+func TestDNSResolverFallbackServer(t *testing.T) {
+	down := newTestDNSServer(t, map[string]testDNSRecord{})
+	down.setDown(true)
+	up := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+	})
+	resolver := newDNSResolver([]string{down.addr, up.addr}, 0)
+
+	if ips, err := resolver.lookup("www.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("Expected the second server to answer, got %v %s", err, ipStrings(ips))
+	}
+}
+
+func TestDNSResolverConcurrentMisses(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+	})
+	resolver, _ := newTestResolver(server, 0)
+
+	// the server holds back its answers until every lookup has started
+	server.mutex.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ips, err := resolver.lookup("www.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+				t.Errorf("Expected the address, got %v %s", err, ipStrings(ips))
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	server.mutex.Unlock()
+	wg.Wait()
+	if queries := server.queryCount(); queries != 2 {
+		t.Errorf("Expected one A and one AAAA query, got %d", queries)
+	}
+}
+
+func TestDNSResolverFailingType(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"192.0.2.1"}, ttl: 60},
+		"v6.example.com":  {ips: []string{"2001:db8::1"}, ttl: 60},
+	})
+	server.mutex.Lock()
+	server.failing[dnsTypeAAAA] = true
+	server.mutex.Unlock()
+	resolver, _ := newTestResolver(server, 0)
+
+	if ips, err := resolver.lookup("www.example.com"); err != nil || ipStrings(ips) != "192.0.2.1" {
+		t.Errorf("Expected the IPv4 address despite the failing IPv6 query, got %v %s", err, ipStrings(ips))
+	}
+	// no IPv4 address doesn't mean there's no IPv6 address either
+	if _, err := resolver.lookup("v6.example.com"); err == nil || err.(*net.DNSError).IsNotFound {
+		t.Errorf("Expected a temporary error, got %v", err)
+	}
+}
+
+func TestParseDNSServers(t *testing.T) {
+	servers, err := parseDNSServers("10.0.0.2, 10.0.0.3:5353,::1,[::1]:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(servers, " ") != "10.0.0.2:53 10.0.0.3:5353 [::1]:53 [::1]:53" {
+		t.Errorf("Unexpected servers %v", servers)
+	}
+	if _, err := parseDNSServers("dns.example.com"); err == nil {
+		t.Error("Expected an error for a hostname")
+	}
+}
+
+func TestReadDNSNameLoop(t *testing.T) {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+2)
+	msg = append(msg, 0xc0, dnsHeaderLen)
+	if _, _, err := readDNSName(msg, dnsHeaderLen); err != errDNSMalformed {
+		t.Errorf("Expected a pointer loop to be refused, got %v", err)
+	}
+}
+
+func TestParseDNSResponseQuestion(t *testing.T) {
+	response, _ := buildDNSQuery(42, "www.example.com", dnsTypeA)
+	// the query with the response flag, without the OPT record
+	response = response[:len(response)-11]
+	binary.BigEndian.PutUint16(response[2:], dnsFlagResponse|dnsFlagRecursion)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	if _, _, err := parseDNSResponse(response, 42, "WWW.example.com.", dnsTypeA); err != nil {
+		t.Errorf("Expected the answer to the question to be accepted, got %v", err)
+	}
+	tests := []struct {
+		id    uint16
+		name  string
+		qtype uint16
+	}{
+		{43, "www.example.com", dnsTypeA},
+		{42, "example.com", dnsTypeA},
+		{42, "www.example.com", dnsTypeAAAA},
+	}
+	for _, test := range tests {
+		if _, _, err := parseDNSResponse(response, test.id, test.name, test.qtype); err != errDNSMalformed {
+			t.Errorf("%+v: expected the answer to another query to be refused, got %v", test, err)
+		}
+	}
+}
+
+func TestHTTPDNSResolver(t *testing.T) {
+	server := newTestDNSServer(t, map[string]testDNSRecord{
+		"www.example.com": {ips: []string{"93.184.216.34"}, ttl: 60},
+	})
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.lookup = newDNSResolver([]string{server.addr}, 0).lookup
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	if _, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-dialed; address != "93.184.216.34:80" {
+		t.Errorf("Expected the resolved address to be dialed, got %s", address)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultErrorTemplate is used for error responses without a template in
+// ERROR_TEMPLATE_DIR
+var defaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>Request ID: {{.RequestID}}</small></p>
+</body>
+</html>
+`))
+
+// errorMessages explain the common error responses to visitors
+var errorMessages = map[int]string{
+	http.StatusBadRequest:                  "The request could not be understood.",
+	http.StatusForbidden:                   "This website is not served here.",
+	http.StatusMisdirectedRequest:          "This connection can't be used for this website, please try again.",
+	http.StatusRequestHeaderFieldsTooLarge: "The request headers are too large.",
+	http.StatusBadGateway:                  "The website could not be reached.",
+	http.StatusServiceUnavailable:          "The website is temporarily unavailable, please try again later.",
+	http.StatusGatewayTimeout:              "The website took too long to respond.",
+	http.StatusLoopDetected:                "The website is misconfigured and points back at this server.",
+}
+
+// errorPage is what error templates are rendered with
+type errorPage struct {
+	Status     int
+	StatusText string
+	Message    string
+	Host       string
+	RequestID  string
+}
+
+// errorPages are the templates for error responses, by status code. The
+// template for status 0 is used for all others.
+type errorPages map[int]*template.Template
+
+// loadErrorPages parses the templates in dir, named after the status code
+// they're for, e.g. "502.html", or "error.html" for any status
+func loadErrorPages(dir string) (errorPages, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := errorPages{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+		status := 0
+		if name != "error.html" {
+			if status, err = strconv.Atoi(strings.TrimSuffix(name, ".html")); err != nil || status < 400 || status > 599 {
+				continue
+			}
+		}
+		tmpl, err := template.ParseFiles(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		pages[status] = tmpl
+	}
+	return pages, nil
+}
+
+// render returns the HTML body for an error response
+func (pages errorPages) render(page errorPage) []byte {
+	tmpl, ok := pages[page.Status]
+	if !ok {
+		tmpl, ok = pages[0]
+	}
+	if !ok {
+		tmpl = defaultErrorTemplate
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, page); err != nil {
+		body.Reset()
+		defaultErrorTemplate.Execute(&body, page)
+	}
+	return body.Bytes()
+}
+
+// writeHTTPError sends an HTML error response with the given status to the
+// client, the connection is expected to be closed afterwards. The response
+// includes the connection's ID, which is in the log lines about it as well.
+func (p *ConnectionProxy) writeHTTPError(downstream net.Conn, code int, hostname string) error {
+	id := connectionID(downstream)
+	body := p.errorPages.render(errorPage{
+		Status:     code,
+		StatusText: http.StatusText(code),
+		Message:    errorMessages[code],
+		Host:       hostname,
+		RequestID:  id,
+	})
+	_, err := fmt.Fprintf(downstream, "HTTP/1.1 %d %s\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: %d\r\nX-Request-Id: %s\r\nConnection: close\r\n\r\n%s",
+		code, http.StatusText(code), len(body), id, body)
+	return err
+}
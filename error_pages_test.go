@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHTTPErrorResponses(t *testing.T) {
+	refused := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	timeout := func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+	}
+	tests := []struct {
+		name     string
+		request  string
+		dial     dialFunc
+		status   string
+		expected string
+	}{
+		{"denied", "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n", refused, "403 Forbidden", "DEBUG: Hostname is not whitelisted"},
+		{"dial failure", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", refused, "502 Bad Gateway", "DEBUG: Couldn't connect to backend"},
+		{"dial timeout", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", timeout, "504 Gateway Timeout", "DEBUG: Upstream dial timeout"},
+		{"malformed", "GET / HTTP/1.1\r\nHost : example.com\r\n\r\n", refused, "400 Bad Request", "DEBUG: Bad request"},
+	}
+	for _, test := range tests {
+		w := &BufferWriter{}
+		proxy := getMockProxy(w, "example.com")
+		proxy.dial = test.dial
+
+		response, err := requestHTTPRaw(test.request, proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 "+test.status+"\r\n") {
+			t.Errorf("%s: expected a %s response, got %q", test.name, test.status, response)
+			continue
+		}
+		if !strings.Contains(string(response), "Content-Type: text/html") || !strings.Contains(string(response), "<h1>"+test.status+"</h1>") {
+			t.Errorf("%s: expected an HTML page, got %q", test.name, response)
+		}
+
+		// the request ID on the page matches the log line
+		match := regexp.MustCompile(`Request ID: ([0-9a-f]+)`).FindStringSubmatch(string(response))
+		if match == nil {
+			t.Errorf("%s: no request ID in %q", test.name, response)
+			continue
+		}
+		if !strings.Contains(string(response), "X-Request-Id: "+match[1]+"\r\n") {
+			t.Errorf("%s: expected X-Request-Id %s, got %q", test.name, match[1], response)
+		}
+		if !strings.Contains(string(w.Content()), test.expected) || !strings.Contains(string(w.Content()), "id="+match[1]) {
+			t.Errorf("%s: expected '%s' with id=%s in logs, got %s", test.name, test.expected, match[1], w.Content())
+		}
+	}
+}
+
+func TestLoadErrorPages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensible-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"502.html":   "<p>{{.Host}} is down, quote {{.RequestID}}</p>",
+		"error.html": "<p>{{.Status}} {{.Host}}</p>",
+		"readme.txt": "{{",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pages, err := loadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		page     errorPage
+		expected string
+	}{
+		{errorPage{Status: 502, Host: "<b>example.com</b>", RequestID: "abc"}, "<p>&lt;b&gt;example.com&lt;/b&gt; is down, quote abc</p>"},
+		{errorPage{Status: 403, Host: "example.com"}, "<p>403 example.com</p>"},
+	}
+	for _, test := range tests {
+		if actual := string(pages.render(test.page)); actual != test.expected {
+			t.Errorf("%d: expected %q, got %q", test.page.Status, test.expected, actual)
+		}
+	}
+	var none errorPages
+	if actual := string(none.render(errorPage{Status: 504, StatusText: "Gateway Timeout"})); !strings.Contains(actual, "<h1>504 Gateway Timeout</h1>") {
+		t.Errorf("Expected the default page, got %q", actual)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "400.html"), []byte("{{.Status"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadErrorPages(dir); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// fallbackMaintenance ends the fallbacks of a rule with the maintenance page,
+// a 503 response saying the website is temporarily unavailable
+const fallbackMaintenance = "maintenance"
+
+// maintenanceError is returned by connectWithFallbacks when the upstream and
+// all fallbacks failed, and the rule ends with fallbackMaintenance
+type maintenanceError struct {
+	err error
+}
+
+func (e *maintenanceError) Error() string {
+	return fmt.Sprintf("Serving the maintenance page: %s", e.err)
+}
+
+// isMaintenance returns true if err says to serve the maintenance page
+func isMaintenance(err error) bool {
+	_, ok := err.(*maintenanceError)
+	return ok
+}
+
+// connectWithFallbacks connects to the upstream like connectUpstream, and if
+// that fails, to the fallbacks of the rule for hostname in order, on the port
+// of address. It returns the fallback that was connected to, or "" for the
+// upstream. Callers that can answer with the maintenance page set
+// maintenance, and get a *maintenanceError once it's the fallback left.
+func (p *ConnectionProxy) connectWithFallbacks(downstream net.Conn, address, hostname string, replay []byte, idempotent, maintenance bool) (net.Conn, string, error) {
+	upstream, err := p.connectUpstream(downstream, address, hostname, replay, idempotent)
+	if err == nil {
+		setUpstream(downstream, hostname, upstream)
+		return upstream, "", nil
+	}
+	_, port, _ := net.SplitHostPort(address)
+	for _, fallback := range p.config.ruleFor(hostname).Fallbacks {
+		if !canFallBack(err, idempotent) {
+			break
+		}
+		if fallback == fallbackMaintenance {
+			if maintenance {
+				return nil, fallback, &maintenanceError{err}
+			}
+			if debugLog {
+				p.logger.Printf("%s\n", NewLogData("Can't serve the maintenance page without terminating TLS", "DEBUG", hostname, downstream))
+			}
+			break
+		}
+		if debugLog {
+			p.logger.Printf("%s\n", NewLogData(fmt.Sprintf("Falling back to %s: %s", fallback, err), "DEBUG", hostname, downstream))
+		}
+		// fallbacks are configured rather than requested, so they aren't
+		// checked against the blocklist
+		upstream, err = p.connect(p.dialBreaker, downstream, net.JoinHostPort(fallback, port), hostname, replay, idempotent)
+		if err == nil {
+			setUpstream(downstream, hostname, upstream)
+			return upstream, fallback, nil
+		}
+	}
+	return nil, "", err
+}
+
+// canFallBack returns false if the upstream might have acted on the client's
+// data before failing
+func canFallBack(err error, idempotent bool) bool {
+	setupErr, ok := err.(*upstreamSetupError)
+	return idempotent || !ok || setupErr.step != "proxying initial data"
+}
+
+// serveMaintenance answers the request read from conn with the maintenance
+// page, downstream being the client connection it's logged for
+func (p *ConnectionProxy) serveMaintenance(conn, downstream net.Conn, err error, hostname string) bool {
+	p.writeHTTPError(conn, http.StatusServiceUnavailable, hostname)
+	if debugLog {
+		p.logger.Printf("%s\n", NewLogData(err.Error(), "DEBUG", hostname, downstream))
+	}
+	p.Close(conn)
+	return p.LogAccessVia(fallbackMaintenance, hostname, downstream)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newFallbackProxy(w *BufferWriter, fallbacks ...string) *ConnectionProxy {
+	proxy := getMockProxy(w)
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, Fallbacks: fallbacks}}}
+	return proxy
+}
+
+func TestFallbackOrigin(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := newFallbackProxy(w, "origin.example.net", "10.0.0.5", fallbackMaintenance)
+	// origins may be on private networks
+	proxy.blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	proxy.lookup = lookupAddresses("192.0.2.1")
+	dial, dialed := dialByAddress(map[string]dialFunc{
+		"192.0.2.1:80":          dialRefused,
+		"origin.example.net:80": dialRefused,
+		"10.0.0.5:80":           dialEchoServer(t),
+	})
+	proxy.dial = dial
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != request {
+		t.Errorf("Expected the request to reach the fallback, got %q", response)
+	}
+	if addresses := strings.Join(dialed(), " "); addresses != "192.0.2.1:80 origin.example.net:80 10.0.0.5:80" {
+		t.Errorf("Expected the fallbacks to be tried in order, got %s", addresses)
+	}
+	if !strings.Contains(string(w.Content()), "ACCESS: connected fallback=10.0.0.5") {
+		t.Errorf("Expected the fallback in the access log, got %s", w.Content())
+	}
+}
+
+func TestFallbackMaintenance(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := newFallbackProxy(w, "origin.example.net", fallbackMaintenance)
+	proxy.dial = dialRefused
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 503 ") || !strings.Contains(string(response), "temporarily unavailable") {
+		t.Errorf("Expected the maintenance page, got %q", response)
+	}
+	if !strings.Contains(string(w.Content()), "ACCESS: served fallback=maintenance") {
+		t.Errorf("Expected the fallback in the access log, got %s", w.Content())
+	}
+}
+
+func TestFallbackNotIdempotent(t *testing.T) {
+	proxy := newFallbackProxy(&BufferWriter{}, "origin.example.net")
+	echo := dialEchoServer(t)
+	dial, dialed := dialByAddress(map[string]dialFunc{
+		"www.example.com:80": func(network, address string, timeout time.Duration) (net.Conn, error) {
+			conn, err := echo(network, address, timeout)
+			return &failingWriteConn{conn}, err
+		},
+		"origin.example.net:80": echo,
+	})
+	proxy.dial = dial
+
+	response, err := requestHTTPRaw("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 0\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 502 ") {
+		t.Errorf("Expected a 502 response, got %q", response)
+	}
+	if addresses := dialed(); len(addresses) != 1 {
+		t.Errorf("Expected no fallback for a request that might have been acted on, got %v", addresses)
+	}
+}
+
+func TestFallbackHTTPS(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := newFallbackProxy(w, "origin.example.net", fallbackMaintenance)
+	dial, dialed := dialByAddress(map[string]dialFunc{
+		"www.example.com:443":    dialRefused,
+		"origin.example.net:443": dialRefused,
+	})
+	proxy.dial = dial
+
+	requestHTTPS("example.com", "example.com", proxy)
+	if addresses := strings.Join(dialed(), " "); addresses != "www.example.com:443 origin.example.net:443" {
+		t.Errorf("Expected the origin to be tried, got %s", addresses)
+	}
+	// without terminating TLS, the maintenance page can't be served
+	if logs := string(w.Content()); !strings.Contains(logs, "Couldn't connect to backend: connection refused") || strings.Contains(logs, "fallback=maintenance") {
+		t.Errorf("Expected the connection to fail, got %s", logs)
+	}
+	if logs := string(w.Content()); !strings.Contains(logs, "DEBUG: Can't serve the maintenance page without terminating TLS") {
+		t.Errorf("Expected the skipped maintenance page to be logged, got %s", logs)
+	}
+}
+
+func TestLoadConfigFallbacks(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"rules": [{"hosts": ["*"], "fallbacks": ["origin.example.com", "maintenance"]}]}`, ""},
+		{`{"rules": [{"hosts": ["*"], "fallbacks": ["maintenance", "origin.example.com"]}]}`, `"maintenance" has to be the last fallback`},
+		{`{"rules": [{"hosts": ["*"], "fallbacks": ["origin.example.com:8080"]}]}`, `fallback "origin.example.com:8080" has a port`},
+		{`{"rules": [{"hosts": ["*"], "fallbacks": [""]}]}`, "empty fallback"},
+	}
+	dir := tempDir(t)
+	for _, test := range tests {
+		path := dir + "/rules.json"
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadConfig(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.content, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.content, test.err, err)
+		}
+	}
+}
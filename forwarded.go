@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// forwardedHeaderNames are the headers that tell the upstream about the
+// client and the original request
+var forwardedHeaderNames = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"Forwarded",
+}
+
+// isForwardedHeader returns the canonical name if the header field name is
+// one of forwardedHeaderNames, or "" otherwise
+func isForwardedHeader(name string) string {
+	for _, forwarded := range forwardedHeaderNames {
+		if strings.EqualFold(name, forwarded) {
+			return forwarded
+		}
+	}
+	return ""
+}
+
+// rewriteForwardedHeaders returns the request head with the client's address
+// added to the X-Forwarded-* and Forwarded headers, if enabled. Copies of
+// those headers sent by clients that aren't trusted proxies are removed first
+// if stripping is enabled.
+func (p *ConnectionProxy) rewriteForwardedHeaders(head []byte, client net.Addr, hostname string) []byte {
+	if !p.forwardedHeaders && !p.stripForwarded {
+		return head
+	}
+	clientIP := addrIP(client)
+	strip := p.stripForwarded && !containsIP(p.trustedProxies, clientIP)
+
+	// the head is rebuilt line by line, leaving everything that isn't
+	// changed byte for byte the same
+	lines := bytes.SplitAfter(head, []byte("\n"))
+	lastLine := map[string]int{}
+	for i, line := range lines {
+		if i == 0 || len(bytes.TrimRight(line, "\r\n")) == 0 {
+			continue
+		}
+		name, _, err := parseHeaderLine(strings.TrimRight(string(line), "\r\n"))
+		if err != nil {
+			continue
+		}
+		if forwarded := isForwardedHeader(name); forwarded != "" {
+			if strip {
+				lines[i] = nil
+				continue
+			}
+			lastLine[forwarded] = i
+		}
+	}
+
+	if p.forwardedHeaders {
+		values := map[string]string{
+			"X-Forwarded-For":   "unknown",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  hostname,
+		}
+		if clientIP != nil {
+			values["X-Forwarded-For"] = clientIP.String()
+		}
+		values["Forwarded"] = fmt.Sprintf("for=%s;proto=http;host=%s", forwardedNode(clientIP), hostname)
+
+		// list headers are extended, others only set if missing
+		appendToLine(lines, lastLine, "X-Forwarded-For", values["X-Forwarded-For"])
+		appendToLine(lines, lastLine, "Forwarded", values["Forwarded"])
+		var added []byte
+		for _, name := range forwardedHeaderNames {
+			if _, ok := lastLine[name]; !ok {
+				added = append(added, fmt.Sprintf("%s: %s\r\n", name, values[name])...)
+			}
+		}
+		// before the empty line that ends the head
+		end := len(lines) - 1
+		for end > 0 && len(lines[end]) == 0 {
+			end--
+		}
+		lines[end] = append(added, lines[end]...)
+	}
+
+	result := make([]byte, 0, len(head)+256)
+	for _, line := range lines {
+		result = append(result, line...)
+	}
+	return result
+}
+
+// appendToLine adds value to the end of the list in the last header field
+// called name, if there is one
+func appendToLine(lines [][]byte, lastLine map[string]int, name, value string) {
+	i, ok := lastLine[name]
+	if !ok {
+		return
+	}
+	line := lines[i]
+	content := bytes.TrimRight(line, "\r\n")
+	ending := line[len(content):]
+	updated := make([]byte, 0, len(line)+len(value)+2)
+	updated = append(updated, bytes.TrimRight(content, " \t")...)
+	updated = append(updated, ", "...)
+	updated = append(updated, value...)
+	lines[i] = append(updated, ending...)
+}
+
+// forwardedNode formats ip as a node for the Forwarded header, RFC 7239
+// requires IPv6 addresses to be bracketed and quoted
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return ip.String()
+}
+
+// addrIP returns the IP address of a connection's address
+func addrIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// containsIP returns true if ip is in any of the networks
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCIDRs parses a comma separated list of networks, e.g.
+// "10.0.0.0/8,fc00::/7". Single addresses are allowed as well.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", cidr)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteForwardedHeaders(t *testing.T) {
+	trusted, _ := parseCIDRs("10.0.0.0/8, 2001:db8::1")
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	trustedClient := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	ipv6Client := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 1234}
+
+	tests := []struct {
+		name     string
+		add      bool
+		strip    bool
+		client   net.Addr
+		head     string
+		expected string
+	}{
+		{
+			"disabled",
+			false, false, client,
+			"GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 1.1.1.1\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 1.1.1.1\r\n\r\n",
+		},
+		{
+			"added",
+			true, false, client,
+			"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: example.com\r\n" +
+				"X-Forwarded-For: 192.0.2.1\r\nX-Forwarded-Proto: http\r\nX-Forwarded-Host: example.com\r\n" +
+				"Forwarded: for=192.0.2.1;proto=http;host=example.com\r\n\r\n",
+		},
+		{
+			"appended",
+			true, false, client,
+			"GET / HTTP/1.1\nHost: example.com\nx-forwarded-for: 1.1.1.1 \nX-Forwarded-Proto: https\nForwarded: for=1.1.1.1\n\n",
+			"GET / HTTP/1.1\nHost: example.com\nx-forwarded-for: 1.1.1.1, 192.0.2.1\nX-Forwarded-Proto: https\n" +
+				"Forwarded: for=1.1.1.1, for=192.0.2.1;proto=http;host=example.com\n" +
+				"X-Forwarded-Host: example.com\r\n\n",
+		},
+		{
+			"stripped from untrusted",
+			false, true, client,
+			"GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1\r\nHost: example.com\r\nForwarded: for=1.1.1.1\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			"kept from trusted",
+			false, true, trustedClient,
+			"GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1\r\nHost: example.com\r\n\r\n",
+			"GET / HTTP/1.1\r\nX-Forwarded-For: 1.1.1.1\r\nHost: example.com\r\n\r\n",
+		},
+		{
+			"stripped and replaced",
+			true, true, ipv6Client,
+			"GET / HTTP/1.1\r\nHost: example.com\r\nX-Forwarded-For: 1.1.1.1\r\n\r\n",
+			"GET / HTTP/1.1\r\nHost: example.com\r\n" +
+				"X-Forwarded-For: 2001:db8::2\r\nX-Forwarded-Proto: http\r\nX-Forwarded-Host: example.com\r\n" +
+				"Forwarded: for=\"[2001:db8::2]\";proto=http;host=example.com\r\n\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		proxy := getMockProxy(&BufferWriter{})
+		proxy.forwardedHeaders = test.add
+		proxy.stripForwarded = test.strip
+		proxy.trustedProxies = trusted
+		actual := string(proxy.rewriteForwardedHeaders([]byte(test.head), test.client, "example.com"))
+		if actual != test.expected {
+			t.Errorf("%s: expected\n%q got\n%q", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestHTTPForwardedHeaders(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.forwardedHeaders = true
+	proxy.stripForwarded = true
+	proxy.dial = dialHTTPEchoServer(t)
+
+	response, err := requestHTTPRaw("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\nX-Forwarded-For: 6.6.6.6\r\n\r\nbody", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 4\r\n" +
+		"X-Forwarded-For: 127.0.0.1\r\nX-Forwarded-Proto: http\r\nX-Forwarded-Host: example.com\r\n" +
+		"Forwarded: for=127.0.0.1;proto=http;host=example.com\r\n\r\nbody"
+	if actual := responseBody(response); actual != expected {
+		t.Errorf("Expected upstream to receive\n%q got\n%q", expected, actual)
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	networks, err := parseCIDRs("10.0.0.0/8, 192.0.2.1,fc00::/7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.1.1.1", "192.0.2.1", "fd00::1"} {
+		if !containsIP(networks, net.ParseIP(ip)) {
+			t.Errorf("Expected %s to be in %v", ip, networks)
+		}
+	}
+	for _, ip := range []string{"11.1.1.1", "192.0.2.2", "2001:db8::1"} {
+		if containsIP(networks, net.ParseIP(ip)) {
+			t.Errorf("Expected %s not to be in %v", ip, networks)
+		}
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected an error for an invalid network")
+	}
+	if networks, _ := parseCIDRs(""); len(networks) != 0 {
+		t.Errorf("Expected no networks, got %v", networks)
+	}
+}
+
+func TestHTTPForwardedHeadersKeepAlive(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.stripForwarded = true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %q", r.Host, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer server.Close()
+	dialed := recordDials(proxy, func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, server.Listener.Addr().String(), timeout)
+	})
+	client := getKeepAliveClient(t, proxy)
+
+	// in passthrough mode every request still goes to the first upstream,
+	// but none of them can sneak in a forwarded header
+	expected := []string{`a.example ""`, `b.example ""`, `a.example ""`}
+	for i, host := range []string{"a.example", "b.example", "a.example"} {
+		request := newTestRequest(t, "GET", host, nil)
+		request.Header.Set("X-Forwarded-For", "6.6.6.6")
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected[i] {
+			t.Errorf("Expected response '%s' got '%s'", expected[i], string(body))
+		}
+	}
+
+	close(dialed)
+	var addresses []string
+	for address := range dialed {
+		addresses = append(addresses, address)
+	}
+	if strings.Join(addresses, ",") != "www.a.example:80" {
+		t.Errorf("Expected a single connection to the first upstream, got %v", addresses)
+	}
+}
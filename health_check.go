@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of health checks
+const (
+	// healthCheckTCP only connects to the backend
+	healthCheckTCP = "tcp"
+	// healthCheckHTTP expects a 2xx or 3xx response to a GET request
+	healthCheckHTTP = "http"
+	// healthCheckTLS expects a TLS handshake to complete
+	healthCheckTLS = "tls"
+)
+
+// HealthCheck is checked periodically against every backend of a pool.
+// Backends that fail it Fall times in a row are no longer picked, until
+// they pass it Rise times in a row.
+type HealthCheck struct {
+	// Type is tcp (the default), http or tls
+	Type string `json:"type"`
+	// Port defaults to 443 for tls checks and 80 for the others
+	Port int `json:"port"`
+	// Path is requested by http checks, defaults to "/"
+	Path string `json:"path"`
+	// Host is sent as the Host header of http checks and the SNI of tls
+	// checks, defaults to the backend's address
+	Host string `json:"host"`
+	// Interval between checks, defaults to 10s
+	Interval duration `json:"interval"`
+	// Timeout for each check, defaults to 2s
+	Timeout duration `json:"timeout"`
+	// Rise is how many checks an unhealthy backend has to pass, defaults
+	// to 2
+	Rise int `json:"rise"`
+	// Fall is how many checks a healthy backend has to fail, defaults to 3
+	Fall int `json:"fall"`
+}
+
+// duration is a time.Duration written as a string in JSON, e.g. "10s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("durations are strings such as \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (c *HealthCheck) validate() error {
+	switch c.Type {
+	case "":
+		c.Type = healthCheckTCP
+	case healthCheckTCP, healthCheckHTTP, healthCheckTLS:
+	default:
+		return fmt.Errorf("unknown health check type %q", c.Type)
+	}
+	if c.Port == 0 {
+		c.Port = 80
+		if c.Type == healthCheckTLS {
+			c.Port = 443
+		}
+	}
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("health check path %q doesn't start with /", c.Path)
+	}
+	if c.Interval == 0 {
+		c.Interval = duration(10 * time.Second)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = duration(2 * time.Second)
+	}
+	if c.Rise == 0 {
+		c.Rise = 2
+	}
+	if c.Fall == 0 {
+		c.Fall = 3
+	}
+	if c.Port < 0 || c.Port > 65535 || c.Interval < 0 || c.Timeout < 0 || c.Rise < 0 || c.Fall < 0 {
+		return fmt.Errorf("invalid health check")
+	}
+	return nil
+}
+
+// check returns why the backend at address failed the check, or nil if it
+// passed
+func (c *HealthCheck) check(address string) error {
+	timeout := time.Duration(c.Timeout)
+	target := net.JoinHostPort(address, strconv.Itoa(c.Port))
+	host := c.Host
+	if host == "" {
+		host = address
+	}
+	switch c.Type {
+	case healthCheckHTTP:
+		client := &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Dial: func(network, _ string) (net.Conn, error) {
+					return net.DialTimeout(network, target, timeout)
+				},
+				DisableKeepAlives: true,
+			},
+			// a redirect is an answer, it doesn't have to be followed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		request, err := http.NewRequest(http.MethodGet, "http://"+target+c.Path, nil)
+		if err != nil {
+			return err
+		}
+		request.Host = host
+		request.Header.Set("User-Agent", "sensible-proxy health check")
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode >= 400 {
+			return fmt.Errorf("status %d", response.StatusCode)
+		}
+		return nil
+	case healthCheckTLS:
+		// only the handshake is checked, the certificate is for the
+		// hostnames of the pool rather than the backend's address
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", target, &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// startHealthChecks checks each backend of the pool every interval, logging
+// when one goes down or comes back up
+func (p *Pool) startHealthChecks(logf func(format string, v ...interface{})) {
+	if p.HealthCheck == nil {
+		return
+	}
+	for _, backend := range p.Backends {
+		go func(backend *Backend) {
+			ticker := time.NewTicker(time.Duration(p.HealthCheck.Interval))
+			for range ticker.C {
+				p.recordHealth(backend, p.HealthCheck.check(backend.Address), logf)
+			}
+		}(backend)
+	}
+}
+
+// recordHealth records the result of a check of backend, and takes it out
+// of or puts it back into rotation once enough checks in a row disagree
+// with its state
+func (p *Pool) recordHealth(backend *Backend, err error, logf func(format string, v ...interface{})) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if (err != nil) == backend.down {
+		backend.streak = 0
+		return
+	}
+	backend.streak++
+	if backend.down && backend.streak >= p.HealthCheck.Rise {
+		backend.down, backend.streak = false, 0
+		logf("Backend %s of pool %s is up\n", backend.Address, p.name)
+	} else if !backend.down && backend.streak >= p.HealthCheck.Fall {
+		backend.down, backend.streak = true, 0
+		logf("Backend %s of pool %s is down: %s\n", backend.Address, p.name, err)
+	}
+}
+
+// startHealthChecks starts the health checks of all pools
+func (c *Config) startHealthChecks(logf func(format string, v ...interface{})) {
+	if c == nil {
+		return
+	}
+	for _, pool := range c.Pools {
+		pool.startHealthChecks(logf)
+	}
+}
+
+// backendStatus is how a backend is doing, for the metrics
+type backendStatus struct {
+	Healthy     bool `json:"healthy"`
+	Connections int  `json:"connections"`
+}
+
+// poolStatus returns the status of the backends of each pool by address
+func (c *Config) poolStatus() map[string]map[string]backendStatus {
+	status := map[string]map[string]backendStatus{}
+	if c == nil {
+		return status
+	}
+	for name, pool := range c.Pools {
+		pool.mutex.Lock()
+		backends := map[string]backendStatus{}
+		for _, backend := range pool.Backends {
+			backends[backend.Address] = backendStatus{Healthy: !backend.down, Connections: backend.active}
+		}
+		pool.mutex.Unlock()
+		status[name] = backends
+	}
+	return status
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	a, b := &Backend{Address: "a"}, &Backend{Address: "b"}
+	pool := newTestPool(t, "", a, b)
+	pool.name = "web"
+	pool.HealthCheck = &HealthCheck{}
+	pool.HealthCheck.validate()
+	w := &BufferWriter{}
+	logf := getMockProxy(w).Logf
+	failed := errors.New("connection refused")
+
+	for i, err := range []error{failed, failed, nil, failed, failed} {
+		pool.recordHealth(a, err, logf)
+		if a.down {
+			t.Fatalf("Expected the backend to stay up after %d checks", i+1)
+		}
+	}
+	pool.recordHealth(a, failed, logf)
+	if !a.down {
+		t.Fatal("Expected the backend to be down after 3 failed checks in a row")
+	}
+	for i := 0; i < 4; i++ {
+		if backend := pool.pick(""); backend != b {
+			t.Fatalf("Expected the healthy backend to be picked, got %s", backend.Address)
+		}
+	}
+
+	pool.recordHealth(a, nil, logf)
+	if !a.down {
+		t.Error("Expected the backend to stay down after passing one check")
+	}
+	pool.recordHealth(a, nil, logf)
+	if a.down {
+		t.Error("Expected the backend to be up after passing 2 checks in a row")
+	}
+	logs := string(w.Content())
+	if !strings.Contains(logs, "Backend a of pool web is down: connection refused") || !strings.Contains(logs, "Backend a of pool web is up") {
+		t.Errorf("Expected the state changes in the logs, got %s", logs)
+	}
+}
+
+func TestPoolSkipsDownBackends(t *testing.T) {
+	for _, strategy := range []string{strategyRoundRobin, strategyLeastConnections, strategyHash} {
+		a, b := &Backend{Address: "a"}, &Backend{Address: "b"}
+		pool := newTestPool(t, strategy, a, b)
+		a.down = true
+		for i := 0; i < 20; i++ {
+			if backend := pool.pick(fmt.Sprintf("192.0.2.%d", i)); backend != b {
+				t.Fatalf("%s: expected the backend that's up, got %s", strategy, backend.Address)
+			}
+		}
+		b.down = true
+		if backend := pool.pick(""); backend != nil {
+			t.Errorf("%s: expected no backend, got %s", strategy, backend.Address)
+		}
+	}
+}
+
+func TestPoolNoHealthyBackends(t *testing.T) {
+	pool := newTestPool(t, "", &Backend{Address: "10.0.0.5", down: true})
+	pool.name = "web"
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.config = &Config{
+		Rules: []*Rule{{Hosts: []string{"*"}, Pool: "web"}},
+		Pools: map[string]*Pool{"web": pool},
+	}
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 502 ") {
+		t.Errorf("Expected a 502 response, got %q", response)
+	}
+	if !strings.Contains(string(w.Content()), "Couldn't connect to backend: no healthy backends in pool web") {
+		t.Errorf("Expected the reason in the logs, got %s", w.Content())
+	}
+}
+
+func TestHealthCheckTypes(t *testing.T) {
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "example.com" || r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer httpServer.Close()
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	tests := []struct {
+		check   HealthCheck
+		address string
+		healthy bool
+	}{
+		{HealthCheck{}, httpServer.URL, true},
+		{HealthCheck{}, "http://" + closed.Addr().String(), false},
+		{HealthCheck{Type: healthCheckHTTP, Path: "/health", Host: "example.com"}, httpServer.URL, true},
+		{HealthCheck{Type: healthCheckHTTP, Path: "/"}, httpServer.URL, false},
+		{HealthCheck{Type: healthCheckTLS}, tlsServer.URL, true},
+		{HealthCheck{Type: healthCheckTLS}, httpServer.URL, false},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.address)
+		test.check.Port, _ = strconv.Atoi(u.Port())
+		test.check.Timeout = duration(time.Second)
+		if err := test.check.validate(); err != nil {
+			t.Fatal(err)
+		}
+		err := test.check.check(u.Hostname())
+		if (err == nil) != test.healthy {
+			t.Errorf("%s check of %s: expected healthy %v, got %v", test.check.Type, test.address, test.healthy, err)
+		}
+	}
+}
+
+func TestLoadConfigHealthCheck(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5"}], "health_check": {"type": "http", "interval": "5s", "rise": 1}}}}`, ""},
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5"}], "health_check": {"type": "icmp"}}}}`, `unknown health check type "icmp"`},
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5"}], "health_check": {"interval": 5}}}}`, `durations are strings`},
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5"}], "health_check": {"path": "health"}}}}`, `doesn't start with /`},
+	}
+	dir := tempDir(t)
+	for _, test := range tests {
+		path := dir + "/rules.json"
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.content, err)
+				continue
+			}
+			check := config.Pools["web"].HealthCheck
+			if check.Interval != duration(5*time.Second) || check.Timeout != duration(2*time.Second) || check.Rise != 1 || check.Fall != 3 || check.Port != 80 {
+				t.Errorf("%s: unexpected health check %+v", test.content, check)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.content, test.err, err)
+		}
+	}
+}
+
+func TestPoolStatus(t *testing.T) {
+	pool := newTestPool(t, "", &Backend{Address: "10.0.0.5"}, &Backend{Address: "10.0.0.6", down: true})
+	config := &Config{Pools: map[string]*Pool{"web": pool}}
+	pool.pick("")
+
+	status := config.poolStatus()
+	if status["web"]["10.0.0.5"] != (backendStatus{Healthy: true, Connections: 1}) || status["web"]["10.0.0.6"] != (backendStatus{}) {
+		t.Errorf("Unexpected status %+v", status)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on DNS names, see RFC 1035 section 2.3.4
+const (
+	maxHostnameLen = 253
+	maxLabelLen    = 63
+)
+
+// hostnameError is returned for hostnames from clients that aren't valid
+// DNS names
+type hostnameError struct {
+	hostname string
+	reason   string
+}
+
+func (e *hostnameError) Error() string {
+	return fmt.Sprintf("invalid hostname %q: %s", e.hostname, e.reason)
+}
+
+// normalizeHostname returns the hostname from a Host header or SNI in the
+// form it's whitelisted, matched against rules and dialed with: lowercase,
+// without a port or trailing dot, and with internationalized labels in
+// punycode. Anything that isn't a valid DNS name of letters, digits and
+// hyphens (RFC 1123) gets a *hostnameError.
+func normalizeHostname(hostname string) (string, error) {
+	invalid := func(reason string) (string, error) {
+		return "", &hostnameError{hostname: hostname, reason: reason}
+	}
+	if !utf8.ValidString(hostname) {
+		return invalid("not UTF-8")
+	}
+	name, err := stripPort(hostname)
+	if err != nil {
+		return invalid(err.Error())
+	}
+	// ideographic and fullwidth full stops separate labels as well, see
+	// RFC 3490 section 3.1
+	name = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(name)
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return invalid("empty")
+	}
+
+	labels := strings.Split(name, ".")
+	for i, label := range labels {
+		if label == "" {
+			return invalid("empty label")
+		}
+		if !isASCII(label) {
+			if labels[i], err = punycodeEncode(label); err != nil {
+				return invalid(err.Error())
+			}
+			labels[i] = "xn--" + labels[i]
+		}
+		if len(labels[i]) > maxLabelLen {
+			return invalid("label too long")
+		}
+		if !isLDHLabel(labels[i]) {
+			return invalid("only letters, digits and hyphens are allowed")
+		}
+	}
+	// IP addresses aren't hostnames, and neither is anything else with a
+	// numeric top-level domain
+	if strings.Trim(labels[len(labels)-1], "0123456789") == "" {
+		return invalid("numeric top-level domain")
+	}
+	name = strings.Join(labels, ".")
+	if len(name) > maxHostnameLen {
+		return invalid("too long")
+	}
+	return name, nil
+}
+
+// isLDHLabel returns true if label only has letters, digits and hyphens,
+// and doesn't start or end with a hyphen
+func isLDHLabel(label string) bool {
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		c := label[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of punycode for IDNA, see RFC 3492 section 5
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeEncode encodes a label with the algorithm from RFC 3492 section
+// 6.3, without the "xn--" prefix
+func punycodeEncode(label string) (string, error) {
+	runes := []rune(label)
+	// every code point takes at least a byte, and longer labels would
+	// make this quadratic loop slow
+	if len(runes) > maxLabelLen {
+		return "", fmt.Errorf("label too long")
+	}
+	var output []byte
+	for _, r := range runes {
+		if r < punycodeInitialN {
+			output = append(output, byte(r))
+		}
+	}
+	basic := len(output)
+	handled := basic
+	if basic > 0 {
+		output = append(output, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for handled < len(runes) {
+		// the smallest code point not handled yet
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				output = append(output, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			output = append(output, punycodeDigit(q))
+			bias = punycodeAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(output), nil
+}
+
+func punycodeAdapt(delta, points int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / points
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeHostname(t *testing.T) {
+	tests := []struct {
+		hostname string
+		expected string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"example.com.", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"EXAMPLE.com.:80", "example.com"},
+		{"my-site.example.com", "my-site.example.com"},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"例え。テスト", "xn--r8jz45g.xn--zckzah"},
+		{"3com.com", "3com.com"},
+		{strings.Repeat("a", 63) + ".com", strings.Repeat("a", 63) + ".com"},
+	}
+	for _, test := range tests {
+		actual, err := normalizeHostname(test.hostname)
+		if err != nil {
+			t.Errorf("%q: %s", test.hostname, err)
+		} else if actual != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.hostname, test.expected, actual)
+		}
+	}
+}
+
+func TestNormalizeHostnameInvalid(t *testing.T) {
+	for _, hostname := range []string{
+		"",
+		".",
+		"example..com",
+		".example.com",
+		"exa mple.com",
+		"example.com/path",
+		"example_1.com",
+		"-example.com",
+		"example-.com",
+		"example.com:http",
+		"example.com:99999",
+		"127.0.0.1",
+		"[::1]",
+		"[::1]:80",
+		"\xff.com",
+		strings.Repeat("a", 64) + ".com",
+		strings.Repeat("ü", 64) + ".com",
+		strings.Repeat("a.", 127) + "com",
+	} {
+		_, err := normalizeHostname(hostname)
+		if _, ok := err.(*hostnameError); !ok {
+			t.Errorf("%q: expected a *hostnameError, got %v", hostname, err)
+		}
+	}
+}
+
+func TestHTTPNormalizedHostname(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	if _, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: EXAMPLE.com.:80\r\n\r\n", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-dialed; address != "www.example.com:80" {
+		t.Errorf("Expected the normalized hostname to be whitelisted and dialed, got %s", address)
+	}
+}
+
+func TestHTTPInvalidHostname(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: evil.com/x\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 400 ") {
+		t.Errorf("Expected a 400 response, got %q", response)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected nothing to be dialed, got %s", <-dialed)
+	}
+}
+
+func TestHTTPSNormalizedHostname(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	go requestHTTPS("Example.COM", "example.com", proxy)
+	if address := <-dialed; address != "www.example.com:443" {
+		t.Errorf("Expected the normalized hostname to be whitelisted and dialed, got %s", address)
+	}
+}
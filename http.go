@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxHeaderSize is the largest request line and headers accepted from
+// a client, unless configured otherwise
+const defaultMaxHeaderSize = 8192
+
+var (
+	errMalformedHeader = errors.New("malformed header field")
+	errInvalidPort     = errors.New("invalid port")
+	errEmptyHost       = errors.New("empty host")
+)
+
+// requestError is a problem with the client's request, which is reported
+// back to it with status
+type requestError struct {
+	status int
+	reason string
+}
+
+func (e *requestError) Error() string {
+	return e.reason
+}
+
+func badRequest(err error) *requestError {
+	return &requestError{http.StatusBadRequest, fmt.Sprintf("Bad request - %s", err)}
+}
+
+// readRequestHead reads the request line and headers from reader, returning
+// them exactly as they were received together with the normalized requested
+// host. Read errors are returned as is, problems with the request as a
+// *requestError.
+func readRequestHead(reader *bufio.Reader, limit int) ([]byte, string, error) {
+	if err := skipEmptyLines(reader, limit); err != nil {
+		return nil, "", err
+	}
+	head, err := readHead(reader, limit)
+	if err != nil {
+		return head, "", err
+	}
+	hostname, err := requestHost(headLines(head))
+	if err == nil {
+		hostname, err = normalizeHostname(hostname)
+	}
+	if err != nil {
+		return head, hostname, badRequest(err)
+	}
+	return head, hostname, nil
+}
+
+// skipEmptyLines discards empty lines before a request line, which some
+// clients send after a request body, see RFC 7230 section 3.5
+func skipEmptyLines(reader *bufio.Reader, limit int) error {
+	for skipped := 0; ; {
+		line, err := reader.Peek(1)
+		if err == nil && line[0] == '\r' {
+			line, err = reader.Peek(2)
+		}
+		if err != nil {
+			return err
+		}
+		if string(line) != "\n" && string(line) != "\r\n" {
+			return nil
+		}
+		reader.Discard(len(line))
+		if skipped += len(line); skipped > limit {
+			return &requestError{http.StatusRequestHeaderFieldsTooLarge, "Request header too large"}
+		}
+	}
+}
+
+// readHead reads the start line and header fields of an HTTP message up to
+// and including the empty line that ends them
+func readHead(reader *bufio.Reader, limit int) ([]byte, error) {
+	var head []byte
+	for {
+		start := len(head)
+		for {
+			fragment, err := reader.ReadSlice('\n')
+			head = append(head, fragment...)
+			if len(head) > limit {
+				return head, &requestError{http.StatusRequestHeaderFieldsTooLarge, "Request header too large"}
+			}
+			if err == bufio.ErrBufferFull {
+				// the line is longer than what fits in the reader
+				continue
+			}
+			if err != nil {
+				return head, err
+			}
+			break
+		}
+		if len(bytes.TrimRight(head[start:], "\r\n")) == 0 {
+			// End of HTTP headers
+			return head, nil
+		}
+	}
+}
+
+// headLines splits a message head into its lines, without line endings and
+// the final empty line
+func headLines(head []byte) []string {
+	lines := strings.Split(strings.TrimRight(string(head), "\r\n"), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSuffix(lines[i], "\r")
+	}
+	return lines
+}
+
+// requestHost returns the host a request is for, lines being the request
+// line followed by the header fields
+func requestHost(lines []string) (string, error) {
+	// an absolute-form request-target takes precedence over the Host
+	// header
+	hostname, err := hostFromRequestLine(lines[0])
+	if err != nil {
+		return "", err
+	}
+	hostHeaders := 0
+	for _, line := range lines[1:] {
+		host, err := hostFromHeaderLine(line)
+		if err != nil {
+			return "", err
+		}
+		if host == "" {
+			continue
+		}
+		if hostHeaders++; hostHeaders > 1 {
+			return "", errors.New("multiple Host headers")
+		}
+		if hostname == "" {
+			hostname = host
+		}
+	}
+	if hostname == "" {
+		return "", errors.New("no host")
+	}
+	return hostname, nil
+}
+
+// hostFromRequestLine returns the host of an absolute-form request-target,
+// e.g. "GET http://example.com/ HTTP/1.1", which RFC 7230 section 5.4 says
+// must be used instead of the Host header. It returns "" for any other form.
+func hostFromRequestLine(line string) (string, error) {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !strings.Contains(parts[1], "://") {
+		return "", nil
+	}
+	target, err := url.Parse(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return "", nil
+	}
+	return stripPort(target.Host)
+}
+
+// parseHeaderLine splits a header field into its name and value, with the
+// optional whitespace around the value removed
+func parseHeaderLine(line string) (string, string, error) {
+	colon := strings.IndexByte(line, ':')
+	if colon < 1 {
+		return "", "", errMalformedHeader
+	}
+	name := line[:colon]
+	// no whitespace is allowed between the field name and colon
+	if strings.ContainsAny(name, " \t") {
+		return "", "", errMalformedHeader
+	}
+	return name, strings.Trim(line[colon+1:], " \t"), nil
+}
+
+// hostFromHeaderLine returns the host from a Host header field, matched case
+// insensitively. It returns "" if line is a different header.
+func hostFromHeaderLine(line string) (string, error) {
+	name, value, err := parseHeaderLine(line)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(name, "Host") {
+		return "", nil
+	}
+	host, err := stripPort(value)
+	if err == nil && host == "" {
+		err = errEmptyHost
+	}
+	return host, err
+}
+
+// stripPort removes and validates the optional port from a uri-host, and
+// the brackets around an IPv6 address
+func stripPort(hostport string) (string, error) {
+	host, port := hostport, ""
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return "", fmt.Errorf("missing ']' in host %q", hostport)
+		}
+		host, port = hostport[1:end], hostport[end+1:]
+		if port != "" && port[0] != ':' {
+			return "", errInvalidPort
+		}
+		port = strings.TrimPrefix(port, ":")
+	} else if colon := strings.LastIndexByte(hostport, ':'); colon >= 0 {
+		host, port = hostport[:colon], hostport[colon+1:]
+	}
+
+	// an empty port is allowed, e.g. "example.com:"
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 || strings.TrimLeft(port, "0123456789") != "" {
+			return "", errInvalidPort
+		}
+	}
+	return host, nil
+}
+
+// writeHTTPRedirect sends a response redirecting the client to location, the
+// connection is expected to be closed afterwards
+func writeHTTPRedirect(w io.Writer, code int, location string) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nLocation: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n",
+		code, http.StatusText(code), location)
+	return err
+}
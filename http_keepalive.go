@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTP keep-alive modes. By default the upstream is picked from the first
+// request and everything after it is passed on untouched. In the other modes
+// every request on the connection is parsed, and requests for a different
+// host than the first one are either sent to that host's upstream or
+// answered with "421 Misdirected Request".
+const (
+	keepAlivePassthrough = ""
+	keepAliveReroute     = "reroute"
+	keepAliveReject      = "reject"
+)
+
+// bodyFraming is how the end of an HTTP message body is found, see RFC 7230
+// section 3.3.3
+type bodyFraming int
+
+const (
+	noBody bodyFraming = iota
+	fixedLengthBody
+	chunkedBody
+	// the body ends when the connection is closed
+	closeDelimitedBody
+)
+
+// errMalformedChunkSize is returned for chunk sizes that aren't all
+// hexadecimal digits
+var errMalformedChunkSize = errors.New("malformed chunk size")
+
+// messageHead holds what's needed to pass on an HTTP message from the
+// lines of its head
+type messageHead struct {
+	lines   []string
+	framing bodyFraming
+	length  int64
+	// keepAlive is false if the connection must be closed after the message
+	keepAlive bool
+}
+
+// headerValues returns the comma separated values of all header fields
+// called name
+func (m *messageHead) headerValues(name string) []string {
+	var values []string
+	for _, line := range m.lines[1:] {
+		field, value, err := parseHeaderLine(line)
+		if err != nil || !strings.EqualFold(field, name) {
+			continue
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.Trim(v, " \t"); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// hasToken returns true if any of the values of the header field name is
+// token, compared case insensitively
+func (m *messageHead) hasToken(name, token string) bool {
+	for _, value := range m.headerValues(name) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFraming finds out how the message body is framed from its
+// Transfer-Encoding and Content-Length headers
+func (m *messageHead) parseFraming() error {
+	if codings := m.headerValues("Transfer-Encoding"); len(codings) > 0 {
+		if !strings.EqualFold(codings[len(codings)-1], "chunked") {
+			return errors.New("unsupported Transfer-Encoding")
+		}
+		m.framing = chunkedBody
+		return nil
+	}
+	lengths := m.headerValues("Content-Length")
+	if len(lengths) == 0 {
+		return nil
+	}
+	for _, length := range lengths {
+		if length != lengths[0] {
+			return errors.New("conflicting Content-Length")
+		}
+	}
+	n, err := parseDigits(lengths[0], 10)
+	if err != nil {
+		return errors.New("invalid Content-Length")
+	}
+	m.framing = fixedLengthBody
+	m.length = n
+	return nil
+}
+
+// parseConnection works out whether the connection can be kept open after
+// the message, given the HTTP version on the start line
+func (m *messageHead) parseConnection(version string) {
+	if version == "HTTP/1.0" {
+		m.keepAlive = m.hasToken("Connection", "keep-alive")
+	} else {
+		m.keepAlive = !m.hasToken("Connection", "close")
+	}
+}
+
+// parseRequest parses the head of a request and returns its method
+func parseRequest(head []byte) (*messageHead, string, error) {
+	m := &messageHead{lines: headLines(head)}
+	parts := strings.Split(m.lines[0], " ")
+	if len(parts) != 3 {
+		return nil, "", errors.New("malformed request line")
+	}
+	if err := m.parseFraming(); err != nil {
+		return nil, "", err
+	}
+	// the upstream might frame such a request by its Content-Length and
+	// find a request in the body that never had its Host checked, see RFC
+	// 7230 section 3.3.3
+	if m.framing == chunkedBody && len(m.headerValues("Content-Length")) > 0 {
+		return nil, "", errors.New("both Transfer-Encoding and Content-Length")
+	}
+	m.parseConnection(parts[2])
+	return m, parts[0], nil
+}
+
+// parseResponse parses the head of a response to a request with method and
+// returns its status code
+func parseResponse(head []byte, method string) (*messageHead, int, error) {
+	m := &messageHead{lines: headLines(head)}
+	parts := strings.SplitN(m.lines[0], " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "HTTP/") {
+		return nil, 0, errors.New("malformed status line")
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil || status < 100 || status > 999 {
+		return nil, 0, errors.New("malformed status code")
+	}
+	m.parseConnection(parts[0])
+
+	switch {
+	case method == http.MethodHead || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified:
+		return m, status, nil
+	case method == http.MethodConnect && status < 300:
+		m.framing = closeDelimitedBody
+		return m, status, nil
+	}
+	if err := m.parseFraming(); err != nil {
+		// a response without a usable length ends with the connection
+		m.framing = closeDelimitedBody
+	}
+	if m.framing == noBody && len(m.headerValues("Content-Length")) == 0 {
+		m.framing = closeDelimitedBody
+	}
+	if m.framing == closeDelimitedBody {
+		m.keepAlive = false
+	}
+	return m, status, nil
+}
+
+// copyBody copies a message body framed as described by m from src to dst,
+// leaving the bytes unchanged
+func copyBody(dst io.Writer, src *bufio.Reader, m *messageHead, limit int) error {
+	switch m.framing {
+	case fixedLengthBody:
+		_, err := io.CopyN(dst, src, m.length)
+		return err
+	case closeDelimitedBody:
+		_, err := io.Copy(dst, src)
+		return err
+	case chunkedBody:
+		return copyChunkedBody(dst, src, limit)
+	}
+	return nil
+}
+
+// copyChunkedBody copies chunks until the last one and the trailer section
+// after it
+func copyChunkedBody(dst io.Writer, src *bufio.Reader, limit int) error {
+	for {
+		line, err := readChunkLine(src, limit)
+		if err != nil {
+			return err
+		}
+		size := strings.TrimRight(string(line), "\r\n")
+		if semicolon := strings.IndexByte(size, ';'); semicolon >= 0 {
+			size = size[:semicolon]
+		}
+		// checked before it's passed on, since the other side might read
+		// it differently
+		n, err := parseDigits(strings.TrimRight(size, " \t"), 16)
+		if err != nil {
+			return errMalformedChunkSize
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		// the chunk data is followed by CRLF
+		if _, err := io.CopyN(dst, src, n); err != nil {
+			return err
+		}
+		line, err = readChunkLine(src, limit)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(line); err != nil {
+			return err
+		}
+	}
+
+	trailers, err := readHead(src, limit)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(trailers)
+	return err
+}
+
+// parseDigits parses a Content-Length or chunk size in base 10 or 16.
+// Unlike strconv.ParseInt it refuses signs, which the grammar in RFC 7230
+// doesn't allow and others might not read the same way.
+func parseDigits(s string, base int) (int64, error) {
+	if s == "" {
+		return 0, errors.New("no digits")
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		hex := base == 16 && (('a' <= c && c <= 'f') || ('A' <= c && c <= 'F'))
+		if (c < '0' || c > '9') && !hex {
+			return 0, fmt.Errorf("invalid digit %q", c)
+		}
+	}
+	n, err := strconv.ParseUint(s, base, 63)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n), nil
+}
+
+// readChunkLine reads a chunk size line or the line ending after the chunk
+// data
+func readChunkLine(src *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		fragment, err := src.ReadSlice('\n')
+		line = append(line, fragment...)
+		if len(line) > limit {
+			return nil, errors.New("chunk line too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+// deadlineConn renews the read or write deadline of the connection before
+// each read and write, so that it fails after being idle for timeout
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// proxyHTTPRequests passes requests and responses between the client and
+// upstream one at a time, so each request's host can be checked. head is
+// the first request, which has already been read from reader.
+func proxyHTTPRequests(downstream net.Conn, reader *bufio.Reader, head []byte, hostname string, upstream net.Conn, proxy *ConnectionProxy) bool {
+	limit := proxy.headerLimit()
+	client := &deadlineConn{downstream, proxy.idleTimeout}
+	// carry over what has already been read from the client
+	buffered, _ := reader.Peek(reader.Buffered())
+	clientReader := bufio.NewReader(io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), client))
+	server := &deadlineConn{upstream, proxy.idleTimeout}
+	serverReader := bufio.NewReader(server)
+	tunneled := false
+	defer func() {
+		if !tunneled {
+			// errors are ignored since logging might already have closed
+			// the client connection
+			server.Conn.Close()
+			downstream.Close()
+		}
+	}()
+
+	for {
+		request, method, err := parseRequest(head)
+		if err != nil {
+			proxy.writeHTTPError(downstream, http.StatusBadRequest, hostname)
+			return proxy.LogDebug(fmt.Sprintf("Bad request - %s", err), hostname, downstream)
+		}
+		if _, err := server.Write(head); err != nil {
+			return proxy.LogDebug(fmt.Sprintf("Error while proxying request to backend: %s", err), hostname, downstream)
+		}
+		// the request body is sent while waiting for the response, as
+		// the upstream might answer before reading it all
+		bodySent := make(chan error, 1)
+		go func(upstream net.Conn) {
+			err := copyBody(server, clientReader, request, limit)
+			bodySent <- err
+			if err == errMalformedChunkSize {
+				// the upstream is still waiting for the rest of the body
+				upstream.Close()
+			}
+		}(server.Conn)
+
+		var response *messageHead
+		var status int
+		for {
+			responseHead, err := readHead(serverReader, limit)
+			if err == nil {
+				response, status, err = parseResponse(responseHead, method)
+			}
+			if err != nil {
+				select {
+				case bodyErr := <-bodySent:
+					if bodyErr == errMalformedChunkSize {
+						proxy.writeHTTPError(downstream, http.StatusBadRequest, hostname)
+						return proxy.LogDebug(fmt.Sprintf("Bad request - %s", bodyErr), hostname, downstream)
+					}
+				default:
+				}
+				return proxy.LogDebug(fmt.Sprintf("Error while reading response from backend: %s", err), hostname, downstream)
+			}
+			if _, err := client.Write(responseHead); err != nil {
+				return proxy.LogDebug(fmt.Sprintf("Error while proxying response to client: %s", err), hostname, downstream)
+			}
+			// informational responses are followed by the final one
+			if status >= 200 || status == http.StatusSwitchingProtocols {
+				break
+			}
+		}
+
+		if status == http.StatusSwitchingProtocols || (method == http.MethodConnect && status < 300) {
+			// from here on it's no longer HTTP
+			if err := <-bodySent; err != nil {
+				return proxy.LogDebug(fmt.Sprintf("Error while proxying request to backend: %s", err), hostname, downstream)
+			}
+			if buffered, _ := serverReader.Peek(serverReader.Buffered()); len(buffered) > 0 {
+				if _, err := client.Write(buffered); err != nil {
+					return proxy.LogDebug(fmt.Sprintf("Error while proxying response to client: %s", err), hostname, downstream)
+				}
+			}
+			// hiding the reader's type makes sure whatever is left of
+			// the carried over bytes is read before the connection
+			proxyConnections(downstream, struct{ io.Reader }{clientReader}, upstream, proxy)
+			tunneled = true
+			return true
+		}
+
+		if err := copyBody(client, serverReader, response, limit); err != nil {
+			return proxy.LogDebug(fmt.Sprintf("Error while proxying response to client: %s", err), hostname, downstream)
+		}
+		if !response.keepAlive || !request.keepAlive {
+			return true
+		}
+		select {
+		case err = <-bodySent:
+		default:
+			if request.hasToken("Expect", "100-continue") {
+				// the upstream answered without asking for the body, the
+				// client might never send it
+				return true
+			}
+			err = <-bodySent
+		}
+		if err != nil {
+			return proxy.LogDebug(fmt.Sprintf("Error while proxying request to backend: %s", err), hostname, downstream)
+		}
+
+		var nextHostname string
+		head, nextHostname, err = readRequestHead(clientReader, limit)
+		if err == io.EOF && len(head) == 0 {
+			// the client is done
+			return true
+		}
+		if err != nil {
+			if reqErr, ok := err.(*requestError); ok {
+				proxy.writeHTTPError(downstream, reqErr.status, hostname)
+				return proxy.LogDebug(reqErr.reason, hostname, downstream)
+			}
+			if isTimeout(err) {
+				return proxy.LogError("Idle timeout", hostname, downstream)
+			}
+			return proxy.LogDebug(fmt.Sprintf("Error while reading request: %s", err), hostname, downstream)
+		}
+		if proxy.loopDetected(nil, head) {
+			proxy.writeHTTPError(downstream, http.StatusLoopDetected, nextHostname)
+			return proxy.LogError("Proxy loop detected: the request already went through this proxy", nextHostname, downstream)
+		}
+		head = proxy.rewriteForwardedHeaders(head, downstream.RemoteAddr(), nextHostname)
+		head = proxy.addLoopMarker(head)
+		// in passthrough mode requests are only read for the forwarded
+		// headers, and go to the first request's upstream as before
+		if proxy.keepAliveMode == keepAlivePassthrough || strings.EqualFold(nextHostname, hostname) {
+			continue
+		}
+
+		if proxy.keepAliveMode != keepAliveReroute {
+			proxy.writeHTTPError(downstream, http.StatusMisdirectedRequest, nextHostname)
+			return proxy.LogDebug(fmt.Sprintf("Host differs from the first request on the connection: %s", hostname), nextHostname, downstream)
+		}
+		if !proxy.IsWhiteListed(nextHostname) {
+			proxy.writeHTTPError(downstream, http.StatusForbidden, nextHostname)
+			return proxy.LogDebug("Hostname is not whitelisted", nextHostname, downstream)
+		}
+		if rule := proxy.config.ruleFor(nextHostname); rule.Action == actionRedirect {
+			return proxy.redirectRequest(downstream, rule, head, nextHostname)
+		}
+		// the request is sent at the top of the loop
+		next, fallback, err := proxy.connectWithFallbacks(downstream, "www."+nextHostname+":80", nextHostname, nil, true, true)
+		if err != nil {
+			if isMaintenance(err) {
+				return proxy.serveMaintenance(downstream, downstream, err, nextHostname)
+			}
+			return proxy.LogHTTPUpstreamError(err, nextHostname, downstream)
+		}
+		proxy.Close(server.Conn)
+		hostname, upstream = nextHostname, next
+		server.Conn = next
+		serverReader = bufio.NewReader(server)
+		proxy.LogAccessVia(fallback, hostname, downstream)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPKeepAliveReroute(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.keepAliveMode = keepAliveReroute
+	dialed := recordDials(proxy, dialHTTPServer(t))
+	client := getKeepAliveClient(t, proxy)
+
+	requests := []*http.Request{
+		newTestRequest(t, "GET", "a.example", nil),
+		// chunked, since the length is unknown
+		newTestRequest(t, "POST", "a.example", io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body"))),
+		newTestRequest(t, "POST", "b.example", bytes.NewReader([]byte("fixed length body"))),
+		newTestRequest(t, "GET", "b.example", nil),
+	}
+	expected := []string{
+		"GET a.example ",
+		"POST a.example chunked body",
+		"POST b.example fixed length body",
+		"GET b.example ",
+	}
+	for i, request := range requests {
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected[i] {
+			t.Errorf("Expected response '%s' got '%s'", expected[i], string(body))
+		}
+	}
+
+	close(dialed)
+	var addresses []string
+	for address := range dialed {
+		addresses = append(addresses, address)
+	}
+	if strings.Join(addresses, ",") != "www.a.example:80,www.b.example:80" {
+		t.Errorf("Expected one connection to each upstream, got %v", addresses)
+	}
+	logLines := w.Content()
+	expectedLog := "b.example ACCESS: connected"
+	if !strings.Contains(string(logLines), expectedLog) {
+		t.Errorf("Expected '%s' in logs, got %s", expectedLog, string(logLines))
+	}
+}
+
+func TestHTTPKeepAliveReject(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.keepAliveMode = keepAliveReject
+	proxy.dial = dialHTTPServer(t)
+	client := getKeepAliveClient(t, proxy)
+
+	response, err := client.Do(newTestRequest(t, "GET", "a.example", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(response.Body)
+	response.Body.Close()
+
+	response, err = client.Do(newTestRequest(t, "GET", "b.example", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMisdirectedRequest {
+		t.Errorf("Expected status %d got %d", http.StatusMisdirectedRequest, response.StatusCode)
+	}
+	logLines := w.Content()
+	expected := "b.example DEBUG: Host differs from the first request on the connection"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestHTTPKeepAliveAmbiguousFraming(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.keepAliveMode = keepAliveReroute
+	proxy.dial = dialHTTPServer(t)
+
+	smuggled := "GET / HTTP/1.1\r\nHost: not-whitelisted.example\r\n\r\n"
+	request := fmt.Sprintf("POST / HTTP/1.1\r\nHost: a.example\r\nTransfer-Encoding: chunked\r\nContent-Length: %d\r\n\r\n0\r\n\r\n%s", len(smuggled)+5, smuggled)
+	response, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 400 ") {
+		t.Errorf("Expected a 400 response, got %q", response)
+	}
+	expected := "Bad request - both Transfer-Encoding and Content-Length"
+	if !strings.Contains(string(w.Content()), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, w.Content())
+	}
+}
+
+func TestHTTPKeepAliveSignedLengths(t *testing.T) {
+	tests := []struct {
+		request  string
+		expected string
+	}{
+		{"POST / HTTP/1.1\r\nHost: a.example\r\nContent-Length: +5\r\n\r\nhello", "Bad request - invalid Content-Length"},
+		{"POST / HTTP/1.1\r\nHost: a.example\r\nContent-Length: -0\r\n\r\n", "Bad request - invalid Content-Length"},
+		{"POST / HTTP/1.1\r\nHost: a.example\r\nTransfer-Encoding: chunked\r\n\r\n-0\r\n\r\n", "Bad request - malformed chunk size"},
+		{"POST / HTTP/1.1\r\nHost: a.example\r\nTransfer-Encoding: chunked\r\n\r\n+a\r\n0123456789\r\n0\r\n\r\n", "Bad request - malformed chunk size"},
+	}
+	for _, test := range tests {
+		w := &BufferWriter{}
+		proxy := getMockProxy(w)
+		proxy.keepAliveMode = keepAliveReroute
+		proxy.dial = dialHTTPServer(t)
+
+		response, err := requestHTTPRaw(test.request, proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 400 ") {
+			t.Errorf("%q: expected a 400 response, got %q", test.request, response)
+		}
+		if !strings.Contains(string(w.Content()), test.expected) {
+			t.Errorf("%q: expected '%s' in logs, got %s", test.request, test.expected, w.Content())
+		}
+	}
+}
+
+func TestParseDigits(t *testing.T) {
+	tests := []struct {
+		digits   string
+		base     int
+		expected int64
+		err      bool
+	}{
+		{"0", 10, 0, false},
+		{"1234", 10, 1234, false},
+		{"fF", 16, 255, false},
+		{"", 10, 0, true},
+		{"+5", 10, 0, true},
+		{"-0", 16, 0, true},
+		{"a", 10, 0, true},
+		{"0x1", 16, 0, true},
+		{"1_000", 10, 0, true},
+		{"9223372036854775808", 10, 0, true},
+	}
+	for _, test := range tests {
+		n, err := parseDigits(test.digits, test.base)
+		if (err != nil) != test.err || n != test.expected {
+			t.Errorf("%q: expected %d (error %t), got %d, %v", test.digits, test.expected, test.err, n, err)
+		}
+	}
+}
+
+func TestHTTPKeepAliveChunkedResponse(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.keepAliveMode = keepAliveReject
+	proxy.dial = dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		conn.Read(make([]byte, 1024))
+		fmt.Fprint(conn, "HTTP/1.1 100 Continue\r\n\r\n")
+		fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n"+
+			"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nTrailer: yes\r\n\r\n")
+		conn.Read(make([]byte, 1024))
+		fmt.Fprint(conn, "HTTP/1.1 204 No Content\r\n\r\n")
+	})
+
+	listener, err := getProxyServer(handleHTTPConnection, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: a.example\r\n\r\n")
+	expected := "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nTrailer: yes\r\n\r\n"
+	actual := make([]byte, len(expected))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, actual); err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != expected {
+		t.Errorf("Expected response %q got %q", expected, string(actual))
+	}
+
+	// a second request for a different host is refused, after the first
+	// response was passed on in full
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: b.example\r\n\r\n")
+	rest, _ := ioutil.ReadAll(conn)
+	if !strings.HasPrefix(string(rest), "HTTP/1.1 421 Misdirected Request") {
+		t.Errorf("Expected a 421 response, got %q", string(rest))
+	}
+}
+
+// dialHTTPServer starts an HTTP server that answers with the method, host
+// and body of each request and returns a dial function that connects to it
+func dialHTTPServer(t *testing.T) dialFunc {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.Host, body)
+	}))
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, server.Listener.Addr().String(), timeout)
+	}
+}
+
+// getKeepAliveClient returns an HTTP client that sends all its requests over
+// a single connection to the HTTP handler
+func getKeepAliveClient(t *testing.T, proxy *ConnectionProxy) *http.Client {
+	listener, err := getProxyServer(handleHTTPConnection, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, address string) (net.Conn, error) {
+				return net.Dial("tcp", listener.Addr().String())
+			},
+			MaxIdleConnsPerHost: 1,
+		},
+		Timeout: 5 * time.Second,
+	}
+}
+
+func newTestRequest(t *testing.T, method, host string, body io.Reader) *http.Request {
+	request, err := http.NewRequest(method, "http://proxy/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = host
+	return request
+}
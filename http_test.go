@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHostFromHeaderLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+		err      bool
+	}{
+		{"Host: example.com", "example.com", false},
+		{"host: example.com", "example.com", false},
+		{"HOST: example.com", "example.com", false},
+		{"Host:example.com", "example.com", false},
+		{"Host: \t example.com \t", "example.com", false},
+		{"Host: example.com:8080", "example.com", false},
+		{"Host: example.com:", "example.com", false},
+		{"Host: [::1]:80", "::1", false},
+		{"Content-Length: 0", "", false},
+		{"X-Host: example.com", "", false},
+		{"Host : example.com", "", true},
+		{"Host: example.com:http", "", true},
+		{"Host: example.com:65536", "", true},
+		{"Host: example.com:0", "", true},
+		{"Host: example.com:+80", "", true},
+		{"Host: [::1", "", true},
+		{"Host: [::1]80", "", true},
+		{"Host:", "", true},
+		{"Host: :80", "", true},
+		{"no colon", "", true},
+	}
+	for _, test := range tests {
+		actual, err := hostFromHeaderLine(test.line)
+		if test.err && err == nil {
+			t.Errorf("Expected an error for '%s', got '%s'", test.line, actual)
+		}
+		if !test.err && err != nil {
+			t.Errorf("Expected no error for '%s', got %s", test.line, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", test.expected, test.line, actual)
+		}
+	}
+}
+
+func TestHostFromRequestLine(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+		err      bool
+	}{
+		{"GET / HTTP/1.1", "", false},
+		{"GET http://example.com/path?q=1 HTTP/1.1", "example.com", false},
+		{"GET HTTP://Example.com:8080/ HTTP/1.1", "Example.com", false},
+		{"GET ftp://example.com/ HTTP/1.1", "", false},
+		{"OPTIONS * HTTP/1.1", "", false},
+		{"GET http://example.com:99999/ HTTP/1.1", "", true},
+	}
+	for _, test := range tests {
+		actual, err := hostFromRequestLine(test.line)
+		if test.err && err == nil {
+			t.Errorf("Expected an error for '%s', got '%s'", test.line, actual)
+		}
+		if !test.err && err != nil {
+			t.Errorf("Expected no error for '%s', got %s", test.line, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", test.expected, test.line, actual)
+		}
+	}
+}
+
+func TestHTTPHostHeaderCaseInsensitive(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	actual, err := requestHTTPRaw("GET / HTTP/1.0\r\nhost:example.com:80\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(actual), "host:example.com:80") {
+		t.Errorf("Expected the request to be echoed, got '%s'", string(actual))
+	}
+	if address := <-dialed; address != "www.example.com:80" {
+		t.Errorf("Expected to connect to www.example.com:80, got %s", address)
+	}
+}
+
+func TestHTTPAbsoluteFormRequestTarget(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	_, err := requestHTTPRaw("GET http://example.com/ HTTP/1.1\r\nHost: example.net\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if address := <-dialed; address != "www.example.com:80" {
+		t.Errorf("Expected to connect to www.example.com:80, got %s", address)
+	}
+}
+
+func TestHTTPNoHostBadRequest(t *testing.T) {
+	requests := []string{
+		"GET / HTTP/1.0\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost:\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost : example.com\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com:http\r\n\r\n",
+		"GET / HTTP/1.1\r\nHost: example.com\r\nHost: example.net\r\n\r\n",
+	}
+	for _, request := range requests {
+		w := &BufferWriter{}
+		proxy := getMockProxy(w)
+		actual, err := requestHTTPRaw(request, proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "HTTP/1.1 400 Bad Request"
+		if !strings.HasPrefix(string(actual), expected) {
+			t.Errorf("Expected response to %q to start with '%s' got:\n%s", request, expected, string(actual))
+		}
+		logLines := w.Content()
+		expected = "DEBUG: Bad request"
+		if !strings.Contains(string(logLines), expected) {
+			t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+		}
+	}
+}
+
+func TestHTTPPreservesRequestBytes(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.maxHeaderSize = 16384
+	proxy.dial = dialEchoServer(t)
+
+	// longer than the line buffer, with mixed line endings and a body
+	request := "POST /upload HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"Cookie: " + strings.Repeat("c", 6000) + "\r\n" +
+		"X-Bare-LF: yes\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n" +
+		"hello"
+	actual, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != request {
+		t.Errorf("Expected the request to arrive unchanged, got:\n%q", string(actual))
+	}
+}
+
+func TestHTTPLeadingEmptyLines(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.dial = dialEchoServer(t)
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	actual, err := requestHTTPRaw("\r\n\n"+request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actual) != request {
+		t.Errorf("Expected the empty lines to be skipped, got:\n%q", string(actual))
+	}
+
+	// e.g. after a request body on a keep-alive connection
+	proxy.keepAliveMode = keepAliveReroute
+	proxy.dial = dialHTTPServer(t)
+	actual, err = requestHTTPRaw("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi\r\n"+
+		"GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses := strings.Count(string(actual), "HTTP/1.1 200 OK"); responses != 2 {
+		t.Errorf("Expected both requests to be answered, got:\n%q", string(actual))
+	}
+}
+
+func TestHTTPHeaderTooLarge(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.maxHeaderSize = 1024
+	proxy.dial = dialEchoServer(t)
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\nCookie: " + strings.Repeat("c", 1024) + "\r\n\r\n"
+	actual, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "HTTP/1.1 431 Request Header Fields Too Large"
+	if !strings.HasPrefix(string(actual), expected) {
+		t.Errorf("Expected response to start with '%s' got:\n%s", expected, string(actual))
+	}
+	logLines := w.Content()
+	expected = "DEBUG: Request header too large"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+// requestHTTPRaw sends request to the HTTP handler and returns everything
+// that is sent back
+func requestHTTPRaw(request string, proxy *ConnectionProxy) ([]byte, error) {
+	listener, err := getProxyServer(handleHTTPConnection, proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, request)
+	conn.(*net.TCPConn).CloseWrite()
+	return ioutil.ReadAll(conn)
+}
+
+// dialHTTPEchoServer starts a TCP server that answers a request with the
+// request it received, byte for byte, as the body
+func dialHTTPEchoServer(t *testing.T) dialFunc {
+	return dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		echoHTTPRequest(conn, bufio.NewReader(conn))
+	})
+}
+
+// echoHTTPRequest reads a request from reader and answers it on conn with
+// the request as the body
+func echoHTTPRequest(conn net.Conn, reader *bufio.Reader) {
+	var request []byte
+	length := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		request = append(request, line...)
+		content := bytes.TrimRight(line, "\r\n")
+		if len(content) == 0 {
+			break
+		}
+		if name, value, err := parseHeaderLine(string(content)); err == nil && strings.EqualFold(name, "Content-Length") {
+			length, _ = strconv.Atoi(value)
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return
+	}
+	request = append(request, body...)
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(request), request)
+}
+
+// responseBody returns what follows the head of a raw HTTP response
+func responseBody(response []byte) string {
+	if i := bytes.Index(response, []byte("\r\n\r\n")); i >= 0 {
+		return string(response[i+4:])
+	}
+	return ""
+}
+
+// recordDials makes proxy connect using dial and returns the addresses it
+// was asked to connect to
+func recordDials(proxy *ConnectionProxy, dial dialFunc) chan string {
+	dialed := make(chan string, 10)
+	proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed <- address
+		return dial(network, address, timeout)
+	}
+	return dialed
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// BenchmarkIdleConnections opens IDLE_CONNECTIONS (default 50000) proxied
+// HTTP and HTTPS connections that sit idle in the copy phase and reports the
+// memory used per connection. Each connection needs four file descriptors,
+// so the number is capped by the open files limit. Run it with:
+//
+//	go test -run none -bench IdleConnections -benchtime 1x
+func BenchmarkIdleConnections(b *testing.B) {
+	b.Run("HTTP", func(b *testing.B) {
+		benchmarkIdleConnections(b, handleHTTPConnection, []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	})
+	b.Run("HTTPS", func(b *testing.B) {
+		hello := testClientHello("example.com")
+		record := append([]byte{0x16, 3, 1, byte(len(hello) >> 8), byte(len(hello))}, hello...)
+		benchmarkIdleConnections(b, handleHTTPSConnection, record)
+	})
+}
+
+// benchmarkIdleConnections has handle proxy connections that send request
+// and then wait
+func benchmarkIdleConnections(b *testing.B, handle tcpHandler, request []byte) {
+	count := idleConnectionCount(b)
+
+	// the client, downstream and upstream side of each connection all live
+	// in this process, so connections are spread over several loopback
+	// addresses to not run out of ephemeral ports
+	var upstreams int64
+	upstreamConns := make(chan net.Conn, count)
+	upstreamListener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer upstreamListener.Close()
+	go acceptAll(upstreamListener, func(conn net.Conn) {
+		upstreamConns <- conn
+		atomic.AddInt64(&upstreams, 1)
+	})
+	_, upstreamPort, _ := net.SplitHostPort(upstreamListener.Addr().String())
+
+	proxy := getMockProxy(ioutil.Discard)
+	var dials int64
+	proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, loopbackAddress(atomic.AddInt64(&dials, 1), upstreamPort), timeout)
+	}
+	proxyListener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer proxyListener.Close()
+	go acceptAll(proxyListener, func(conn net.Conn) {
+		go handle(conn, proxy)
+	})
+	_, proxyPort, _ := net.SplitHostPort(proxyListener.Addr().String())
+
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		atomic.StoreInt64(&upstreams, 0)
+		runtime.GC()
+		rssBefore := readRSS(b)
+		var before runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		clients := openIdleConnections(b, count, proxyPort, request)
+		// wait until the proxy has connected all of them upstream, or
+		// has given up on some of them
+		for waited := 0; atomic.LoadInt64(&upstreams) < int64(len(clients)) && waited < 500; waited++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		established := atomic.LoadInt64(&upstreams)
+
+		// twice, so garbage from setting the connections up is freed
+		runtime.GC()
+		runtime.GC()
+		var after runtime.MemStats
+		runtime.ReadMemStats(&after)
+		rssAfter := readRSS(b)
+
+		b.ReportMetric(float64(rssAfter-rssBefore)/float64(established), "rss-bytes/conn")
+		b.ReportMetric(float64(after.HeapInuse+after.StackInuse-before.HeapInuse-before.StackInuse)/float64(established), "inuse-bytes/conn")
+		b.ReportMetric(float64(after.StackInuse-before.StackInuse)/float64(established), "stack-bytes/conn")
+		b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(established), "allocs/conn")
+
+		for _, conn := range clients {
+			conn.Close()
+		}
+		for i := int64(0); i < established; i++ {
+			(<-upstreamConns).Close()
+		}
+	}
+}
+
+// openIdleConnections connects count clients to the proxy and sends request
+// on each, stopping early if the process runs out of file descriptors
+func openIdleConnections(b *testing.B, count int, port string, request []byte) []net.Conn {
+	clients := make([]net.Conn, 0, count)
+	for i := 0; i < count; i++ {
+		conn, err := net.DialTimeout("tcp", loopbackAddress(int64(i), port), time.Second)
+		if err != nil && i > 0 {
+			// the effective open files limit can be lower than what
+			// getrlimit reports, e.g. in containers
+			b.Logf("Stopped after %d connections: %s", i, err)
+			break
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Write(request)
+		clients = append(clients, conn)
+	}
+	return clients
+}
+
+// acceptAll calls handle for every connection on listener until it's closed
+func acceptAll(listener net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil && strings.Contains(err.Error(), "use of closed network connection") {
+			return
+		}
+		if err != nil {
+			// most likely out of file descriptors
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		handle(conn)
+	}
+}
+
+// idleConnectionCount returns how many connections BenchmarkIdleConnections
+// should open
+func idleConnectionCount(b *testing.B) int {
+	count := 50000
+	if os.Getenv("IDLE_CONNECTIONS") != "" {
+		var err error
+		if count, err = strconv.Atoi(os.Getenv("IDLE_CONNECTIONS")); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		b.Fatal(err)
+	}
+	limit.Cur = limit.Max
+	syscall.Setrlimit(syscall.RLIMIT_NOFILE, &limit)
+	// leave some room for the listeners and the test binary itself
+	if max := int(limit.Cur-100) / 4; count > max {
+		b.Logf("Open files limit is %d, only using %d connections", limit.Cur, max)
+		count = max
+	}
+	return count
+}
+
+// loopbackAddress spreads connections over 127.0.0.1 - 127.0.0.16
+func loopbackAddress(i int64, port string) string {
+	return net.JoinHostPort(fmt.Sprintf("127.0.0.%d", i%16+1), port)
+}
+
+// readRSS returns the resident set size of the test process in bytes
+func readRSS(b *testing.B) int64 {
+	status, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		b.Skip("RSS is only available on Linux")
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		kb, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return kb * 1024
+	}
+	b.Fatal("No VmRSS in /proc/self/status")
+	return 0
+}
@@ -24,8 +24,12 @@ type LogData struct {
 
 func (data *LogData) String() string {
 	remoteIP := "-"
+	id := ""
 	if data.conn != nil {
 		remoteIP = data.conn.RemoteAddr().String()
+		if connectionID(data.conn) != "" {
+			id = fmt.Sprintf(" id=%s", connectionID(data.conn))
+		}
 	}
 	hostname := "-"
 	message := "-"
@@ -41,11 +45,12 @@ func (data *LogData) String() string {
 	}
 
 	return fmt.Sprintf(
-		"%s %s %s %s %s",
+		"%s %s %s %s %s%s",
 		time.Now().Format(time.RFC3339),
 		remoteIP,
 		hostname,
 		messageType,
 		message,
+		id,
 	)
 }
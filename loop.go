@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// A proxy loop happens when www.<domain> points back at the proxy, which
+// then keeps connecting to itself. Upstreams resolving to the proxy's own
+// addresses are refused, and for loops through other proxies, e.g. chained
+// instances or a load balancer in front, each instance can mark requests
+// with its LOOP_MARKER. HTTP requests are marked with a Via header, and
+// PROXY protocol v2 headers sent upstream with a pp2TypeLoopMarkers TLV
+// listing the markers so far. A request that already carries the
+// instance's own marker has been here before.
+
+// upstreamLoopError is returned when an upstream resolves to one of the
+// proxy's own addresses
+type upstreamLoopError struct {
+	host    string
+	address string
+}
+
+func (e *upstreamLoopError) Error() string {
+	return fmt.Sprintf("%s resolves to the proxy itself (%s)", e.host, e.address)
+}
+
+// isLoop returns true if err is from an upstream that is the proxy itself
+func isLoop(err error) bool {
+	_, ok := err.(*upstreamLoopError)
+	return ok
+}
+
+// localAddresses are the addresses the proxy listens on
+type localAddresses struct {
+	ips   []net.IP
+	ports map[string]bool
+}
+
+// newLocalAddresses returns the addresses of all interfaces with the given
+// listening ports
+func newLocalAddresses(ports ...string) (*localAddresses, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	local := &localAddresses{ports: make(map[string]bool)}
+	for _, addr := range addrs {
+		if network, ok := addr.(*net.IPNet); ok {
+			local.ips = append(local.ips, network.IP)
+		}
+	}
+	for _, port := range ports {
+		local.ports[port] = true
+	}
+	return local, nil
+}
+
+// contains returns true if connecting to ip and port reaches the proxy
+func (l *localAddresses) contains(ip net.IP, port string) bool {
+	if l == nil || !l.ports[port] {
+		return false
+	}
+	// all of 127.0.0.0/8 is local, and connecting to 0.0.0.0 or :: ends
+	// up on the local host as well
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, local := range l.ips {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopMarkers returns the markers the connection arrived with, followed by
+// this instance's
+func (p *ConnectionProxy) loopMarkers(downstream net.Conn) []string {
+	if p.loopMarker == "" {
+		return nil
+	}
+	var markers []string
+	if conn, ok := downstream.(*clientConn); ok {
+		markers = append(markers, conn.loopMarkers...)
+	}
+	return append(markers, p.loopMarker)
+}
+
+// loopDetected returns true if the connection, or the request in head if
+// it isn't nil, already went through this instance
+func (p *ConnectionProxy) loopDetected(downstream net.Conn, head []byte) bool {
+	if p.loopMarker == "" {
+		return false
+	}
+	if conn, ok := downstream.(*clientConn); ok {
+		for _, marker := range conn.loopMarkers {
+			if marker == p.loopMarker {
+				return true
+			}
+		}
+	}
+	if head == nil {
+		return false
+	}
+	// Via entries are "<protocol> <received-by> [comment]"
+	request := &messageHead{lines: headLines(head)}
+	for _, via := range request.headerValues("Via") {
+		if fields := strings.Fields(via); len(fields) >= 2 && fields[1] == p.loopMarker {
+			return true
+		}
+	}
+	return false
+}
+
+// addLoopMarker adds a Via header with this instance's marker to the
+// request in head
+func (p *ConnectionProxy) addLoopMarker(head []byte) []byte {
+	if p.loopMarker == "" {
+		return head
+	}
+	// before the empty line that ends the head
+	end := len(head) - 1
+	if bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		end = len(head) - 2
+	} else if !bytes.HasSuffix(head, []byte("\n\n")) {
+		return head
+	}
+	result := make([]byte, 0, len(head)+len(p.loopMarker)+16)
+	result = append(result, head[:end]...)
+	result = append(result, "Via: 1.1 "+p.loopMarker+"\r\n"...)
+	return append(result, head[end:]...)
+}
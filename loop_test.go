@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPUpstreamLoop(t *testing.T) {
+	tests := []struct {
+		hostname string
+		address  string
+		dialed   string
+	}{
+		{"self.com", "203.0.113.1", ""},
+		{"loopback.com", "127.0.0.2", ""},
+		{"unspecified.com", "0.0.0.0", ""},
+		{"public.com", "93.184.216.34", "93.184.216.34:80"},
+	}
+	for _, test := range tests {
+		w := &BufferWriter{}
+		proxy := getMockProxy(w)
+		proxy.localAddrs = &localAddresses{ips: []net.IP{net.ParseIP("203.0.113.1")}, ports: map[string]bool{"80": true}}
+		address := test.address
+		proxy.lookup = func(host string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP(address)}, nil
+		}
+		dialed := recordDials(proxy, dialEchoServer(t))
+
+		response, err := requestHTTPRaw(fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", test.hostname), proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.dialed != "" {
+			if address := <-dialed; address != test.dialed {
+				t.Errorf("%s: expected %s to be dialed, got %s", test.hostname, test.dialed, address)
+			}
+			continue
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 508 ") {
+			t.Errorf("%s: expected a 508 response, got %q", test.hostname, response)
+		}
+		expected := fmt.Sprintf("ERROR: Proxy loop detected: www.%s resolves to the proxy itself (%s:80)", test.hostname, test.address)
+		if !strings.Contains(string(w.Content()), expected) {
+			t.Errorf("%s: expected %q in logs, got %s", test.hostname, expected, w.Content())
+		}
+	}
+}
+
+func TestLocalAddressesOtherPort(t *testing.T) {
+	local := &localAddresses{ips: []net.IP{net.ParseIP("203.0.113.1")}, ports: map[string]bool{"80": true, "443": true}}
+	if local.contains(net.ParseIP("203.0.113.1"), "8080") || local.contains(net.ParseIP("127.0.0.1"), "8080") {
+		t.Error("Expected other ports on the proxy's addresses to be allowed")
+	}
+	if !local.contains(net.ParseIP("::ffff:203.0.113.1"), "443") || !local.contains(net.ParseIP("::1"), "443") {
+		t.Error("Expected the proxy's addresses to be found")
+	}
+}
+
+func TestHTTPLoopMarker(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.loopMarker = "edge-1"
+	proxy.dial = dialEchoServer(t)
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.1 cdn\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.1 cdn\r\nVia: 1.1 edge-1\r\n\r\n"
+	if string(response) != expected {
+		t.Errorf("Expected the request to be marked, got %q", response)
+	}
+
+	// the upstream sent it back to the proxy
+	response, err = requestHTTPRaw(string(response), proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 508 ") {
+		t.Errorf("Expected a 508 response, got %q", response)
+	}
+	if !strings.Contains(string(w.Content()), "ERROR: Proxy loop detected: the request already went through this proxy") {
+		t.Errorf("Expected the loop in the logs, got %s", w.Content())
+	}
+}
+
+func TestHTTPKeepAliveLoopMarker(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.keepAliveMode = keepAliveReroute
+	proxy.loopMarker = "edge-1"
+	proxy.dial = dialHTTPServer(t)
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+		"GET / HTTP/1.1\r\nHost: example.com\r\nVia: 1.0 edge-1 (sensible-proxy)\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 200 ") || !strings.Contains(string(response), "HTTP/1.1 508 ") {
+		t.Errorf("Expected the second request to be refused, got %q", response)
+	}
+}
+
+func TestProxyProtocolLoopMarkers(t *testing.T) {
+	client := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324},
+	}
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.proxyProtocolSources, _ = parseCIDRs("127.0.0.1")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, ProxyProtocol: proxyProtocolV2}}}
+	proxy.loopMarker = "edge-2"
+	headers := make(chan testProxyHeader, 1)
+	proxy.dial = dialProxyProtocolServer(t, headers)
+
+	header := proxyHeader(proxyProtocolV2, client, "example.com", "1", "edge-0", "edge-1")
+	if _, err := requestHTTPRaw(string(header)+"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if markers := string((<-headers).tlvs[pp2TypeLoopMarkers]); markers != "edge-0,edge-1,edge-2" {
+		t.Errorf("Expected the markers to be passed on, got %q", markers)
+	}
+}
+
+func TestHTTPSLoopMarker(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.proxyProtocolSources, _ = parseCIDRs("127.0.0.1")
+	proxy.loopMarker = "edge-1"
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	listener, err := getProxyServer(handleHTTPSConnection, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &addrConn{local: conn.RemoteAddr(), remote: conn.LocalAddr()}
+	conn.Write(proxyHeader(proxyProtocolV2, client, "", "", "edge-1", "edge-2"))
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tls.Client(conn, &tls.Config{ServerName: "example.com"}).Handshake(); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected nothing to be dialed, got %s", <-dialed)
+	}
+	if !strings.Contains(string(w.Content()), "example.com ERROR: Proxy loop detected: the connection already went through this proxy") {
+		t.Errorf("Expected the loop in the logs, got %s", w.Content())
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// publishPoolMetrics adds the health and open connections of the backends
+// of each pool to the metrics
+func publishPoolMetrics(config *Config) {
+	expvar.Publish("upstream_pools", expvar.Func(func() interface{} {
+		return config.poolStatus()
+	}))
+}
+
+// publishBreakerMetrics adds the circuit breakers of upstreams that have
+// failed recently to the metrics
+func publishBreakerMetrics(breakers *circuitBreakers) {
+	expvar.Publish("circuit_breakers", expvar.Func(func() interface{} {
+		return breakers.status()
+	}))
+}
+
+// serveMetrics serves the expvar counters as JSON on addr, at /debug/vars
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		log.Fatalln("Metrics listener failed", http.ListenAndServe(addr, mux))
+	}()
+}
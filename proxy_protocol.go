@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol versions, see
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// proxyProtocolV2Signature starts every version 2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 type-length-value fields
+const (
+	pp2TypeAuthority = 0x02
+	pp2TypeUniqueID  = 0x05
+	// pp2TypeLoopMarkers is in the range for custom types, see loop.go
+	pp2TypeLoopMarkers = 0xe0
+)
+
+// proxyHeader returns the PROXY protocol header describing the client's
+// connection in the given version. Version 2 headers include the hostname,
+// the connection's ID and the loop markers as well.
+func proxyHeader(version string, downstream net.Conn, hostname, id string, loopMarkers ...string) []byte {
+	src, srcOK := downstream.RemoteAddr().(*net.TCPAddr)
+	dst, dstOK := downstream.LocalAddr().(*net.TCPAddr)
+	known := srcOK && dstOK && src.IP.To16() != nil && dst.IP.To16() != nil
+	// with one IPv4 address and one IPv6 address, both are sent as IPv6
+	ipv4 := known && src.IP.To4() != nil && dst.IP.To4() != nil
+
+	if version == proxyProtocolV1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(src.IP), ipv6String(dst.IP), src.Port, dst.Port))
+		}
+	}
+
+	var addresses bytes.Buffer
+	family := byte(0x00) // AF_UNSPEC
+	switch {
+	case ipv4:
+		family = 0x11 // TCP over IPv4
+		addresses.Write(src.IP.To4())
+		addresses.Write(dst.IP.To4())
+	case known:
+		family = 0x21 // TCP over IPv6
+		addresses.Write(src.IP.To16())
+		addresses.Write(dst.IP.To16())
+	}
+	if known {
+		binary.Write(&addresses, binary.BigEndian, uint16(src.Port))
+		binary.Write(&addresses, binary.BigEndian, uint16(dst.Port))
+	}
+	writeTLV(&addresses, pp2TypeAuthority, []byte(hostname))
+	writeTLV(&addresses, pp2TypeUniqueID, []byte(id))
+	writeTLV(&addresses, pp2TypeLoopMarkers, []byte(strings.Join(loopMarkers, ",")))
+
+	header := bytes.NewBuffer(nil)
+	header.Write(proxyProtocolV2Signature)
+	// version 2, PROXY command
+	header.WriteByte(0x21)
+	header.WriteByte(family)
+	binary.Write(header, binary.BigEndian, uint16(addresses.Len()))
+	header.Write(addresses.Bytes())
+	return header.Bytes()
+}
+
+// ipv6String formats ip as an IPv6 address. IPv4 addresses are written as
+// IPv4-mapped ones, which net.IP.String writes in the IPv4 format.
+func ipv6String(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+// writeTLV adds a PROXY protocol v2 type-length-value field to buf, empty
+// values are left out
+func writeTLV(buf *bytes.Buffer, tlvType byte, value []byte) {
+	if len(value) == 0 {
+		return
+	}
+	buf.WriteByte(tlvType)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
+
+// sendProxyHeader writes the PROXY protocol header to upstream, if the rule
+// for hostname asks for one
+func (p *ConnectionProxy) sendProxyHeader(upstream, downstream net.Conn, hostname string) error {
+	rule := p.config.ruleFor(hostname)
+	if rule.ProxyProtocol == "" {
+		return nil
+	}
+	_, err := upstream.Write(proxyHeader(rule.ProxyProtocol, downstream, hostname, connectionID(downstream), p.loopMarkers(downstream)...))
+	return err
+}
+
+// proxyProtocolV1MaxLen is the longest version 1 header allowed by the spec
+const proxyProtocolV1MaxLen = 107
+
+// acceptProxyHeader reads the PROXY protocol header that connections from
+// the trusted proxyProtocolSources must start with, and sets the client's
+// addresses on conn from it. Connections from anywhere else, and headers
+// that don't carry any addresses, leave conn as it is.
+func (p *ConnectionProxy) acceptProxyHeader(conn *clientConn) error {
+	if len(p.proxyProtocolSources) == 0 || !containsIP(p.proxyProtocolSources, addrIP(conn.RemoteAddr())) {
+		return nil
+	}
+	source, destination, tlvs, err := readProxyHeader(conn)
+	if err != nil {
+		return err
+	}
+	// source is nil for e.g. the load balancer's health checks
+	conn.source, conn.destination = source, destination
+	if markers := findTLV(tlvs, pp2TypeLoopMarkers); len(markers) > 0 {
+		conn.loopMarkers = strings.Split(string(markers), ",")
+	}
+	return nil
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from r and returns
+// the client's address and the address it connected to, which are nil for
+// UNKNOWN and LOCAL headers, and the TLVs of v2 headers. Nothing past the
+// header is read, so the connection can be handed on as is. Version 1
+// headers have no length field and are read byte by byte for that reason.
+func readProxyHeader(r io.Reader) (net.Addr, net.Addr, []byte, error) {
+	// the shortest headers are "PROXY UNKNOWN\r\n" and the 16 bytes that
+	// start every v2 header
+	start := make([]byte, 15, proxyProtocolV1MaxLen)
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, nil, nil, err
+	}
+	if bytes.HasPrefix(proxyProtocolV2Signature, start[:12]) {
+		return readProxyHeaderV2(r, start)
+	}
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, nil, nil, errors.New("missing PROXY protocol header")
+	}
+	source, destination, err := readProxyHeaderV1(r, start)
+	return source, destination, nil, err
+}
+
+// readProxyHeaderV1 reads the rest of a version 1 header, after the first
+// bytes in start
+func readProxyHeaderV1(r io.Reader, start []byte) (net.Addr, net.Addr, error) {
+	line := start
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLen {
+			return nil, nil, errors.New("PROXY protocol header too long")
+		}
+		next := line[len(line) : len(line)+1]
+		if _, err := io.ReadFull(r, next); err != nil {
+			return nil, nil, err
+		}
+		line = line[:len(line)+1]
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	source, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+// readProxyHeaderV2 reads the rest of a version 2 header, after the first
+// bytes in start
+func readProxyHeaderV2(r io.Reader, start []byte) (net.Addr, net.Addr, []byte, error) {
+	fixed := append(start, 0)
+	if _, err := io.ReadFull(r, fixed[len(start):]); err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.Equal(fixed[:12], proxyProtocolV2Signature) || fixed[12]>>4 != 2 {
+		return nil, nil, nil, errors.New("invalid PROXY protocol v2 signature")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, nil, err
+	}
+	// the LOCAL command is used for connections by the proxy itself
+	if fixed[12]&0x0f == 0x00 {
+		return nil, nil, nil, nil
+	}
+	if fixed[12]&0x0f != 0x01 {
+		return nil, nil, nil, fmt.Errorf("unknown PROXY protocol v2 command 0x%02x", fixed[12])
+	}
+
+	var addrLen int
+	switch fixed[13] {
+	case 0x00:
+		// no addresses, but there can be TLVs
+		return nil, nil, body, nil
+	case 0x11:
+		addrLen = net.IPv4len
+	case 0x21:
+		addrLen = net.IPv6len
+	default:
+		// UDP or unix sockets, the TLVs are of no interest
+		return nil, nil, nil, nil
+	}
+	if len(body) < 2*addrLen+4 {
+		return nil, nil, nil, errors.New("PROXY protocol v2 addresses truncated")
+	}
+	ports := body[2*addrLen:]
+	source := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:addrLen]...)),
+		Port: int(binary.BigEndian.Uint16(ports)),
+	}
+	destination := &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[addrLen:2*addrLen]...)),
+		Port: int(binary.BigEndian.Uint16(ports[2:])),
+	}
+	return source, destination, body[2*addrLen+4:], nil
+}
+
+// findTLV returns the value of the first PROXY protocol v2 TLV of tlvType,
+// or nil
+func findTLV(tlvs []byte, tlvType byte) []byte {
+	for len(tlvs) >= 3 {
+		length := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return nil
+		}
+		if tlvs[0] == tlvType {
+			return tlvs[3 : 3+length]
+		}
+		tlvs = tlvs[3+length:]
+	}
+	return nil
+}
+
+// parseProxyAddr parses an address and port from a version 1 header
+func parseProxyAddr(host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil || n < 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid PROXY protocol address %s %s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: n}, nil
+}
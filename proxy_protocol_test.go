@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProxyProtocolV1(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, ProxyProtocol: proxyProtocolV1}}}
+	headers := make(chan testProxyHeader, 1)
+	proxy.dial = dialProxyProtocolServer(t, headers)
+
+	request := "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	response, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := <-headers
+	if header.version != proxyProtocolV1 {
+		t.Fatalf("Expected a v1 header, got %q", header.version)
+	}
+	if !strings.HasPrefix(header.raw, "PROXY TCP4 127.0.0.1 127.0.0.1 ") {
+		t.Errorf("Unexpected header %q", header.raw)
+	}
+	// the request follows the header untouched
+	if string(response) != request {
+		t.Errorf("Expected upstream to receive %q after the header, got %q", request, response)
+	}
+}
+
+func TestHTTPSProxyProtocolV2(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*.com"}, ProxyProtocol: proxyProtocolV2}}}
+	headers := make(chan testProxyHeader, 1)
+	proxy.dial = dialProxyProtocolServer(t, headers)
+
+	go requestHTTPS("example.com", "example.com", proxy)
+	var header testProxyHeader
+	select {
+	case header = <-headers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upstream never got a PROXY header")
+	}
+	if header.version != proxyProtocolV2 {
+		t.Fatalf("Expected a v2 header, got %q", header.version)
+	}
+	if header.family != 0x11 {
+		t.Errorf("Expected TCP over IPv4, got family 0x%02x", header.family)
+	}
+	if !strings.HasPrefix(header.source, "127.0.0.1:") || !strings.HasPrefix(header.destination, "127.0.0.1:") {
+		t.Errorf("Unexpected addresses %s -> %s", header.source, header.destination)
+	}
+	if got := string(header.tlvs[pp2TypeAuthority]); got != "example.com" {
+		t.Errorf("Expected the SNI hostname in PP2_TYPE_AUTHORITY, got %q", got)
+	}
+	if len(header.tlvs[pp2TypeUniqueID]) == 0 {
+		t.Error("Expected a connection ID in PP2_TYPE_UNIQUE_ID")
+	}
+	// the ClientHello record follows the header
+	if len(header.rest) == 0 || header.rest[0] != 0x16 {
+		t.Errorf("Expected a TLS handshake record after the header, got % x", header.rest)
+	}
+}
+
+func TestHTTPProxyProtocolOtherHost(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.org")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, ProxyProtocol: proxyProtocolV1}}}
+	proxy.dial = dialEchoServer(t)
+
+	request := "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"
+	response, err := requestHTTPRaw(request, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != request {
+		t.Errorf("Expected no PROXY header for hosts without a rule, got %q", response)
+	}
+}
+
+func TestProxyHeaderIPv6(t *testing.T) {
+	conn := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 56324},
+	}
+	v1 := proxyHeader(proxyProtocolV1, conn, "example.com", "1")
+	if expected := "PROXY TCP6 2001:db8::2 2001:db8::1 56324 443\r\n"; string(v1) != expected {
+		t.Errorf("Expected %q, got %q", expected, v1)
+	}
+
+	header, err := parseTestProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(proxyProtocolV2, conn, "example.com", "1"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.family != 0x21 || header.source != "[2001:db8::2]:56324" || header.destination != "[2001:db8::1]:443" {
+		t.Errorf("Unexpected v2 header %+v", header)
+	}
+
+	// an IPv4 client on a listener bound to an IPv6 address
+	mixed := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324},
+	}
+	v1 = proxyHeader(proxyProtocolV1, mixed, "example.com", "1")
+	if expected := "PROXY TCP6 ::ffff:203.0.113.7 2001:db8::1 56324 443\r\n"; string(v1) != expected {
+		t.Errorf("Expected %q, got %q", expected, v1)
+	}
+	header, err = parseTestProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(proxyProtocolV2, mixed, "example.com", "1"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.family != 0x21 || header.source != "203.0.113.7:56324" || header.destination != "[2001:db8::1]:443" {
+		t.Errorf("Unexpected v2 header %+v", header)
+	}
+
+	unknown := &addrConn{local: &net.UnixAddr{Name: "/tmp/sock"}, remote: &net.UnixAddr{Name: "@"}}
+	if v1 := proxyHeader(proxyProtocolV1, unknown, "example.com", "1"); string(v1) != "PROXY UNKNOWN\r\n" {
+		t.Errorf("Expected an UNKNOWN header, got %q", v1)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	conn := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443},
+		remote: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 56324},
+	}
+	conn6 := &addrConn{
+		local:  &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80},
+		remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 56324},
+	}
+	local := append(append([]byte(nil), proxyProtocolV2Signature...), 0x20, 0x00, 0x00, 0x00)
+
+	tests := []struct {
+		name        string
+		header      []byte
+		source      string
+		destination string
+		err         string
+	}{
+		{"v1", proxyHeader(proxyProtocolV1, conn, "example.com", "1"), "203.0.113.7:56324", "192.0.2.1:443", ""},
+		{"v1 IPv6", proxyHeader(proxyProtocolV1, conn6, "example.com", "1"), "[2001:db8::2]:56324", "[2001:db8::1]:80", ""},
+		{"v2", proxyHeader(proxyProtocolV2, conn, "example.com", "1"), "203.0.113.7:56324", "192.0.2.1:443", ""},
+		{"v2 IPv6", proxyHeader(proxyProtocolV2, conn6, "example.com", "1"), "[2001:db8::2]:56324", "[2001:db8::1]:80", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", ""},
+		{"v2 local", local, "", "", ""},
+		{"none", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n"), "", "", "missing PROXY protocol header"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"), "", "", "too long"},
+		{"v1 bad address", []byte("PROXY TCP4 1.2.3 4.5.6.7 1 2\r\n"), "", "", "invalid PROXY protocol address"},
+		{"v1 truncated", []byte("PROXY TCP4 1.2.3.4 4.5.6.7"), "", "", "EOF"},
+	}
+	for _, test := range tests {
+		// whatever follows the header must be left unread
+		reader := bytes.NewReader(append(test.header, "rest"...))
+		source, destination, _, err := readProxyHeader(reader)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if addrString(source) != test.source {
+			t.Errorf("%s: expected source %s, got %s", test.name, test.source, source)
+		}
+		if addrString(destination) != test.destination {
+			t.Errorf("%s: expected destination %s, got %s", test.name, test.destination, destination)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "rest" {
+			t.Errorf("%s: expected the data after the header to be left, got %q", test.name, rest)
+		}
+	}
+}
+
+func TestHTTPAcceptProxyProtocol(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w, "example.com")
+	proxy.proxyProtocolSources, _ = parseCIDRs("127.0.0.1")
+	proxy.forwardedHeaders = true
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, ProxyProtocol: proxyProtocolV2}}}
+	headers := make(chan testProxyHeader, 1)
+	// the forwarded headers make the proxy expect an HTTP response
+	proxy.dial = dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header, err := parseTestProxyHeader(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		headers <- header
+		echoHTTPRequest(conn, reader)
+	})
+
+	response, err := requestHTTPRaw("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the client's address is logged and passed on to the upstream
+	header := <-headers
+	if header.source != "203.0.113.7:56324" || header.destination != "192.0.2.1:80" {
+		t.Errorf("Expected the addresses from the inbound header, got %s -> %s", header.source, header.destination)
+	}
+	if !strings.Contains(string(response), "X-Forwarded-For: 203.0.113.7\r\n") {
+		t.Errorf("Expected X-Forwarded-For with the client's address, got %q", response)
+	}
+	if !strings.Contains(string(w.Content()), "203.0.113.7:56324") {
+		t.Errorf("Expected the client's address in the log, got %q", w.Content())
+	}
+}
+
+func TestHTTPSAcceptProxyProtocolRequired(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.proxyProtocolSources, _ = parseCIDRs("127.0.0.0/8")
+	proxy.dial = dialEchoServer(t)
+
+	requestHTTPS("example.com", "example.com", proxy)
+	if !strings.Contains(string(w.Content()), "missing PROXY protocol header") {
+		t.Errorf("Expected connections from a trusted source without a header to be refused, got %q", w.Content())
+	}
+}
+
+func TestHTTPAcceptProxyProtocolUntrusted(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.com")
+	proxy.proxyProtocolSources, _ = parseCIDRs("192.0.2.0/24")
+	proxy.dial = dialEchoServer(t)
+
+	// only the load balancer may set the client's address, for anyone else
+	// the header is just an invalid request
+	response, err := requestHTTPRaw("PROXY TCP4 203.0.113.7 192.0.2.1 56324 80\r\nGET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 400 ") {
+		t.Errorf("Expected a 400 response, got %q", response)
+	}
+}
+
+// testProxyHeader is a PROXY protocol header as received by the upstream,
+// followed by what it was sent after it
+type testProxyHeader struct {
+	version     string
+	raw         string
+	family      byte
+	source      string
+	destination string
+	tlvs        map[byte][]byte
+	rest        []byte
+}
+
+// dialProxyProtocolServer starts a TCP server that parses the PROXY header on
+// every connection, sends it to headers and then echoes the rest back
+func dialProxyProtocolServer(t *testing.T, headers chan testProxyHeader) dialFunc {
+	return dialTCPServer(t, func(conn net.Conn) {
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		header, err := parseTestProxyHeader(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		rest, _ := ioutil.ReadAll(io.LimitReader(reader, 5))
+		header.rest = rest
+		headers <- header
+		conn.Write(rest)
+		conn.SetReadDeadline(time.Time{})
+		io.Copy(conn, reader)
+	})
+}
+
+// parseTestProxyHeader reads a PROXY protocol v1 or v2 header
+func parseTestProxyHeader(reader *bufio.Reader) (testProxyHeader, error) {
+	header := testProxyHeader{tlvs: map[byte][]byte{}}
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return header, err
+	}
+	if !bytes.Equal(signature, proxyProtocolV2Signature) {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return header, err
+		}
+		fields := strings.Fields(line)
+		if !strings.HasSuffix(line, "\r\n") || len(fields) != 6 || fields[0] != "PROXY" {
+			return header, fmt.Errorf("invalid v1 header %q", line)
+		}
+		header.version, header.raw = proxyProtocolV1, line
+		header.source = net.JoinHostPort(fields[2], fields[4])
+		header.destination = net.JoinHostPort(fields[3], fields[5])
+		return header, nil
+	}
+
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return header, err
+	}
+	if fixed[12] != 0x21 {
+		return header, fmt.Errorf("unexpected version and command 0x%02x", fixed[12])
+	}
+	header.version, header.family = proxyProtocolV2, fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return header, err
+	}
+	addressLen := map[byte]int{0x11: 4, 0x21: 16}[header.family]
+	if addressLen > 0 {
+		src, dst := net.IP(body[:addressLen]), net.IP(body[addressLen:2*addressLen])
+		ports := body[2*addressLen:]
+		header.source = net.JoinHostPort(src.String(), fmt.Sprint(binary.BigEndian.Uint16(ports)))
+		header.destination = net.JoinHostPort(dst.String(), fmt.Sprint(binary.BigEndian.Uint16(ports[2:])))
+		body = ports[4:]
+	}
+	for len(body) > 0 {
+		if len(body) < 3 || len(body) < 3+int(binary.BigEndian.Uint16(body[1:])) {
+			return header, fmt.Errorf("truncated TLV % x", body)
+		}
+		length := int(binary.BigEndian.Uint16(body[1:]))
+		header.tlvs[body[0]] = body[3 : 3+length]
+		body = body[3+length:]
+	}
+	return header, nil
+}
+
+// addrString formats addr, or returns "" if there is none
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// addrConn is a connection with made up addresses
+type addrConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr  { return c.local }
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Rule actions for HTTP requests
+const (
+	actionProxy    = "proxy"
+	actionRedirect = "redirect"
+)
+
+// defaultRedirectLocation is where redirects go unless configured otherwise
+const defaultRedirectLocation = "http://www.{host}"
+
+// redirectStatus returns the status code redirects are answered with
+func (r *Rule) redirectStatus() int {
+	if r.RedirectStatus == 0 {
+		return http.StatusMovedPermanently
+	}
+	return r.RedirectStatus
+}
+
+// redirectLocation returns where a request for target on hostname is
+// redirected to, keeping its path and query
+func (r *Rule) redirectLocation(hostname, target string) string {
+	location := r.RedirectLocation
+	switch {
+	case r.RedirectHTTPS:
+		// HSTS requires the upgrade to https to happen on the same host,
+		// before any redirect to another one
+		location = "https://{host}"
+	case location == "":
+		location = defaultRedirectLocation
+	}
+	location = strings.Replace(location, "{host}", hostname, -1)
+	return strings.TrimSuffix(location, "/") + target
+}
+
+// requestTarget returns the path and query of a request line, e.g. "/a?b"
+// for both "GET /a?b HTTP/1.1" and "GET http://example.com/a?b HTTP/1.1"
+func requestTarget(line string) string {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return "/"
+	}
+	if strings.HasPrefix(parts[1], "/") {
+		return parts[1]
+	}
+	target, err := url.Parse(parts[1])
+	if err != nil || target.Host == "" {
+		// asterisk-form, authority-form or nonsense
+		return "/"
+	}
+	return target.RequestURI()
+}
+
+// isValidLocation returns true if location is safe to send in a header field
+func isValidLocation(location string) bool {
+	for _, c := range location {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// redirectRequest answers the request in head with a redirect according to
+// rule and closes the connection
+func (p *ConnectionProxy) redirectRequest(downstream net.Conn, rule *Rule, head []byte, hostname string) bool {
+	location := rule.redirectLocation(hostname, requestTarget(headLines(head)[0]))
+	if !isValidLocation(location) {
+		p.writeHTTPError(downstream, http.StatusBadRequest, hostname)
+		return p.LogDebug(fmt.Sprintf("Bad request - invalid redirect location %q", location), hostname, downstream)
+	}
+	status := rule.redirectStatus()
+	if err := writeHTTPRedirect(downstream, status, location); err != nil {
+		return p.LogDebug(fmt.Sprintf("Error while sending redirect: %s", err), hostname, downstream)
+	}
+	p.Close(downstream)
+	return p.LogRedirect(status, location, hostname, downstream)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestRuleRedirectLocation(t *testing.T) {
+	tests := []struct {
+		rule     Rule
+		line     string
+		expected string
+	}{
+		{Rule{}, "GET / HTTP/1.1", "http://www.example.com/"},
+		{Rule{}, "GET /a/b?c=d&e HTTP/1.1", "http://www.example.com/a/b?c=d&e"},
+		{Rule{}, "GET http://example.com:8080/a?b HTTP/1.1", "http://www.example.com/a?b"},
+		{Rule{}, "OPTIONS * HTTP/1.1", "http://www.example.com/"},
+		{Rule{RedirectHTTPS: true}, "GET /a?b HTTP/1.1", "https://example.com/a?b"},
+		{Rule{RedirectLocation: "https://www.{host}/"}, "GET /a HTTP/1.1", "https://www.example.com/a"},
+		{Rule{RedirectLocation: "https://landing.example.net/{host}"}, "GET /a HTTP/1.1", "https://landing.example.net/example.com/a"},
+	}
+	for _, test := range tests {
+		actual := test.rule.redirectLocation("example.com", requestTarget(test.line))
+		if actual != test.expected {
+			t.Errorf("%+v %q: expected %q, got %q", test.rule, test.line, test.expected, actual)
+		}
+	}
+}
+
+func TestHTTPRedirect(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w, "example.com")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, Action: actionRedirect, RedirectStatus: 308}}}
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	response, err := requestHTTPRaw("GET /path?query=1 HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "HTTP/1.1 308 Permanent Redirect\r\nLocation: http://www.example.com/path?query=1\r\n"
+	if !strings.HasPrefix(string(response), expected) {
+		t.Errorf("Expected response to start with %q, got %q", expected, response)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected no upstream to be dialed, got %s", <-dialed)
+	}
+	if !strings.Contains(string(w.Content()), "REDIRECT: 308 http://www.example.com/path?query=1") {
+		t.Errorf("Expected a REDIRECT log line, got %q", w.Content())
+	}
+}
+
+func TestHTTPRedirectNotWhitelisted(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard, "example.org")
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionRedirect}}}
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 403 ") {
+		t.Errorf("Expected hosts that aren't whitelisted not to be redirected, got %q", response)
+	}
+}
+
+func TestHTTPRedirectInvalidLocation(t *testing.T) {
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionRedirect}}}
+
+	response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: exa\rmple.com\r\n\r\n", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(response), "HTTP/1.1 400 ") {
+		t.Errorf("Expected a 400 response, got %q", response)
+	}
+}
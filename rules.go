@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Config is the optional configuration file set with RULES_PATH. It lets
+// connections be handled differently depending on the requested hostname,
+// e.g.
+//
+//	{
+//	    "rules": [
+//	        {"hosts": ["example.com", "*.example.com"], "proxy_protocol": "v2"},
+//	        {"hosts": ["example.org"], "action": "redirect", "redirect_status": 308},
+//	        {"hosts": ["*.example.net"], "action": "terminate"},
+//	        {"hosts": ["shop.example.com"], "pool": "shop"},
+//	        {"hosts": ["blog.example.com"], "fallbacks": ["origin.example.com", "maintenance"]},
+//	        {"hosts": ["*"]}
+//	    ],
+//	    "pools": {
+//	        "shop": {"backends": [{"address": "10.0.0.5"}, {"address": "10.0.0.6"}]}
+//	    }
+//	}
+type Config struct {
+	Rules []*Rule `json:"rules"`
+	// Pools are backends rules can send connections to, by name, see Pool
+	Pools map[string]*Pool `json:"pools"`
+}
+
+// Rule configures how connections for hostnames matching Hosts are handled.
+// The zero value is the default behaviour.
+type Rule struct {
+	// Hosts are hostnames, "*.example.com" for any subdomain of example.com
+	// or "*" for everything
+	Hosts []string `json:"hosts"`
+	// ProxyProtocol sends a PROXY protocol header with the client's address
+	// to the upstream, either "v1" or "v2"
+	ProxyProtocol string `json:"proxy_protocol"`
+	// Action is what to do with connections, "proxy" to the upstream (the
+	// default), "redirect" HTTP requests or "terminate" TLS connections
+	Action string `json:"action"`
+	// RedirectStatus is 301 (the default), 302, 307 or 308
+	RedirectStatus int `json:"redirect_status"`
+	// RedirectLocation is where to redirect to, with "{host}" replaced by
+	// the requested hostname and the request's path and query appended.
+	// Defaults to defaultRedirectLocation.
+	RedirectLocation string `json:"redirect_location"`
+	// RedirectHTTPS redirects to the same host over https instead, as
+	// required for HSTS preloading
+	RedirectHTTPS bool `json:"redirect_https"`
+	// TerminateUpstream is how terminated TLS connections are passed on,
+	// "tls" (the default) or "plain" TCP to port 80
+	TerminateUpstream string `json:"terminate_upstream"`
+	// Pool is the name of the pool to proxy to instead of the www upstream
+	Pool string `json:"pool"`
+	// Fallbacks are tried in order when the upstream can't be reached:
+	// hostnames or IP addresses, connected to on the same port, and
+	// "maintenance" last for the maintenance page. That's only served over
+	// HTTP and terminated TLS, HTTPS connections that are passed through
+	// are closed instead.
+	Fallbacks []string `json:"fallbacks"`
+}
+
+// defaultRule applies to hostnames not matching any rule
+var defaultRule = &Rule{}
+
+// loadConfig reads and validates the configuration file at path
+func loadConfig(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	for name, pool := range config.Pools {
+		pool.name = name
+		if err := pool.validate(); err != nil {
+			return nil, fmt.Errorf("%s: pool %q: %s", path, name, err)
+		}
+	}
+	for i, rule := range config.Rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %s", path, i+1, err)
+		}
+		if _, ok := config.Pools[rule.Pool]; rule.Pool != "" && !ok {
+			return nil, fmt.Errorf("%s: rule %d: unknown pool %q", path, i+1, rule.Pool)
+		}
+	}
+	return config, nil
+}
+
+// warnings returns what the rules ask for that can't always be done, to be
+// logged when they're loaded
+func (c *Config) warnings() []string {
+	var warnings []string
+	for i, rule := range c.Rules {
+		last := len(rule.Fallbacks) - 1
+		if last >= 0 && rule.Fallbacks[last] == fallbackMaintenance && rule.Action != actionTerminate {
+			warnings = append(warnings, fmt.Sprintf("rule %d: the maintenance page can't be served to HTTPS connections that aren't terminated, they're closed instead", i+1))
+		}
+	}
+	return warnings
+}
+
+func (r *Rule) validate() error {
+	if len(r.Hosts) == 0 {
+		return fmt.Errorf("no hosts")
+	}
+	switch r.ProxyProtocol {
+	case "", proxyProtocolV1, proxyProtocolV2:
+	default:
+		return fmt.Errorf("unknown proxy_protocol %q", r.ProxyProtocol)
+	}
+	switch r.Action {
+	case "", actionProxy, actionRedirect, actionTerminate:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	switch r.TerminateUpstream {
+	case "", terminateUpstreamTLS, terminateUpstreamPlain:
+	default:
+		return fmt.Errorf("unknown terminate_upstream %q", r.TerminateUpstream)
+	}
+	switch r.RedirectStatus {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect_status %d", r.RedirectStatus)
+	}
+	for i, fallback := range r.Fallbacks {
+		if fallback == "" {
+			return fmt.Errorf("empty fallback")
+		}
+		if fallback == fallbackMaintenance && i < len(r.Fallbacks)-1 {
+			return fmt.Errorf("%q has to be the last fallback", fallbackMaintenance)
+		}
+		if _, _, err := net.SplitHostPort(fallback); err == nil {
+			return fmt.Errorf("fallback %q has a port, the one the connection was received for is used", fallback)
+		}
+	}
+	if r.RedirectLocation != "" {
+		location, err := url.Parse(strings.Replace(r.RedirectLocation, "{host}", "example.com", -1))
+		if err != nil || (location.Scheme != "http" && location.Scheme != "https") || location.Host == "" {
+			return fmt.Errorf("redirect_location %q isn't an absolute http(s) URL", r.RedirectLocation)
+		}
+	}
+	return nil
+}
+
+// matches returns true if hostname is one of the rule's hosts
+func (r *Rule) matches(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, pattern := range r.Hosts {
+		pattern = strings.ToLower(pattern)
+		switch {
+		case pattern == "*":
+			return true
+		case strings.HasPrefix(pattern, "*."):
+			if strings.HasSuffix(hostname, pattern[1:]) {
+				return true
+			}
+		case pattern == hostname:
+			return true
+		}
+	}
+	return false
+}
+
+// names returns true if hostname is one of the rule's hosts itself rather
+// than matched by a wildcard
+func (r *Rule) names(hostname string) bool {
+	for _, host := range r.Hosts {
+		if strings.EqualFold(host, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// ruleFor returns the first rule matching hostname, or the default rule
+func (c *Config) ruleFor(hostname string) *Rule {
+	if c == nil {
+		return defaultRule
+	}
+	for _, rule := range c.Rules {
+		if rule.matches(hostname) {
+			return rule
+		}
+	}
+	return defaultRule
+}
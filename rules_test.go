@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigRuleFor(t *testing.T) {
+	exact := &Rule{Hosts: []string{"example.com"}}
+	wildcard := &Rule{Hosts: []string{"*.Example.com"}}
+	catchAll := &Rule{Hosts: []string{"*"}}
+	config := &Config{Rules: []*Rule{exact, wildcard, catchAll}}
+
+	tests := []struct {
+		hostname string
+		expected *Rule
+	}{
+		{"example.com", exact},
+		{"EXAMPLE.com", exact},
+		{"www.example.com", wildcard},
+		{"a.b.example.com", wildcard},
+		{"badexample.com", catchAll},
+		{"example.org", catchAll},
+	}
+	for _, test := range tests {
+		if got := config.ruleFor(test.hostname); got != test.expected {
+			t.Errorf("%s: expected rule %v, got %v", test.hostname, test.expected.Hosts, got.Hosts)
+		}
+	}
+
+	if got := (&Config{Rules: []*Rule{exact}}).ruleFor("example.org"); got != defaultRule {
+		t.Errorf("Expected the default rule, got %v", got.Hosts)
+	}
+	var none *Config
+	if got := none.ruleFor("example.com"); got != defaultRule {
+		t.Errorf("Expected the default rule without a config, got %v", got.Hosts)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sensible-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"rules": [{"hosts": ["*"], "proxy_protocol": "v2"}]}`, ""},
+		{`{"rules": [{"hosts": ["*"], "proxy_protocol": "v3"}]}`, `rule 1: unknown proxy_protocol "v3"`},
+		{`{"rules": [{"hosts": ["*"]}, {"proxy_protocol": "v1"}]}`, "rule 2: no hosts"},
+		{`{"rules": [{"hosts": ["*"], "action": "drop"}]}`, `rule 1: unknown action "drop"`},
+		{`{"rules": [{"hosts": ["*"], "redirect_status": 200}]}`, "rule 1: invalid redirect_status 200"},
+		{`{"rules": [{"hosts": ["*"], "redirect_location": "www.{host}"}]}`, "isn't an absolute http(s) URL"},
+		{`{"rules": `, "unexpected end of JSON input"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(dir, "rules.json")
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.content, err)
+			} else if config.ruleFor("example.com").ProxyProtocol != proxyProtocolV2 {
+				t.Errorf("%s: rule not loaded", test.content)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.content, test.err, err)
+		}
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	config := &Config{Rules: []*Rule{
+		{Hosts: []string{"example.com"}, Fallbacks: []string{"origin.example.com", fallbackMaintenance}},
+		{Hosts: []string{"example.org"}, Action: actionTerminate, Fallbacks: []string{fallbackMaintenance}},
+		{Hosts: []string{"example.net"}, Fallbacks: []string{"origin.example.net"}},
+	}}
+	warnings := config.warnings()
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0], "rule 1: the maintenance page can't be served to HTTPS connections") {
+		t.Errorf("Expected a warning for the passed through rule, got %q", warnings)
+	}
+}
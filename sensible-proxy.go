@@ -8,8 +8,8 @@ package main
 
 import (
 	"bufio"
-	"container/list"
 	"crypto/sha1"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,6 +18,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -25,6 +26,8 @@ import (
 
 var (
 	debugLog = false
+	// version is set when building, with -ldflags "-X main.version=1.2.3"
+	version = "dev"
 )
 
 type tcpHandler func(net.Conn, *ConnectionProxy) bool
@@ -36,9 +39,16 @@ func main() {
 
 	// default configuration
 	var (
-		httpPort   = "80"
-		httpsPort  = "443"
-		appLogPath = "/var/log/sensible-proxy.log"
+		httpPort         = "80"
+		httpsPort        = "443"
+		appLogPath       = "/var/log/sensible-proxy.log"
+		maxHeaderSize    = defaultMaxHeaderSize
+		keepAliveMode    = keepAlivePassthrough
+		handshakeTimeout = 10 * time.Second
+		dialTimeout      = 10 * time.Second
+		idleTimeout      = 5 * time.Minute
+		dialRetries      = 0
+		breakerFailures  = 5
 	)
 
 	// Get configuration from ENV
@@ -54,6 +64,139 @@ func main() {
 	if os.Getenv("DEBUG") != "" {
 		debugLog = true
 	}
+	handshakeTimeout = durationFromEnv("HANDSHAKE_TIMEOUT", handshakeTimeout)
+	dialTimeout = durationFromEnv("DIAL_TIMEOUT", dialTimeout)
+	idleTimeout = durationFromEnv("IDLE_TIMEOUT", idleTimeout)
+	if os.Getenv("MAX_HEADER_SIZE") != "" {
+		size, err := strconv.Atoi(os.Getenv("MAX_HEADER_SIZE"))
+		if err != nil || size < 1 {
+			log.Fatalln("Invalid MAX_HEADER_SIZE", os.Getenv("MAX_HEADER_SIZE"))
+		}
+		maxHeaderSize = size
+	}
+	if os.Getenv("DIAL_RETRIES") != "" {
+		retries, err := strconv.Atoi(os.Getenv("DIAL_RETRIES"))
+		if err != nil || retries < 0 {
+			log.Fatalln("Invalid DIAL_RETRIES", os.Getenv("DIAL_RETRIES"))
+		}
+		dialRetries = retries
+	}
+	if os.Getenv("BREAKER_FAILURES") != "" {
+		failures, err := strconv.Atoi(os.Getenv("BREAKER_FAILURES"))
+		if err != nil || failures < 0 {
+			log.Fatalln("Invalid BREAKER_FAILURES", os.Getenv("BREAKER_FAILURES"))
+		}
+		breakerFailures = failures
+	}
+
+	trustedProxies, err := parseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		log.Fatalln("Invalid TRUSTED_PROXIES", err)
+	}
+
+	proxyProtocolSources, err := parseCIDRs(os.Getenv("ACCEPT_PROXY_PROTOCOL"))
+	if err != nil {
+		log.Fatalln("Invalid ACCEPT_PROXY_PROTOCOL", err)
+	}
+
+	var blockedNetworks []*net.IPNet
+	switch os.Getenv("UPSTREAM_BLOCKLIST") {
+	case "none":
+	case "":
+		blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	default:
+		if blockedNetworks, err = parseCIDRs(os.Getenv("UPSTREAM_BLOCKLIST")); err != nil {
+			log.Fatalln("Invalid UPSTREAM_BLOCKLIST", err)
+		}
+	}
+
+	resolver := newSystemDNSResolver(durationFromEnv("DNS_CACHE_TTL", 30*time.Second), dialTimeout, durationFromEnv("DNS_MAX_STALE", time.Hour))
+	if os.Getenv("DNS_SERVERS") != "" {
+		servers, err := parseDNSServers(os.Getenv("DNS_SERVERS"))
+		if err != nil || len(servers) == 0 {
+			log.Fatalln("Invalid DNS_SERVERS", os.Getenv("DNS_SERVERS"))
+		}
+		resolver = newDNSResolver(servers, resolver.maxStale)
+	}
+	lookup := resolver.lookup
+
+	// open connections are only tracked for the admin API
+	var sessions *sessionTable
+	if os.Getenv("ADMIN_ADDR") != "" {
+		sessions = newSessionTable()
+	}
+
+	// shared, so failures seen by one listener fail the other fast too
+	var breakers *circuitBreakers
+	if breakerFailures > 0 {
+		breakers = newCircuitBreakers(breakerFailures, durationFromEnv("BREAKER_COOLDOWN", 30*time.Second))
+	}
+
+	var config *Config
+	if os.Getenv("RULES_PATH") != "" {
+		if config, err = loadConfig(os.Getenv("RULES_PATH")); err != nil {
+			log.Fatalln("Invalid RULES_PATH", err)
+		}
+		for _, warning := range config.warnings() {
+			log.Printf("%s: %s", os.Getenv("RULES_PATH"), warning)
+		}
+	}
+
+	challenges := newChallengeStore(os.Getenv("ACME_CHALLENGE_DIR"))
+
+	var certs *certStore
+	if os.Getenv("CERT_DIR") != "" {
+		certs = newCertStore(os.Getenv("CERT_DIR"))
+		if _, err := certs.reload(); err != nil {
+			log.Fatalln("Invalid CERT_DIR", err)
+		}
+	}
+
+	// markers are listed in Via headers and PROXY protocol TLVs
+	if strings.ContainsAny(os.Getenv("LOOP_MARKER"), ", \t()") {
+		log.Fatalln("Invalid LOOP_MARKER", os.Getenv("LOOP_MARKER"))
+	}
+	localAddrs, err := newLocalAddresses(httpPort, httpsPort)
+	if err != nil {
+		log.Fatalln("Could not list the interface addresses", err)
+	}
+
+	var acme *acmeManager
+	if os.Getenv("ACME_DIRECTORY_URL") != "" {
+		if certs == nil {
+			log.Fatalln("ACME_DIRECTORY_URL needs CERT_DIR to store the certificates in")
+		}
+		client, err := acmeHTTPClient(os.Getenv("ACME_CA_FILE"))
+		if err != nil {
+			log.Fatalln("Invalid ACME_CA_FILE", err)
+		}
+		acme, err = newACMEManager(os.Getenv("ACME_DIRECTORY_URL"), os.Getenv("ACME_EMAIL"), client, dirStorage(certs.dir), certs, challenges)
+		if err != nil {
+			log.Fatalln("Could not set up ACME", err)
+		}
+		switch os.Getenv("ACME_CHALLENGE_TYPE") {
+		case "", acmeChallengeTLSALPN:
+		case acmeChallengeHTTP:
+			acme.challengeType = acmeChallengeHTTP
+		default:
+			log.Fatalln("Invalid ACME_CHALLENGE_TYPE", os.Getenv("ACME_CHALLENGE_TYPE"))
+		}
+	}
+
+	var pages errorPages
+	if os.Getenv("ERROR_TEMPLATE_DIR") != "" {
+		if pages, err = loadErrorPages(os.Getenv("ERROR_TEMPLATE_DIR")); err != nil {
+			log.Fatalln("Invalid ERROR_TEMPLATE_DIR", err)
+		}
+	}
+
+	switch os.Getenv("HTTP_KEEPALIVE_MODE") {
+	case keepAlivePassthrough, "passthrough":
+	case keepAliveReroute, keepAliveReject:
+		keepAliveMode = os.Getenv("HTTP_KEEPALIVE_MODE")
+	default:
+		log.Fatalln("Invalid HTTP_KEEPALIVE_MODE", os.Getenv("HTTP_KEEPALIVE_MODE"))
+	}
 
 	logFile, err := os.OpenFile(appLogPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
@@ -65,12 +208,84 @@ func main() {
 	errChan := make(chan int)
 
 	proxy := &ConnectionProxy{
-		port:   httpPort,
-		logger: appLog,
+		port:                 httpPort,
+		logger:               appLog,
+		handshakeTimeout:     handshakeTimeout,
+		dialTimeout:          dialTimeout,
+		dialRetries:          dialRetries,
+		breakers:             breakers,
+		sessions:             sessions,
+		idleTimeout:          idleTimeout,
+		maxHeaderSize:        maxHeaderSize,
+		keepAliveMode:        keepAliveMode,
+		forwardedHeaders:     os.Getenv("FORWARDED_HEADERS") != "",
+		stripForwarded:       os.Getenv("STRIP_FORWARDED_HEADERS") != "",
+		trustedProxies:       trustedProxies,
+		proxyProtocolSources: proxyProtocolSources,
+		config:               config,
+		errorPages:           pages,
+		challenges:           challenges,
+		challengeUpstream:    os.Getenv("ACME_CHALLENGE_UPSTREAM"),
+		blockedNetworks:      blockedNetworks,
+		localAddrs:           localAddrs,
+		loopMarker:           os.Getenv("LOOP_MARKER"),
+		lookup:               lookup,
 	}
 	tlsProxy := &ConnectionProxy{
-		port:   httpsPort,
-		logger: appLog,
+		port:                 httpsPort,
+		logger:               appLog,
+		handshakeTimeout:     handshakeTimeout,
+		dialTimeout:          dialTimeout,
+		dialRetries:          dialRetries,
+		breakers:             breakers,
+		sessions:             sessions,
+		idleTimeout:          idleTimeout,
+		proxyProtocolSources: proxyProtocolSources,
+		config:               config,
+		certs:                certs,
+		acme:                 acme,
+		blockedNetworks:      blockedNetworks,
+		localAddrs:           localAddrs,
+		loopMarker:           os.Getenv("LOOP_MARKER"),
+		lookup:               lookup,
+	}
+	if acme != nil {
+		acme.allowed = tlsProxy.canObtainCertificate
+		acme.logf = tlsProxy.Logf
+	}
+	config.startHealthChecks(proxy.Logf)
+	if os.Getenv("METRICS_ADDR") != "" {
+		publishPoolMetrics(config)
+		publishBreakerMetrics(breakers)
+		serveMetrics(os.Getenv("METRICS_ADDR"))
+	}
+	drained := make(chan struct{})
+	if os.Getenv("ADMIN_ADDR") != "" {
+		if os.Getenv("ADMIN_TOKEN") == "" {
+			log.Fatalln("ADMIN_TOKEN has to be set for ADMIN_ADDR")
+		}
+		listener, err := listenAdmin(os.Getenv("ADMIN_ADDR"))
+		if err != nil {
+			log.Fatalln("Invalid ADMIN_ADDR", err)
+		}
+		admin := &adminServer{
+			token:        os.Getenv("ADMIN_TOKEN"),
+			started:      time.Now(),
+			listeners:    map[string]*ConnectionProxy{"http": proxy, "https": tlsProxy},
+			config:       config,
+			breakers:     breakers,
+			sessions:     sessions,
+			challenges:   challenges,
+			logger:       appLog,
+			drainTimeout: durationFromEnv("DRAIN_TIMEOUT", 5*time.Minute),
+			drained:      drained,
+		}
+		if url := os.Getenv("WHITELIST_URL"); url != "" {
+			admin.refreshWhitelist = func() error {
+				return setWhitelistFromURL(proxy, tlsProxy, url)
+			}
+		}
+		admin.serve(listener)
 	}
 	go doProxy(errChan, handleHTTPConnection, proxy)
 	go doProxy(errChan, handleHTTPSConnection, tlsProxy)
@@ -84,6 +299,12 @@ func main() {
 		syscall.SIGQUIT)
 
 	periodicWhiteListUpdate(proxy, tlsProxy, os.Getenv("WHITELIST_URL"))
+	if certs != nil {
+		periodicCertReload(tlsProxy, certs, certReloadInterval)
+	}
+	if acme != nil {
+		acme.periodicRenewal(acmeRenewInterval)
+	}
 
 	// block until error or signal
 	select {
@@ -93,9 +314,26 @@ func main() {
 	case <-sigChan:
 		log.Printf("Stopping server")
 		os.Exit(0)
+	case <-drained:
+		log.Printf("Stopping server, it's drained.")
+		os.Exit(0)
 	}
 }
 
+// durationFromEnv parses the ENV variable name as a time.Duration, e.g. "30s",
+// and returns def if it's not set. A value of 0 disables the timeout.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid duration for %s: %s", name, err)
+	}
+	return d
+}
+
 func periodicWhiteListUpdate(proxy, tlsProxy *ConnectionProxy, url string) {
 	if url == "" {
 		proxy.Logln("No WHITELIST_URL set, allowing all domains")
@@ -112,25 +350,34 @@ func periodicWhiteListUpdate(proxy, tlsProxy *ConnectionProxy, url string) {
 	}()
 }
 
-func setWhitelistFromURL(proxy, tlsProxy *ConnectionProxy, url string) {
+// setWhitelistFromURL fetches the whitelist of both proxies from url. If
+// that fails, the old list is kept, or all domains are allowed if there's
+// none, and the returned error says which.
+func setWhitelistFromURL(proxy, tlsProxy *ConnectionProxy, url string) error {
 	proxy.Logf("Fetching whitelist from '%s'\n", url)
 	whiteList := fetchWhiteList(url)
+	var err error
 	if len(whiteList) > 0 {
 		proxy.Logf("Fetched %d white listed domains\n", len(whiteList))
-	} else if len(proxy.GetWhiteList()) > 0 {
-		proxy.Logf("Could not find whitelist, keeping old list with %d domains", len(proxy.GetWhiteList()))
-		return
+	} else if n := len(proxy.GetWhiteList()); n > 0 {
+		proxy.Logf("Could not find whitelist, keeping old list with %d domains\n", n)
+		return fmt.Errorf("could not find whitelist, keeping old list with %d domains", n)
 	} else {
 		proxy.Logln("Could not find whitelist, allowing all domains")
+		err = errors.New("could not find whitelist, allowing all domains")
 	}
 	proxy.SetWhiteList(whiteList)
 	tlsProxy.SetWhiteList(whiteList)
+	return err
 }
 
 func doProxy(errChan chan int, handle tcpHandler, proxy *ConnectionProxy) {
-	// the proxy should never quit (leaving this function)
+	// the proxy should never quit (leaving this function), unless it's
+	// draining
 	defer func(crash chan int) {
-		crash <- 1
+		if !proxy.isDraining() {
+			crash <- 1
+		}
 	}(errChan)
 
 	listener, err := net.Listen("tcp", "0.0.0.0:"+proxy.port)
@@ -138,12 +385,22 @@ func doProxy(errChan chan int, handle tcpHandler, proxy *ConnectionProxy) {
 		log.Printf("Couldn't start listening: %s", err)
 		return
 	}
-	defer proxy.Close(listener)
+	proxy.Lock()
+	proxy.listener = listener
+	draining := proxy.draining
+	proxy.Unlock()
+	defer listener.Close()
+	if draining {
+		return
+	}
 
 	log.Printf("Started proxy on %s", proxy.port)
 	for {
 		connection, err := listener.Accept()
 		if err != nil {
+			if proxy.isDraining() {
+				return
+			}
 			proxy.logger.Println("Accept error:", err)
 			continue
 		}
@@ -151,185 +408,262 @@ func doProxy(errChan chan int, handle tcpHandler, proxy *ConnectionProxy) {
 	}
 }
 
-func handleHTTPConnection(downstream net.Conn, proxy *ConnectionProxy) bool {
+func handleHTTPConnection(conn net.Conn, proxy *ConnectionProxy) bool {
+	downstream := newClientConn(conn)
+	proxy.sessions.add(downstream, proxy.port)
+	proxy.startHandshake(downstream)
+	if err := proxy.acceptProxyHeader(downstream); err != nil {
+		return proxy.LogHandshakeError(fmt.Sprintf("PROXY protocol header problem: %s", err), err, downstream)
+	}
 	reader := bufio.NewReader(downstream)
-	hostname := ""
-	readLines := list.New()
-	for hostname == "" {
-		bytes, _, err := reader.ReadLine()
-		if err != nil {
-			return proxy.LogError(fmt.Sprintf("Error during copy between connections: %s", err), hostname, downstream)
-		}
-		line := string(bytes)
-		readLines.PushBack(line)
-		if line == "" {
-			// End of HTTP headers
-			break
+	head, hostname, err := readRequestHead(reader, proxy.headerLimit())
+	if err != nil {
+		if reqErr, ok := err.(*requestError); ok {
+			proxy.writeHTTPError(downstream, reqErr.status, hostname)
+			return proxy.LogDebug(reqErr.reason, hostname, downstream)
 		}
-		if strings.HasPrefix(line, "Host: ") {
-			hostname = strings.TrimPrefix(line, "Host: ")
-			break
+		if isTimeout(err) {
+			return proxy.LogError("Handshake timeout", hostname, downstream)
 		}
+		return proxy.LogError(fmt.Sprintf("Error while reading request: %s", err), hostname, downstream)
 	}
 
 	if !proxy.IsWhiteListed(hostname) {
+		proxy.writeHTTPError(downstream, http.StatusForbidden, hostname)
 		return proxy.LogDebug(fmt.Sprintf("Hostname is not whitelisted"), hostname, downstream)
 	}
 
-	// will timeout with the default linux TCP timeout
-	upstream, err := net.Dial("tcp", "www."+hostname+":80")
-	if err != nil {
-		return proxy.LogDebug(fmt.Sprintf("Couldn't connect to backend: %s", err), hostname, downstream)
+	proxy.endHandshake(downstream)
+
+	// ACME HTTP-01 challenges for the apex domain are answered here or by
+	// the challenge server, since the www upstream can't answer them. ACME
+	// servers use a new connection for every validation request, so only
+	// the first request on a connection is checked.
+	address := "www." + hostname + ":80"
+	challenge := false
+	if token, ok := acmeChallengeToken(headLines(head)[0]); ok {
+		if keyAuth, ok := proxy.challenges.Get(token); ok {
+			return proxy.answerChallenge(downstream, headLines(head)[0], token, keyAuth, hostname)
+		}
+		if proxy.challengeUpstream != "" {
+			address, challenge = proxy.challengeUpstream, true
+		}
 	}
 
-	// proxy the clients request to the upstream
-	for element := readLines.Front(); element != nil; element = element.Next() {
-		line := element.Value.(string)
+	if rule := proxy.config.ruleFor(hostname); rule.Action == actionRedirect && !challenge {
+		return proxy.redirectRequest(downstream, rule, head, hostname)
+	}
+	if proxy.loopDetected(downstream, head) {
+		proxy.writeHTTPError(downstream, http.StatusLoopDetected, hostname)
+		return proxy.LogError("Proxy loop detected: the request already went through this proxy", hostname, downstream)
+	}
 
-		if _, err := upstream.Write([]byte(line)); err != nil {
-			return proxy.LogDebug(fmt.Sprintf("Error while proxying initial request to backend: %s", err), hostname, downstream)
-		}
+	head = proxy.rewriteForwardedHeaders(head, downstream.RemoteAddr(), hostname)
+	head = proxy.addLoopMarker(head)
+	// when only the first request is read, the clients request is sent to
+	// the upstream together with whatever else the reader has buffered, so
+	// it can be reused while the connection is being proxied
+	var replay []byte
+	if !proxy.parsesEveryRequest() {
+		buffered, _ := reader.Peek(reader.Buffered())
+		replay = append(head, buffered...)
+	}
 
-		if _, err = upstream.Write([]byte("\n")); err != nil {
-			return proxy.LogDebug(fmt.Sprintf("Error while proxying initial request to backend: %s", err), hostname, downstream)
+	var upstream net.Conn
+	var fallback string
+	if challenge {
+		// the challenge server isn't the upstream the rules are for
+		if upstream, err = proxy.dialDirect(address); err == nil && len(replay) > 0 {
+			if _, err = upstream.Write(replay); err != nil {
+				proxy.Close(upstream)
+				err = &upstreamSetupError{"proxying initial data", err}
+			}
+		}
+	} else {
+		upstream, fallback, err = proxy.connectWithFallbacks(downstream, address, hostname, replay, idempotentRequest(head), true)
+	}
+	if err != nil {
+		if isMaintenance(err) {
+			return proxy.serveMaintenance(downstream, downstream, err, hostname)
 		}
+		return proxy.LogHTTPUpstreamError(err, hostname, downstream)
 	}
 
-	go copyAndClose(upstream, reader, proxy)
-	go copyAndClose(downstream, upstream, proxy)
+	if proxy.parsesEveryRequest() {
+		proxy.LogAccessVia(fallback, hostname, downstream)
+		return proxyHTTPRequests(downstream, reader, head, hostname, upstream, proxy)
+	}
+	proxyConnections(downstream, downstream, upstream, proxy)
 
 	// by getting here, it seems there are no problems with the connection. Log the successful access.
-	return proxy.LogAccess(hostname, downstream)
+	return proxy.LogAccessVia(fallback, hostname, downstream)
 }
 
-func handleHTTPSConnection(downstream net.Conn, proxy *ConnectionProxy) bool {
-	firstByte := make([]byte, 1)
-	_, err := downstream.Read(firstByte)
+func handleHTTPSConnection(conn net.Conn, proxy *ConnectionProxy) bool {
+	downstream := newClientConn(conn)
+	proxy.sessions.add(downstream, proxy.port)
+	proxy.startHandshake(downstream)
+	if err := proxy.acceptProxyHeader(downstream); err != nil {
+		return proxy.LogHandshakeError(fmt.Sprintf("PROXY protocol header problem: %s", err), err, downstream)
+	}
+	header := make([]byte, tlsRecordHeaderLen)
+	firstByte := header[0:1]
+	_, err := io.ReadFull(downstream, firstByte)
 	if err != nil {
-		return proxy.LogError("TLS header - couldn't read first byte.", "", downstream)
+		return proxy.LogHandshakeError("TLS header - couldn't read first byte.", err, downstream)
 	}
 	if firstByte[0] != 0x16 {
 		return proxy.LogError("TLS header - not TLS.", "", downstream)
 	}
 
-	versionBytes := make([]byte, 2)
-	_, err = downstream.Read(versionBytes)
+	versionBytes := header[1:3]
+	_, err = io.ReadFull(downstream, versionBytes)
 	if err != nil {
-		return proxy.LogError("TLS header - couldn't read version bytes.", "", downstream)
+		return proxy.LogHandshakeError("TLS header - couldn't read version bytes.", err, downstream)
 	}
 	if versionBytes[0] < 3 || (versionBytes[0] == 3 && versionBytes[1] < 1) {
 		return proxy.LogError("TLS header - SSL < 3.1, SNI not supported.", "", downstream)
 	}
 
-	restLengthBytes := make([]byte, 2)
-	_, err = downstream.Read(restLengthBytes)
+	restLengthBytes := header[3:5]
+	_, err = io.ReadFull(downstream, restLengthBytes)
 	if err != nil {
-		return proxy.LogError(fmt.Sprintf("TLS header - couldn't read restLength bytes: %s", err), "", downstream)
+		return proxy.LogHandshakeError(fmt.Sprintf("TLS header - couldn't read restLength bytes: %s", err), err, downstream)
 	}
 	restLength := (int(restLengthBytes[0]) << 8) + int(restLengthBytes[1])
-
-	rest := make([]byte, restLength)
-
-	if n, err := downstream.Read(rest); err != nil || n == 0 {
-		return proxy.LogError(fmt.Sprintf("TLS header - couldn't read rest of bytes: %s", err), "", downstream)
+	if restLength > tlsMaxRecordLen {
+		return proxy.LogError("TLS header - record too long.", "", downstream)
 	}
 
-	current := 0
+	// the whole record is forwarded upstream as it arrived
+	record := make([]byte, tlsRecordHeaderLen+restLength)
+	copy(record, header)
+	rest := record[tlsRecordHeaderLen:]
 
-	handshakeType := rest[0]
-	current++
-	if handshakeType != 0x1 {
-		return proxy.LogError("TLS header parsing problem - not a ClientHello.", "", downstream)
+	if n, err := io.ReadFull(downstream, rest); err != nil || n == 0 {
+		return proxy.LogHandshakeError(fmt.Sprintf("TLS header - couldn't read rest of bytes: %s", err), err, downstream)
 	}
 
-	// Skip over another length
-	current += 3
-	// Skip over protocolversion
-	current += 2
-	// Skip over random number
-	current += 4 + 28
-	// Skip over session ID
-	sessionIDLength := int(rest[current])
-	current++
-	current += sessionIDLength
-
-	cipherSuiteLength := (int(rest[current]) << 8) + int(rest[current+1])
-	current += 2
-	current += cipherSuiteLength
-
-	compressionMethodLength := int(rest[current])
-	current++
-	current += compressionMethodLength
+	hostname, err := clientHelloServerName(rest)
+	if err != nil {
+		return proxy.LogError(fmt.Sprintf("TLS header parsing problem - %s.", err), "", downstream)
+	}
+	if hostname == "" {
+		return proxy.LogDebug("TLS header parsing problem - no hostname found.", hostname, downstream)
+	}
+	if hostname, err = normalizeHostname(hostname); err != nil {
+		return proxy.LogDebug(fmt.Sprintf("TLS header parsing problem - %s", err), "", downstream)
+	}
 
-	if current > restLength {
-		return proxy.LogError("TLS header parsing problem - no extensions.", "", downstream)
+	if !proxy.IsWhiteListed(hostname) {
+		return proxy.LogDebug("Hostname is not whitelisted", hostname, downstream)
 	}
 
-	// Skip over extensionsLength
-	// extensionsLength := (int(rest[current]) << 8) + int(rest[current + 1])
-	current += 2
+	if proxy.loopDetected(downstream, nil) {
+		return proxy.LogError("Proxy loop detected: the connection already went through this proxy", hostname, downstream)
+	}
 
-	hostname := ""
-	for current < restLength && hostname == "" {
-		extensionType := (int(rest[current]) << 8) + int(rest[current+1])
-		current += 2
+	if rule := proxy.config.ruleFor(hostname); rule.Action == actionTerminate {
+		return proxy.terminateTLS(downstream, record, hostname, rule)
+	}
 
-		extensionDataLength := (int(rest[current]) << 8) + int(rest[current+1])
-		current += 2
+	proxy.endHandshake(downstream)
 
-		if extensionType == 0 {
+	// proxy the clients request to the upstream
+	// there's no maintenance page without terminating TLS
+	upstream, fallback, err := proxy.connectWithFallbacks(downstream, "www."+hostname+":443", hostname, record, true, false)
+	if err != nil {
+		return proxy.LogUpstreamError(err, hostname, downstream)
+	}
+	proxyConnections(downstream, downstream, upstream, proxy)
 
-			// Skip over number of names as we're assuming there's just one
-			current += 2
+	// by getting here, it seems there are no problems with the connection. Log the successful access.
+	return proxy.LogAccessVia(fallback, hostname, downstream)
+}
 
-			nameType := rest[current]
-			current++
-			if nameType != 0 {
-				return proxy.LogError("TLS header parsing problem - not a hostname.", hostname, downstream)
-			}
-			nameLen := (int(rest[current]) << 8) + int(rest[current+1])
-			current += 2
-			hostname = string(rest[current : current+nameLen])
-		}
+const (
+	// tlsRecordHeaderLen is the length of the content type, version and
+	// length that starts each TLS record
+	tlsRecordHeaderLen = 5
+	// tlsMaxRecordLen is the largest plaintext TLS record allowed by
+	// RFC 5246, which the ClientHello is sent in
+	tlsMaxRecordLen = 1 << 14
+)
 
-		current += extensionDataLength
-	}
+var (
+	errNotClientHello = errors.New("not a ClientHello")
+	errNoExtensions   = errors.New("no extensions")
+	errNotHostname    = errors.New("not a hostname")
+	errTruncatedHello = errors.New("truncated ClientHello")
+)
 
-	if hostname == "" || hostname == "127.0.0.1" {
-		return proxy.LogDebug("TLS header parsing problem - no hostname found.", hostname, downstream)
+// clientHelloServerName returns the hostname from the SNI extension of a
+// ClientHello, or "" if there is none. Every length is checked against
+// hello, so a malformed ClientHello is an error rather than a panic.
+func clientHelloServerName(hello []byte) (string, error) {
+	if len(hello) < 1 || hello[0] != 0x1 {
+		return "", errNotClientHello
 	}
+	// Skip over the handshake type, another length, the protocol version
+	// and the random number
+	current := 1 + 3 + 2 + 32
 
-	if !proxy.IsWhiteListed(hostname) {
-		return proxy.LogDebug("Hostname is not whitelisted", hostname, downstream)
+	// Skip over session ID
+	if current+1 > len(hello) {
+		return "", errTruncatedHello
 	}
+	current += 1 + int(hello[current])
 
-	// proxy the clients request to the upstream
-	upstream, err := net.Dial("tcp", "www."+hostname+":443")
-	if err != nil {
-		return proxy.LogError(fmt.Sprintf("Couldn't connect to backend: %s", err), hostname, downstream)
+	// Skip over cipher suites
+	if current+2 > len(hello) {
+		return "", errTruncatedHello
 	}
+	current += 2 + (int(hello[current])<<8 + int(hello[current+1]))
 
-	if _, err = upstream.Write(firstByte); err != nil {
-		return proxy.LogError(fmt.Sprintf("Error while proxying first byte to backend: %s", err), hostname, downstream)
+	// Skip over compression methods
+	if current+1 > len(hello) {
+		return "", errTruncatedHello
 	}
+	current += 1 + int(hello[current])
 
-	if _, err = upstream.Write(versionBytes); err != nil {
-		return proxy.LogError(fmt.Sprintf("Error while proxying versionBytes to backend: %s", err), hostname, downstream)
+	if current > len(hello) {
+		return "", errNoExtensions
 	}
-
-	if _, err = upstream.Write(restLengthBytes); err != nil {
-		return proxy.LogError(fmt.Sprintf("Error while proxying restLengthBytes to backend: %s", err), hostname, downstream)
+	if current == len(hello) {
+		return "", nil
 	}
 
-	if _, err = upstream.Write(rest); err != nil {
-		return proxy.LogError(fmt.Sprintf("Error while proxying rest to backend: %s", err), hostname, downstream)
-	}
+	// Skip over extensionsLength
+	current += 2
 
-	go copyAndClose(upstream, downstream, proxy)
-	go copyAndClose(downstream, upstream, proxy)
+	for current+4 <= len(hello) {
+		extensionType := int(hello[current])<<8 + int(hello[current+1])
+		extensionDataLength := int(hello[current+2])<<8 + int(hello[current+3])
+		current += 4
+		if current+extensionDataLength > len(hello) {
+			return "", errTruncatedHello
+		}
+		data := hello[current : current+extensionDataLength : current+extensionDataLength]
+		current += extensionDataLength
+		if extensionType != 0 {
+			continue
+		}
 
-	// by getting here, it seems there are no problems with the connection. Log the successful access.
-	return proxy.LogAccess(hostname, downstream)
+		// Skip over the length of the list of names as we're assuming
+		// there's just one
+		if len(data) < 5 {
+			return "", errTruncatedHello
+		}
+		if data[2] != 0 {
+			return "", errNotHostname
+		}
+		nameLen := int(data[3])<<8 + int(data[4])
+		if 5+nameLen > len(data) {
+			return "", errTruncatedHello
+		}
+		return string(data[5 : 5+nameLen : 5+nameLen]), nil
+	}
+	return "", nil
 }
 
 func fetchWhiteList(URL string) []string {
@@ -355,21 +689,6 @@ func fetchWhiteList(URL string) []string {
 	return result
 }
 
-func copyAndClose(dst io.WriteCloser, src io.Reader, proxy *ConnectionProxy) {
-	_, err := io.Copy(dst, src)
-	if err != nil {
-		// this is a bit of hack until the core net lib gives us better
-		// typed error. The below error is expected since either the
-		// client or backend can close the connection when ever they
-		// feel like it.
-		str := err.Error()
-		if !strings.Contains(str, "use of closed network connection") {
-			proxy.LogDebug(fmt.Sprintf("Error during copy between connections: %s", err), "", nil)
-		}
-	}
-	proxy.Close(dst)
-}
-
 // SHA1 returns a string representation of the calculated SHA1 of the input
 func SHA1(s string) string {
 	h := sha1.New()
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -57,8 +58,8 @@ func TestHTTPConnectToNoneExistingDNS(t *testing.T) {
 	}
 	defer conn.Close()
 
-	if string(content) != "" {
-		t.Errorf("Expected read to be empty, got '%s'", string(content))
+	if !strings.HasPrefix(string(content), "HTTP/1.1 502 Bad Gateway") {
+		t.Errorf("Expected a 502 response, got '%s'", string(content))
 	}
 	logLines := w.Content()
 	expected := "Couldn't connect to backend"
@@ -187,6 +188,144 @@ func TestHTTPSBadInput(t *testing.T) {
 	}
 }
 
+func TestHTTPHandshakeTimeout(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.handshakeTimeout = 50 * time.Millisecond
+
+	content, err := requestSilent(handleHTTPConnection, proxy)
+	if err != nil {
+		t.Errorf("%s\n", err)
+		return
+	}
+	if len(content) != 0 {
+		t.Errorf("Expected read to be empty, got '%s'", string(content))
+	}
+	logLines := w.Content()
+	expected := "ERROR: Handshake timeout"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestHTTPSHandshakeTimeout(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.handshakeTimeout = 50 * time.Millisecond
+
+	content, err := requestSilent(handleHTTPSConnection, proxy)
+	if err != nil {
+		t.Errorf("%s\n", err)
+		return
+	}
+	if len(content) != 0 {
+		t.Errorf("Expected read to be empty, got '%s'", string(content))
+	}
+	logLines := w.Content()
+	expected := "ERROR: Handshake timeout"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestHTTPUpstreamDialTimeout(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: timeoutError{}}
+	}
+
+	content, conn, err := requestHTTP("example.com", proxy)
+	if err != nil {
+		t.Errorf("%s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	if !strings.HasPrefix(string(content), "HTTP/1.1 504 Gateway Timeout") {
+		t.Errorf("Expected a 504 response, got '%s'", string(content))
+	}
+	logLines := w.Content()
+	expected := "example.com DEBUG: Upstream dial timeout"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestHTTPIdleTimeout(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.idleTimeout = 100 * time.Millisecond
+	proxy.dial = dialEchoServer(t)
+
+	content, conn, err := requestHTTP("example.com", proxy)
+	if err != nil {
+		t.Errorf("%s\n", err)
+		return
+	}
+	defer conn.Close()
+
+	expected := "Host: example.com"
+	if !strings.Contains(string(content), expected) {
+		t.Errorf("Expected echoed request to contain '%s' got:\n%s", expected, string(content))
+	}
+	logLines := w.Content()
+	expected = "ERROR: Idle timeout"
+	if !strings.Contains(string(logLines), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, string(logLines))
+	}
+}
+
+func TestClientHelloServerName(t *testing.T) {
+	hello := testClientHello("example.com")
+	hostname, err := clientHelloServerName(hello)
+	if err != nil || hostname != "example.com" {
+		t.Fatalf("Expected example.com, got %q, %v", hostname, err)
+	}
+
+	// a truncated hello must neither panic nor return a hostname, even
+	// with the rest of it still in the buffer from an earlier connection
+	for i := 0; i < len(hello); i++ {
+		hostname, err := clientHelloServerName(hello[:i])
+		if hostname != "" {
+			t.Errorf("Expected no hostname from the first %d bytes, got %q, %v", i, hostname, err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func([]byte)
+		expected error
+	}{
+		{"not a ClientHello", func(b []byte) { b[0] = 0x2 }, errNotClientHello},
+		{"name longer than the extension", func(b []byte) { b[len(b)-len("example.com")-1]++ }, errTruncatedHello},
+		{"extension longer than the hello", func(b []byte) { b[len(b)-len("example.com")-6]++ }, errTruncatedHello},
+		{"not a hostname", func(b []byte) { b[len(b)-len("example.com")-3] = 1 }, errNotHostname},
+	}
+	for _, test := range tests {
+		modified := append([]byte(nil), hello...)
+		test.modify(modified)
+		if _, err := clientHelloServerName(modified); err != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+// testClientHello returns a ClientHello handshake message with an empty
+// extension followed by the SNI extension for hostname
+func testClientHello(hostname string) []byte {
+	hello := []byte{0x1, 0, 0, 0, 3, 3}
+	hello = append(hello, make([]byte, 32)...)
+	// no session ID, one cipher suite, no compression
+	hello = append(hello, 0, 0, 2, 0x13, 0x01, 1, 0)
+	sni := []byte{0, byte(len(hostname) + 3), 0, 0, byte(len(hostname))}
+	sni = append(sni, hostname...)
+	extensions := []byte{0xff, 0x01, 0, 0, 0, 0, 0, byte(len(sni))}
+	extensions = append(extensions, sni...)
+	hello = append(hello, 0, byte(len(extensions)))
+	return append(hello, extensions...)
+}
+
 func TestFetchWhiteList(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintln(w, "baea954b95731c68ae6e45bd1e252eb4560cdc45\n93195596cc1951e7857b5cc80a9e9f01b3b43a7c")
@@ -329,6 +468,21 @@ func requestHTTPS(SNIServerName, requestServerName string, proxy *ConnectionProx
 	return content, conn, err
 }
 
+// requestSilent connects to the handler and waits for it to close the
+// connection without ever sending anything
+func requestSilent(handler tcpHandler, proxy *ConnectionProxy) ([]byte, error) {
+	listener, err := getProxyServer(handler, proxy)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ioutil.ReadAll(conn)
+}
+
 func getProxyServer(handler tcpHandler, proxy *ConnectionProxy) (net.Listener, error) {
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -355,6 +509,45 @@ func getMockProxy(mockLogger io.Writer, whiteListedDomains ...string) *Connectio
 	}
 }
 
+// dialEchoServer starts a TCP server that echoes everything back and returns
+// a dial function that connects to it regardless of the requested address
+func dialEchoServer(t *testing.T) dialFunc {
+	return dialTCPServer(t, func(conn net.Conn) {
+		io.Copy(conn, conn)
+		conn.Close()
+	})
+}
+
+// dialTCPServer starts a TCP server that calls handle for each connection
+// and returns a dial function that connects to it regardless of the
+// requested address
+func dialTCPServer(t *testing.T, handle func(net.Conn)) dialFunc {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout(network, listener.Addr().String(), timeout)
+	}
+}
+
+// timeoutError mimics the error the net package returns when a deadline
+// expires
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
 // buffer is just here to make it easier to inject random content into a
 // connection.
 type buffer struct {
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sessionTable keeps track of the open client connections of both
+// listeners for the admin API, so they can be listed and closed
+type sessionTable struct {
+	mutex    sync.Mutex
+	sessions map[string]*session
+}
+
+// session is an open client connection
+type session struct {
+	// received and sent count the bytes from and to the client. They come
+	// first to be aligned for atomic operations on 32 bit platforms.
+	received int64
+	sent     int64
+	table    *sessionTable
+	conn     *clientConn
+	// listener is the port the connection was accepted on
+	listener string
+	started  time.Time
+
+	mutex    sync.Mutex
+	hostname string
+	upstream string
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[string]*session)}
+}
+
+// add tracks conn until it's closed
+func (t *sessionTable) add(conn *clientConn, listener string) {
+	if t == nil {
+		return
+	}
+	conn.session = &session{table: t, conn: conn, listener: listener, started: time.Now()}
+	t.mutex.Lock()
+	t.sessions[conn.id] = conn.session
+	t.mutex.Unlock()
+}
+
+func (t *sessionTable) remove(id string) {
+	t.mutex.Lock()
+	delete(t.sessions, id)
+	t.mutex.Unlock()
+}
+
+// get returns the open connection with the ID, or nil
+func (t *sessionTable) get(id string) *clientConn {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if s, ok := t.sessions[id]; ok {
+		return s.conn
+	}
+	return nil
+}
+
+// count returns the number of open connections
+func (t *sessionTable) count() int {
+	if t == nil {
+		return 0
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.sessions)
+}
+
+// sessionStatus is an open connection as listed by the admin API
+type sessionStatus struct {
+	ID       string `json:"id"`
+	Listener string `json:"listener"`
+	Client   string `json:"client"`
+	Host     string `json:"host"`
+	Upstream string `json:"upstream"`
+	Received int64  `json:"bytes_received"`
+	Sent     int64  `json:"bytes_sent"`
+	Age      string `json:"age"`
+}
+
+// status lists the open connections, oldest first
+func (t *sessionTable) status() []sessionStatus {
+	list := []sessionStatus{}
+	if t == nil {
+		return list
+	}
+	t.mutex.Lock()
+	sessions := make([]*session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+	}
+	t.mutex.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].started.Before(sessions[j].started) })
+	for _, s := range sessions {
+		s.mutex.Lock()
+		list = append(list, sessionStatus{
+			ID:       s.conn.id,
+			Listener: s.listener,
+			Client:   s.conn.RemoteAddr().String(),
+			Host:     s.hostname,
+			Upstream: s.upstream,
+			Received: atomic.LoadInt64(&s.received),
+			Sent:     atomic.LoadInt64(&s.sent),
+			Age:      time.Since(s.started).Round(time.Second).String(),
+		})
+		s.mutex.Unlock()
+	}
+	return list
+}
+
+// setUpstream records the upstream a client connection for hostname was
+// proxied to, if it's a tracked connection
+func setUpstream(downstream net.Conn, hostname string, upstream net.Conn) {
+	c, ok := downstream.(*clientConn)
+	if !ok || c.session == nil {
+		return
+	}
+	c.session.mutex.Lock()
+	c.session.hostname = hostname
+	c.session.upstream = upstream.RemoteAddr().String()
+	c.session.mutex.Unlock()
+}
+
+// sessionCounter returns the byte counter of the session whose client
+// connection is bypassed when copying from src to dstConn, which were
+// unwrapped from srcConn and dst, or nil if the copying goes through it
+func sessionCounter(srcConn net.Conn, src io.Reader, dst, dstConn net.Conn) *int64 {
+	if c, ok := srcConn.(*clientConn); ok && c.session != nil && src == io.Reader(c.Conn) {
+		return &c.session.received
+	}
+	if c, ok := dst.(*clientConn); ok && c.session != nil && dstConn == c.Conn {
+		return &c.session.sent
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// actionTerminate completes the TLS handshake on the proxy with a
+// certificate from CERT_DIR, instead of passing it through to the upstream
+const actionTerminate = "terminate"
+
+// How terminated connections are passed on to the upstream
+const (
+	terminateUpstreamTLS   = "tls"
+	terminateUpstreamPlain = "plain"
+)
+
+// terminateTLS completes the TLS handshake with the client, record being the
+// ClientHello record that was already read to find the hostname, and proxies
+// the decrypted connection to the upstream.
+func (p *ConnectionProxy) terminateTLS(downstream *clientConn, record []byte, hostname string, rule *Rule) bool {
+	downstream.replay = append([]byte(nil), record...)
+	conn := tls.Server(downstream, &tls.Config{
+		GetCertificate:     p.getCertificate,
+		GetConfigForClient: p.alpnChallengeConfig,
+		// the bytes are passed on as is, so only HTTP/1.1 can be
+		// negotiated without knowing what the upstream supports
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := conn.Handshake(); err != nil {
+		if isTimeout(err) {
+			return p.LogError("Handshake timeout", hostname, downstream)
+		}
+		return p.LogError(fmt.Sprintf("TLS handshake failed: %s", err), hostname, downstream)
+	}
+	p.endHandshake(downstream)
+
+	// the handshake was all the ACME server wanted
+	if conn.ConnectionState().NegotiatedProtocol == acmeALPNProtocol {
+		p.Close(conn)
+		p.logger.Printf("%s\n", NewLogData("ACME challenge "+acmeChallengeTLSALPN, "ACCESS", hostname, downstream))
+		return true
+	}
+
+	upstream, fallback, err := p.dialTerminatedUpstream(downstream, hostname, rule)
+	if err != nil {
+		if isMaintenance(err) {
+			return p.serveMaintenance(conn, downstream, err, hostname)
+		}
+		return p.LogUpstreamError(err, hostname, downstream)
+	}
+
+	proxyConnections(conn, conn, upstream, p)
+	return p.LogAccessVia(fallback, hostname, downstream)
+}
+
+// getCertificate picks the certificate for a terminated connection from
+// CERT_DIR, or obtains one with ACME if there isn't any, waiting up to
+// acmeWaitTimeout for it
+func (p *ConnectionProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, err := p.certs.GetCertificate(hello)
+	if p.acme == nil {
+		return cert, err
+	}
+	if err == nil && !isExpired(cert) {
+		p.acme.renewIfNeeded(strings.ToLower(hello.ServerName), cert)
+		return cert, nil
+	}
+	// obtaining a certificate can take longer than the handshake timeout,
+	// which starts over once it's done
+	p.endHandshake(hello.Conn)
+	defer p.startHandshake(hello.Conn)
+	return p.acme.certificate(hello.ServerName)
+}
+
+// canObtainCertificate returns true if a certificate for hostname may be
+// obtained with ACME, which is only done for whitelisted hostnames whose
+// connections are terminated. An empty whitelist allows every hostname, so
+// then the terminate rule has to name the hostname itself, otherwise a
+// wildcard rule would order certificates for any SNI clients send.
+func (p *ConnectionProxy) canObtainCertificate(hostname string) bool {
+	rule := p.config.ruleFor(hostname)
+	if rule.Action != actionTerminate {
+		return false
+	}
+	if size, _ := p.whitelistStatus(); size == 0 {
+		return rule.names(hostname)
+	}
+	return p.IsWhiteListed(hostname)
+}
+
+// alpnChallengeConfig answers ACME tls-alpn-01 validation handshakes with
+// the challenge certificate, other handshakes use the usual config
+func (p *ConnectionProxy) alpnChallengeConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if p.acme == nil || len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acmeALPNProtocol {
+		return nil, nil
+	}
+	cert := p.acme.alpnCertificate(hello.ServerName)
+	if cert == nil {
+		return nil, fmt.Errorf("no pending %s challenge for %q", acmeChallengeTLSALPN, hello.ServerName)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+		NextProtos:   []string{acmeALPNProtocol},
+	}, nil
+}
+
+// dialTerminatedUpstream connects to the upstream for a terminated
+// connection, over TLS unless the rule asks for plain TCP, and returns the
+// fallback it connected to like connectWithFallbacks
+func (p *ConnectionProxy) dialTerminatedUpstream(downstream net.Conn, hostname string, rule *Rule) (net.Conn, string, error) {
+	address := "www." + hostname + ":443"
+	if rule.TerminateUpstream == terminateUpstreamPlain {
+		address = "www." + hostname + ":80"
+	}
+	upstream, fallback, err := p.connectWithFallbacks(downstream, address, hostname, nil, true, true)
+	if err != nil {
+		return nil, fallback, err
+	}
+	if rule.TerminateUpstream == terminateUpstreamPlain {
+		return upstream, fallback, nil
+	}
+
+	config := &tls.Config{}
+	if p.upstreamTLSConfig != nil {
+		config = p.upstreamTLSConfig.Clone()
+	}
+	config.ServerName = "www." + hostname
+	config.NextProtos = []string{"http/1.1"}
+	conn := tls.Client(upstream, config)
+	if p.dialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.dialTimeout))
+	}
+	if err := conn.Handshake(); err != nil {
+		upstream.Close()
+		return nil, fallback, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, fallback, nil
+}
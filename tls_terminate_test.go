@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSTerminate(t *testing.T) {
+	for _, upstreamMode := range []string{terminateUpstreamTLS, terminateUpstreamPlain} {
+		dir := tempDir(t)
+		defer os.RemoveAll(dir)
+		writeTestCertificate(t, dir, "example", time.Hour, "*.example.com", "example.com")
+		certs := newCertStore(dir)
+		if _, err := certs.reload(); err != nil {
+			t.Fatal(err)
+		}
+
+		proxy := getMockProxy(ioutil.Discard, "example.com")
+		proxy.certs = certs
+		proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"example.com"}, Action: actionTerminate, TerminateUpstream: upstreamMode}}}
+		var dialed chan string
+		if upstreamMode == terminateUpstreamTLS {
+			upstreamConfig, upstreamRoots := newTestTLSConfig(t, "www.example.com")
+			proxy.upstreamTLSConfig = &tls.Config{RootCAs: upstreamRoots}
+			dialed = recordDials(proxy, dialTCPServer(t, func(conn net.Conn) {
+				conn = tls.Server(conn, upstreamConfig)
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}))
+		} else {
+			dialed = recordDials(proxy, dialEchoServer(t))
+		}
+
+		roots := x509.NewCertPool()
+		roots.AddCert(certs.lookup("example.com").Leaf)
+		response, err := requestTerminatedHTTPS(proxy, &tls.Config{ServerName: "example.com", RootCAs: roots})
+		if err != nil {
+			t.Fatalf("%s: %s", upstreamMode, err)
+		}
+		// the upstream saw the decrypted request
+		if !strings.HasPrefix(response, "GET / HTTP/1.1\r\nHost: example.com\r\n") {
+			t.Errorf("%s: expected the request to be echoed, got %q", upstreamMode, response)
+		}
+		expected := map[string]string{terminateUpstreamTLS: "www.example.com:443", terminateUpstreamPlain: "www.example.com:80"}[upstreamMode]
+		if address := <-dialed; address != expected {
+			t.Errorf("%s: expected %s to be dialed, got %s", upstreamMode, expected, address)
+		}
+	}
+}
+
+func TestHTTPSTerminateNoCertificate(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.certs = newCertStore(tempDir(t))
+	defer os.RemoveAll(proxy.certs.dir)
+	proxy.config = &Config{Rules: []*Rule{{Hosts: []string{"*"}, Action: actionTerminate}}}
+	proxy.dial = dialEchoServer(t)
+
+	if _, err := requestTerminatedHTTPS(proxy, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true}); err == nil {
+		t.Error("Expected the handshake to fail")
+	}
+	expected := `example.com ERROR: TLS handshake failed`
+	if !strings.Contains(string(w.Content()), expected) {
+		t.Errorf("Expected '%s' in logs, got %s", expected, w.Content())
+	}
+}
+
+func TestCanObtainCertificate(t *testing.T) {
+	config := &Config{Rules: []*Rule{
+		{Hosts: []string{"Example.com", "*.example.com"}, Action: actionTerminate},
+		{Hosts: []string{"example.org"}},
+		{Hosts: []string{"*"}, Action: actionTerminate},
+	}}
+	tests := []struct {
+		whitelist []string
+		hostname  string
+		expected  bool
+	}{
+		{nil, "example.com", true},
+		{nil, "www.example.com", false},
+		{nil, "example.org", false},
+		{nil, "example.net", false},
+		{[]string{"www.example.com", "example.org", "example.net"}, "www.example.com", true},
+		{[]string{"www.example.com", "example.org", "example.net"}, "example.org", false},
+		{[]string{"www.example.com", "example.org", "example.net"}, "example.net", true},
+		{[]string{"www.example.com", "example.org", "example.net"}, "example.com", false},
+	}
+	for _, test := range tests {
+		proxy := getMockProxy(ioutil.Discard, test.whitelist...)
+		proxy.config = config
+		if actual := proxy.canObtainCertificate(test.hostname); actual != test.expected {
+			t.Errorf("%s with whitelist %v: expected %t, got %t", test.hostname, test.whitelist, test.expected, actual)
+		}
+	}
+}
+
+// requestTerminatedHTTPS sends an HTTP request over TLS to the proxy and
+// returns everything the upstream sends back
+func requestTerminatedHTTPS(proxy *ConnectionProxy, config *tls.Config) (string, error) {
+	listener, err := getProxyServer(handleHTTPSConnection, proxy)
+	if err != nil {
+		return "", err
+	}
+	return requestTLS(listener.Addr().String(), config)
+}
+
+// requestTLS sends an HTTP request over TLS to address and returns the
+// response
+func requestTLS(address string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", config.ServerName)
+	conn.CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	return string(response), err
+}
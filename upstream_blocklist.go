@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// defaultUpstreamBlocklist are the networks upstreams may not resolve to
+// unless UPSTREAM_BLOCKLIST says otherwise: private (RFC 1918), loopback,
+// link-local, unique local (ULA) and unspecified addresses, and cloud
+// metadata services not already covered by link-local.
+const defaultUpstreamBlocklist = "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16," +
+	"127.0.0.0/8,::1/128," +
+	"169.254.0.0/16,fe80::/10," +
+	"fc00::/7," +
+	"0.0.0.0/8,::/128," +
+	"100.100.100.200"
+
+type lookupFunc func(host string) ([]net.IP, error)
+
+// blockedUpstreamError is returned when an upstream resolves to an address
+// in the blocklist
+type blockedUpstreamError struct {
+	host string
+	ip   net.IP
+}
+
+func (e *blockedUpstreamError) Error() string {
+	return fmt.Sprintf("%s resolves to %s", e.host, e.ip)
+}
+
+// isBlocked returns true if err is from an upstream in the blocklist
+func isBlocked(err error) bool {
+	_, ok := err.(*blockedUpstreamError)
+	return ok
+}
+
+// resolveUpstream looks up the addresses of the upstream address, e.g.
+// "www.example.com:80". None of them may be in blockedNetworks, rather than
+// just skipping those, so a hostname can't point at internal services
+// alongside a public address. Addresses of the proxy itself aren't allowed
+// either.
+func (p *ConnectionProxy) resolveUpstream(address string) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = p.lookupHost(host); err != nil {
+			return nil, err
+		}
+		// a resolver can answer without any records and no error
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("no addresses for %s", host)
+		}
+	}
+	var addresses []string
+	for _, ip := range ips {
+		if containsIP(p.blockedNetworks, ip) {
+			return nil, &blockedUpstreamError{host: host, ip: ip}
+		}
+		address := net.JoinHostPort(ip.String(), port)
+		if p.localAddrs.contains(ip, port) {
+			return nil, &upstreamLoopError{host: host, address: address}
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// lookupHost returns the IP addresses of host, giving up after dialTimeout
+func (p *ConnectionProxy) lookupHost(host string) ([]net.IP, error) {
+	if p.lookup != nil {
+		return p.lookup(host)
+	}
+	return lookupSystem(host, p.dialTimeout)
+}
+
+// lookupSystem returns the IP addresses of host from the system resolver,
+// giving up after timeout unless it's 0
+func lookupSystem(host string, timeout time.Duration) ([]net.IP, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i := range addrs {
+		ips[i] = addrs[i].IP
+	}
+	return ips, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testHosts resolves the hostnames used in the blocklist tests
+var testHosts = map[string][]string{
+	"www.public.com":   {"93.184.216.34"},
+	"www.private.com":  {"10.1.2.3"},
+	"www.loopback.com": {"127.0.0.1"},
+	"www.metadata.com": {"169.254.169.254"},
+	"www.ula.com":      {"fd00::1"},
+	"www.mapped.com":   {"::ffff:192.168.1.1"},
+	"www.mixed.com":    {"93.184.216.34", "127.0.0.1"},
+}
+
+func lookupTestHost(host string) ([]net.IP, error) {
+	addresses, ok := testHosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	var ips []net.IP
+	for _, address := range addresses {
+		ips = append(ips, net.ParseIP(address))
+	}
+	return ips, nil
+}
+
+func TestHTTPUpstreamBlocklist(t *testing.T) {
+	blocked, err := parseCIDRs(defaultUpstreamBlocklist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hostname string
+		dialed   string
+	}{
+		{"public.com", "93.184.216.34:80"},
+		{"private.com", ""},
+		{"loopback.com", ""},
+		{"metadata.com", ""},
+		{"ula.com", ""},
+		{"mapped.com", ""},
+		{"mixed.com", ""},
+	}
+	for _, test := range tests {
+		w := &BufferWriter{}
+		proxy := getMockProxy(w)
+		proxy.blockedNetworks = blocked
+		proxy.lookup = lookupTestHost
+		dialed := recordDials(proxy, dialEchoServer(t))
+
+		response, err := requestHTTPRaw(fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", test.hostname), proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.dialed != "" {
+			if address := <-dialed; address != test.dialed {
+				t.Errorf("%s: expected %s to be dialed, got %s", test.hostname, test.dialed, address)
+			}
+			continue
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 403 ") {
+			t.Errorf("%s: expected a 403 response, got %q", test.hostname, response)
+		}
+		if len(dialed) != 0 {
+			t.Errorf("%s: expected nothing to be dialed, got %s", test.hostname, <-dialed)
+		}
+		expected := test.hostname + " ERROR: Upstream blocked: www." + test.hostname + " resolves to "
+		if !strings.Contains(string(w.Content()), expected) {
+			t.Errorf("%s: expected %q in logs, got %s", test.hostname, expected, w.Content())
+		}
+	}
+}
+
+func TestHTTPSUpstreamBlocklist(t *testing.T) {
+	w := &BufferWriter{}
+	proxy := getMockProxy(w)
+	proxy.blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	proxy.lookup = lookupTestHost
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	if _, _, err := requestHTTPS("private.com", "private.com", proxy); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected nothing to be dialed, got %s", <-dialed)
+	}
+	expected := "private.com ERROR: Upstream blocked: www.private.com resolves to 10.1.2.3"
+	if !strings.Contains(string(w.Content()), expected) {
+		t.Errorf("Expected %q in logs, got %s", expected, w.Content())
+	}
+}
+
+func TestHTTPChallengeUpstreamNotBlocked(t *testing.T) {
+	proxy := getMockProxy(&BufferWriter{})
+	proxy.blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	proxy.lookup = lookupTestHost
+	proxy.challenges = newChallengeStore("")
+	proxy.challengeUpstream = "10.0.0.5:8080"
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	if _, err := requestHTTPRaw("GET /.well-known/acme-challenge/token HTTP/1.1\r\nHost: private.com\r\n\r\n", proxy); err != nil {
+		t.Fatal(err)
+	}
+	if address := <-dialed; address != "10.0.0.5:8080" {
+		t.Errorf("Expected the challenge upstream to be dialed, got %s", address)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Load balancing strategies of upstream pools
+const (
+	// strategyRoundRobin takes turns, weighted like nginx's smooth weighted
+	// round robin
+	strategyRoundRobin = "round_robin"
+	// strategyLeastConnections picks the backend with the fewest open
+	// connections relative to its weight
+	strategyLeastConnections = "least_connections"
+	// strategyHash keeps clients on the same backend by hashing their IP
+	// address onto a consistent hash ring, so adding or removing a backend
+	// only moves the clients of that backend
+	strategyHash = "hash"
+)
+
+// hashRingReplicas is how many points each unit of weight gets on the ring
+// of a strategyHash pool
+const hashRingReplicas = 100
+
+// Pool is a group of backends that hostnames are proxied to instead of their
+// www upstream, when a rule refers to it by name, e.g.
+//
+//	{
+//	    "pools": {
+//	        "shop": {
+//	            "strategy": "least_connections",
+//	            "backends": [
+//	                {"address": "10.0.0.5", "weight": 2},
+//	                {"address": "10.0.0.6"}
+//	            ]
+//	        }
+//	    },
+//	    "rules": [
+//	        {"hosts": ["shop.example.com"], "pool": "shop"}
+//	    ]
+//	}
+type Pool struct {
+	// Strategy is how backends are picked, round_robin (the default),
+	// least_connections or hash
+	Strategy string `json:"strategy"`
+	// Backends are connected to on the port the connection was received
+	// for, 80 or 443
+	Backends []*Backend `json:"backends"`
+	// HealthCheck takes backends that fail it out of rotation, optional
+	HealthCheck *HealthCheck `json:"health_check"`
+
+	// name is the pool's key in the config
+	name  string
+	mutex sync.Mutex
+	// ring are the points of a strategyHash pool, sorted by hash
+	ring []hashRingPoint
+	// next is where least_connections starts looking, so backends with
+	// the same load take turns
+	next int
+}
+
+// Backend is a server of a pool
+type Backend struct {
+	// Address is its hostname or IP address, without a port
+	Address string `json:"address"`
+	// Weight is its share of the connections relative to the other
+	// backends, defaults to 1
+	Weight int `json:"weight"`
+
+	// active is the number of its open connections
+	active int
+	// current is its state for smooth weighted round robin
+	current int
+	// down is set when it failed its health checks
+	down bool
+	// streak counts the health checks in a row that disagree with down
+	streak int
+}
+
+type hashRingPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+func (p *Pool) validate() error {
+	if p.HealthCheck != nil {
+		if err := p.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+	switch p.Strategy {
+	case "", strategyRoundRobin, strategyLeastConnections, strategyHash:
+	default:
+		return fmt.Errorf("unknown strategy %q", p.Strategy)
+	}
+	if len(p.Backends) == 0 {
+		return fmt.Errorf("no backends")
+	}
+	for _, backend := range p.Backends {
+		if backend.Address == "" {
+			return fmt.Errorf("backend without an address")
+		}
+		if _, _, err := net.SplitHostPort(backend.Address); err == nil {
+			return fmt.Errorf("backend %q has a port, the one the connection was received for is used", backend.Address)
+		}
+		if backend.Weight < 0 {
+			return fmt.Errorf("backend %q has a negative weight", backend.Address)
+		}
+		if backend.Weight == 0 {
+			backend.Weight = 1
+		}
+	}
+	if p.Strategy == strategyHash {
+		for _, backend := range p.Backends {
+			for i := 0; i < backend.Weight*hashRingReplicas; i++ {
+				p.ring = append(p.ring, hashRingPoint{hashString(backend.Address + "#" + strconv.Itoa(i)), backend})
+			}
+		}
+		sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	}
+	return nil
+}
+
+// hashString hashes s for the ring. FNV on its own keeps similar strings,
+// such as neighbouring IP addresses, close together, the finalizer of
+// splitmix64 spreads them over the ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// pick returns the backend for a connection from client, and counts the
+// connection as open on it until release is called. Backends that are down
+// are skipped, nil is returned if all of them are.
+func (p *Pool) pick(client string) *Backend {
+	return p.pickExcept(client, nil)
+}
+
+// pickExcept is pick, also skipping the backends in tried
+func (p *Pool) pickExcept(client string, tried map[*Backend]bool) *Backend {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var picked *Backend
+	switch p.Strategy {
+	case strategyLeastConnections:
+		for i := range p.Backends {
+			backend := p.Backends[(p.next+i)%len(p.Backends)]
+			// fewer connections per weight, without dividing
+			if !backend.down && !tried[backend] && (picked == nil || backend.active*picked.Weight < picked.active*backend.Weight) {
+				picked = backend
+			}
+		}
+		p.next = (p.next + 1) % len(p.Backends)
+	case strategyHash:
+		// the clients of a backend that's down move on to the next one on
+		// the ring
+		hash := hashString(client)
+		i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= hash })
+		for j := 0; j < len(p.ring) && picked == nil; j++ {
+			if backend := p.ring[(i+j)%len(p.ring)].backend; !backend.down && !tried[backend] {
+				picked = backend
+			}
+		}
+	default:
+		total := 0
+		for _, backend := range p.Backends {
+			if backend.down || tried[backend] {
+				continue
+			}
+			backend.current += backend.Weight
+			total += backend.Weight
+			if picked == nil || backend.current > picked.current {
+				picked = backend
+			}
+		}
+		if picked != nil {
+			picked.current -= total
+		}
+	}
+	if picked != nil {
+		picked.active++
+	}
+	return picked
+}
+
+// release counts a connection to backend as closed
+func (p *Pool) release(backend *Backend) {
+	p.mutex.Lock()
+	backend.active--
+	p.mutex.Unlock()
+}
+
+// dial connects to a backend for the upstream address, on its port
+func (p *Pool) dial(proxy *ConnectionProxy, address string, downstream net.Conn) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	client := ""
+	if downstream != nil {
+		client, _, _ = net.SplitHostPort(downstream.RemoteAddr().String())
+	}
+	err = fmt.Errorf("no healthy backends in pool %s", p.name)
+	// backends that can't be connected to, or whose circuit breaker is
+	// open, are passed over for the next one until all have been tried
+	tried := map[*Backend]bool{}
+	for {
+		backend := p.pickExcept(client, tried)
+		if backend == nil {
+			return nil, err
+		}
+		tried[backend] = true
+		// backends are configured rather than requested, so they aren't
+		// checked against the blocklist
+		var conn net.Conn
+		if conn, err = proxy.dialBreaker(net.JoinHostPort(backend.Address, port)); err == nil {
+			return &backendConn{Conn: conn, release: func() { p.release(backend) }}, nil
+		}
+		p.release(backend)
+	}
+}
+
+// backendConn is a connection to a pool backend, which counts as open on it
+// until it's closed
+type backendConn struct {
+	net.Conn
+	release func()
+	closed  sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.closed.Do(c.release)
+	return c.Conn.Close()
+}
+
+// poolFor returns the pool the rule for hostname refers to, or nil if it
+// doesn't
+func (c *Config) poolFor(hostname string) *Pool {
+	rule := c.ruleFor(hostname)
+	if rule.Pool == "" {
+		return nil
+	}
+	return c.Pools[rule.Pool]
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestPool(t *testing.T, strategy string, backends ...*Backend) *Pool {
+	pool := &Pool{Strategy: strategy, Backends: backends}
+	if err := pool.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := newTestPool(t, "", &Backend{Address: "a", Weight: 2}, &Backend{Address: "b"})
+	var picked []string
+	for i := 0; i < 6; i++ {
+		backend := pool.pick("")
+		picked = append(picked, backend.Address)
+		pool.release(backend)
+	}
+	if strings.Join(picked, "") != "abaaba" {
+		t.Errorf("Expected the weighted backends to be interleaved, got %s", strings.Join(picked, ""))
+	}
+}
+
+func TestPoolLeastConnections(t *testing.T) {
+	pool := newTestPool(t, strategyLeastConnections, &Backend{Address: "a", Weight: 2}, &Backend{Address: "b"})
+	a, b := pool.pick(""), pool.pick("")
+	if a.Address != "a" || b.Address != "b" {
+		t.Fatalf("Expected both backends to be picked, got %s and %s", a.Address, b.Address)
+	}
+	// a has half a connection per weight, b one
+	if backend := pool.pick(""); backend.Address != "a" {
+		t.Errorf("Expected the backend with more weight to get the third connection, got %s", backend.Address)
+	}
+	pool.release(b)
+	if backend := pool.pick(""); backend.Address != "b" {
+		t.Errorf("Expected the idle backend, got %s", backend.Address)
+	}
+}
+
+func TestPoolHash(t *testing.T) {
+	backends := []*Backend{{Address: "a"}, {Address: "b"}, {Address: "c"}}
+	pool := newTestPool(t, strategyHash, backends...)
+	without := newTestPool(t, strategyHash, &Backend{Address: "a"}, &Backend{Address: "b"})
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		client := fmt.Sprintf("192.0.2.%d", i)
+		backend := pool.pick(client)
+		if again := pool.pick(client); again != backend {
+			t.Fatalf("%s: expected the same backend, got %s and %s", client, backend.Address, again.Address)
+		}
+		counts[backend.Address]++
+		// only the clients of the removed backend move
+		if backend.Address != "c" && without.pick(client).Address != backend.Address {
+			t.Fatalf("%s: expected to stay on %s when c is removed", client, backend.Address)
+		}
+	}
+	for _, backend := range backends {
+		if counts[backend.Address] < 700 {
+			t.Errorf("Expected the clients to be spread over the backends, got %v", counts)
+			break
+		}
+	}
+}
+
+func TestLoadConfigPools(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{`{"rules": [{"hosts": ["*"], "pool": "web"}], "pools": {"web": {"strategy": "hash", "backends": [{"address": "10.0.0.5"}]}}}`, ""},
+		{`{"rules": [{"hosts": ["*"], "pool": "web"}]}`, `rule 1: unknown pool "web"`},
+		{`{"pools": {"web": {"strategy": "random", "backends": [{"address": "10.0.0.5"}]}}}`, `pool "web": unknown strategy "random"`},
+		{`{"pools": {"web": {}}}`, `pool "web": no backends`},
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5:8080"}]}}}`, `backend "10.0.0.5:8080" has a port`},
+		{`{"pools": {"web": {"backends": [{"address": "10.0.0.5", "weight": -1}]}}}`, "negative weight"},
+	}
+	dir := tempDir(t)
+	for _, test := range tests {
+		path := dir + "/rules.json"
+		if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config, err := loadConfig(path)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.content, err)
+			} else if config.poolFor("example.com") != config.Pools["web"] {
+				t.Errorf("%s: pool not loaded", test.content)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.content, test.err, err)
+		}
+	}
+}
+
+func TestPoolUpstream(t *testing.T) {
+	pool := newTestPool(t, "", &Backend{Address: "10.0.0.5"}, &Backend{Address: "2001:db8::5"})
+	proxy := getMockProxy(ioutil.Discard)
+	proxy.config = &Config{
+		Rules: []*Rule{{Hosts: []string{"example.com"}, Pool: "web"}},
+		Pools: map[string]*Pool{"web": pool},
+	}
+	// backends are configured, so they may be on private networks
+	proxy.blockedNetworks, _ = parseCIDRs(defaultUpstreamBlocklist)
+	dialed := recordDials(proxy, dialEchoServer(t))
+
+	for _, expected := range []string{"10.0.0.5:80", "[2001:db8::5]:80"} {
+		if _, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy); err != nil {
+			t.Fatal(err)
+		}
+		if address := <-dialed; address != expected {
+			t.Errorf("Expected %s to be dialed, got %s", expected, address)
+		}
+	}
+	go requestHTTPS("example.com", "example.com", proxy)
+	if address := <-dialed; address != "10.0.0.5:443" {
+		t.Errorf("Expected the HTTPS port of the backend to be dialed, got %s", address)
+	}
+
+	// the connections are counted until they're closed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pool.mutex.Lock()
+		active := pool.Backends[0].active + pool.Backends[1].active
+		pool.mutex.Unlock()
+		if active == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected no open connections, got %d", active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	for _, strategy := range []string{"", strategyLeastConnections, strategyHash} {
+		pool := newTestPool(t, strategy, &Backend{Address: "10.0.0.5"}, &Backend{Address: "10.0.0.6"}, &Backend{Address: "10.0.0.7"})
+		proxy := getMockProxy(ioutil.Discard)
+		proxy.config = &Config{
+			Rules: []*Rule{{Hosts: []string{"example.com"}, Pool: "web"}},
+			Pools: map[string]*Pool{"web": pool},
+		}
+		dials := map[string]dialFunc{"10.0.0.5:80": dialRefused, "10.0.0.6:80": dialRefused, "10.0.0.7:80": dialRefused}
+		var dialed func() []string
+		proxy.dial, dialed = dialByAddress(dials)
+
+		// every backend is tried before giving up
+		response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(response), "HTTP/1.1 502 ") {
+			t.Errorf("%q: expected a 502 response, got %q", strategy, response)
+		}
+		if len(dialed()) != 3 {
+			t.Errorf("%q: expected each backend to be dialed once, got %v", strategy, dialed())
+		}
+
+		// and the one that works is used
+		dials["10.0.0.6:80"] = dialEchoServer(t)
+		for i := 0; i < 3; i++ {
+			response, err := requestHTTPRaw("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", proxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(response), "GET / HTTP/1.1") {
+				t.Errorf("%q: expected the request to be echoed, got %q", strategy, response)
+			}
+		}
+	}
+}